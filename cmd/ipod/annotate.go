@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/trace"
+)
+
+// maxAnnotationValue is the length values are cut to in annotations
+const maxAnnotationValue = 48
+
+// traceAnnotator writes comments to the trace: the decoded commands
+// of every frame if enabled and markers inserted at runtime
+type traceAnnotator struct {
+	mu       sync.Mutex
+	tw       *trace.Writer
+	commands bool
+	markers  int
+}
+
+// annotator is set when a trace is written
+var annotator *traceAnnotator
+
+// command writes a comment describing the command after its frame
+func (a *traceAnnotator) command(dir trace.Dir, cmd *ipod.Command, err error) {
+	if a == nil || !a.commands {
+		return
+	}
+	text := commandSummary(cmd)
+	if err != nil {
+		text += " error: " + err.Error()
+	}
+	a.tw.WriteComment(dirPrefix(dir, text))
+}
+
+// marker writes a marker comment. An empty text is replaced with a numbered one.
+func (a *traceAnnotator) marker(text string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.markers++
+	if text == "" {
+		text = fmt.Sprintf("marker %d", a.markers)
+	}
+	a.mu.Unlock()
+	a.tw.WriteComment("marker: " + text)
+	log.WithField("text", text).Warn("marker")
+}
+
+// commandSummary describes a command on a single line i.e.
+//
+//	general.ReturniPodName trx=0x0002 Name="ipod"
+func commandSummary(cmd *ipod.Command) string {
+	if cmd == nil {
+		return "<nil>"
+	}
+	name := commandName(cmd)
+	parts := []string{name}
+	if cmd.Transaction != nil {
+		parts = append(parts, "trx="+cmd.Transaction.String())
+	}
+	if fields := fieldSummary(cmd, maxAnnotationValue); fields != "" {
+		parts = append(parts, fields)
+	}
+	return strings.Join(parts, " ")
+}
+
+// fieldSummary lists the fields of the command as path=value,
+// values longer than maxValue are cut (0 keeps them whole)
+func fieldSummary(cmd *ipod.Command, maxValue int) string {
+	name := commandName(cmd)
+	var parts []string
+	for _, f := range commandFields(cmd, ignoreRules{"*.Transaction"}) {
+		value := f.Value
+		if maxValue > 0 && len(value) > maxValue {
+			value = value[:maxValue-3] + "..."
+		}
+		parts = append(parts, strings.TrimPrefix(f.Path, name+".")+"="+value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// handleMarkers inserts a marker on SIGUSR1 and, if r is set,
+// for every line read from r
+func handleMarkers(r io.Reader) {
+	if annotator == nil {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	go func() {
+		for range sig {
+			annotator.marker("")
+		}
+	}()
+	if r != nil {
+		go func() {
+			s := bufio.NewScanner(r)
+			for s.Scan() {
+				annotator.marker(strings.TrimSpace(s.Text()))
+			}
+		}()
+	}
+}
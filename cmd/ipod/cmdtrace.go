@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	"github.com/oandrew/ipod/trace"
+)
+
+// commandTracer records the commands handled by processFrames
+// to a command trace
+type commandTracer struct {
+	mu    sync.Mutex
+	w     *trace.CommandWriter
+	start time.Time
+	frame uint
+}
+
+// cmdTracer is set when serving with --write-commands
+var cmdTracer *commandTracer
+
+func newCommandTracer(path string, appendMode bool) (*commandTracer, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendMode {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &commandTracer{
+		w:     trace.NewCommandWriter(f),
+		start: time.Now(),
+	}, nil
+}
+
+// nextFrame returns the number of the next frame
+func (t *commandTracer) nextFrame() uint {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	frame := t.frame
+	t.frame++
+	return frame
+}
+
+func (t *commandTracer) record(dir trace.Dir, frame uint, cmd *ipod.Command, packet []byte, err error) {
+	if t == nil {
+		return
+	}
+	rec := trace.NewCommandRecord(dir, frame, cmd, packet, err)
+	rec.TS = time.Since(t.start)
+	if err := t.w.WriteRecord(rec); err != nil {
+		log.WithError(err).Errorf("could not write the command trace")
+	}
+}
+
+func (t *commandTracer) Close() error {
+	return t.w.Close()
+}
+
+// exportCommands writes the commands of a trace as a command trace
+func exportCommands(path string, tr *trace.Reader, reportDefs hid.ReportDefs) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	w := trace.NewCommandWriter(bw)
+	var frameNum uint
+	var writeErr error
+	err = decodeTrace(tr, reportDefs, func(frame *trace.Frame) {
+		defer func() { frameNum++ }()
+		for _, p := range frame.Packets {
+			err := p.Err
+			if err == nil {
+				err = p.CmdErr
+			}
+			rec := trace.NewCommandRecord(frame.Dir, frameNum, p.Cmd, p.Data, err)
+			rec.TS = frame.TS
+			if err := w.WriteRecord(rec); err != nil && writeErr == nil {
+				writeErr = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// isCommandTraceFile peeks at the start of a trace to tell
+// a command trace from a report trace
+func isCommandTraceFile(path string, br *bufio.Reader) bool {
+	if strings.HasSuffix(path, ".jsonl") || strings.HasSuffix(path, ".jsonl.gz") {
+		return true
+	}
+	start, _ := br.Peek(64)
+	return trace.IsCommandTrace(start)
+}
+
+// encodeCommandTrace converts a command trace to a report trace
+// for the report defs selected on the command line
+func encodeCommandTrace(r io.Reader, legacy bool) (*trace.Reader, error) {
+	var buf bytes.Buffer
+	w := trace.NewWriter(&buf)
+	err := w.WriteHeader(&trace.Header{
+		Date:       time.Now(),
+		Tool:       "ipod " + version,
+		Device:     "command trace",
+		Legacy:     legacy,
+		ReportDefs: hidReportDefs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := trace.EncodeCommands(trace.NewCommandReader(r), w, hidReportDefs); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return trace.NewReader(&buf), nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/oandrew/ipod"
+)
+
+// deviceConfig is the identity of the emulated device i.e.
+//
+//	name: ipod-gadget
+//	serial: abcd1234
+//	software_version: 7.1.2
+//	model_id: 0x00111349
+//	model: MC676
+//	max_payload: 65535
+//	supported_events: 0x0
+//	lingo_versions:
+//	  general: 1.9
+//	  extremote: 1.12
+//	lingo_options:
+//	  general: 0x000000063DEF73FF
+//
+// Lingoes are given by name or id. If lingo_versions is set it lists the
+// supported lingoes and any other lingo is refused, the default device
+// and configs without it answer every lingo.
+// Fields that are not set keep the defaults or the values of the profile.
+type deviceConfig struct {
+	Name            string            `yaml:"name"`
+	Serial          string            `yaml:"serial"`
+	SoftwareVersion string            `yaml:"software_version"`
+	ModelID         uint32            `yaml:"model_id"`
+	Model           string            `yaml:"model"`
+	MaxPayload      uint16            `yaml:"max_payload"`
+	SupportedEvents uint64            `yaml:"supported_events"`
+	LingoVersions   map[string]string `yaml:"lingo_versions"`
+	LingoOptions    map[string]uint64 `yaml:"lingo_options"`
+
+	softwareVersion [3]uint8
+	lingoVersions   map[uint8][2]uint8
+	lingoOptions    map[uint8]uint64
+	// strict refuses the lingoes missing from LingoVersions,
+	// set by profiles and by configs that list the lingo versions
+	strict bool
+}
+
+// defaultDeviceConfig is an iPhone 4
+var defaultDeviceConfig = deviceConfig{
+	Name:            "ipod-gadget",
+	Serial:          "abcd1234",
+	SoftwareVersion: "7.1.2",
+	ModelID:         0x00111349,
+	Model:           "MC676",
+	MaxPayload:      65535,
+	LingoVersions: map[string]string{
+		"general":    "1.9",
+		"dispremote": "1.5",
+		"extremote":  "1.12",
+		"audio":      "1.2",
+	},
+	LingoOptions: map[string]uint64{
+		"general": 0x000000063DEF73FF,
+	},
+}
+
+// resolvedDefaultConfig is used by devices without a config
+var resolvedDefaultConfig = func() *deviceConfig {
+	cfg := copyDeviceConfig(&defaultDeviceConfig)
+	if err := cfg.resolve(); err != nil {
+		panic(err)
+	}
+	return cfg
+}()
+
+// lingoIDs are the lingo names used in configs
+var lingoIDs = map[string]uint8{
+	"general":      ipod.LingoGeneralID,
+	"simpleremote": ipod.LingoSimpleRemoteID,
+	"dispremote":   ipod.LingoDisplayRemoteID,
+	"extremote":    ipod.LingoExtRemoteID,
+	"usbhost":      ipod.LingoUSBHostID,
+	"rftuner":      ipod.LingoRFTunerID,
+	"eq":           ipod.LingoEqID,
+	"sports":       ipod.LingoSportsID,
+	"audio":        ipod.LingoDigitalAudioID,
+	"storage":      ipod.LingoStorageID,
+}
+
+func parseLingo(s string) (uint8, error) {
+	if id, ok := lingoIDs[strings.ToLower(s)]; ok {
+		return id, nil
+	}
+	id, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown lingo %q", s)
+	}
+	return uint8(id), nil
+}
+
+// parseVersion parses a dotted version with n parts i.e. 1.12 or 7.1.2
+func parseVersion(s string, n int) ([]uint8, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != n {
+		return nil, fmt.Errorf("bad version %q: expected %d numbers", s, n)
+	}
+	v := make([]uint8, n)
+	for i, p := range parts {
+		x, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad version %q", s)
+		}
+		v[i] = uint8(x)
+	}
+	return v, nil
+}
+
+// resolve checks the config and parses the versions and lingoes
+func (c *deviceConfig) resolve() error {
+	v, err := parseVersion(c.SoftwareVersion, 3)
+	if err != nil {
+		return fmt.Errorf("software_version: %v", err)
+	}
+	copy(c.softwareVersion[:], v)
+
+	c.lingoVersions = make(map[uint8][2]uint8)
+	for lingo, version := range c.LingoVersions {
+		id, err := parseLingo(lingo)
+		if err != nil {
+			return fmt.Errorf("lingo_versions: %v", err)
+		}
+		v, err := parseVersion(version, 2)
+		if err != nil {
+			return fmt.Errorf("lingo_versions: %s: %v", lingo, err)
+		}
+		c.lingoVersions[id] = [2]uint8{v[0], v[1]}
+	}
+
+	c.lingoOptions = make(map[uint8]uint64)
+	for lingo, options := range c.LingoOptions {
+		id, err := parseLingo(lingo)
+		if err != nil {
+			return fmt.Errorf("lingo_options: %v", err)
+		}
+		c.lingoOptions[id] = options
+	}
+	return nil
+}
+
+// copyDeviceConfig returns a copy of c that shares nothing with it
+func copyDeviceConfig(c *deviceConfig) *deviceConfig {
+	cfg := *c
+	cfg.LingoVersions = make(map[string]string)
+	for k, v := range c.LingoVersions {
+		cfg.LingoVersions[k] = v
+	}
+	cfg.LingoOptions = make(map[string]uint64)
+	for k, v := range c.LingoOptions {
+		cfg.LingoOptions[k] = v
+	}
+	return &cfg
+}
+
+// parseDeviceConfig reads a yaml config on top of base.
+// Lingo versions and options replace the ones of base as a whole.
+func parseDeviceConfig(data []byte, base *deviceConfig) (*deviceConfig, error) {
+	cfg := copyDeviceConfig(base)
+	cfg.LingoVersions, cfg.LingoOptions = nil, nil
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.LingoVersions == nil {
+		cfg.LingoVersions = base.LingoVersions
+	} else {
+		cfg.strict = true
+	}
+	if cfg.LingoOptions == nil {
+		cfg.LingoOptions = base.LingoOptions
+	}
+	cfg = copyDeviceConfig(cfg)
+	if err := cfg.resolve(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadDeviceConfig(path string, base *deviceConfig) (*deviceConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseDeviceConfig(data, base)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
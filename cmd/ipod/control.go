@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/trace"
+)
+
+// defaultControlSocket is where ipod ctl connects to by default
+const defaultControlSocket = "/tmp/ipod.sock"
+
+// controlState is the session state as served by the control api
+type controlState struct {
+	UIMode         string                 `json:"ui_mode"`
+	Transactions   bool                   `json:"transactions"`
+	EventMask      uint64                 `json:"event_mask"`
+	PlayStatusMask uint32                 `json:"play_status_mask"`
+	Tokens         []*trace.CommandRecord `json:"tokens"`
+	Track          trackMetadata          `json:"track"`
+}
+
+func newControlState(st sessionState) *controlState {
+	cs := &controlState{
+		UIMode:         uiModeNames[st.UIMode],
+		Transactions:   st.Transactions,
+		EventMask:      st.EventMask,
+		PlayStatusMask: st.PlayStatusMask,
+		Tokens:         []*trace.CommandRecord{},
+		Track:          devExtRemote.Track(),
+	}
+	if cs.UIMode == "" {
+		cs.UIMode = fmt.Sprintf("%#02x", uint8(st.UIMode))
+	}
+	for _, token := range st.Tokens {
+		rec := trace.NewCommandRecord(trace.DirIn, 0, &ipod.Command{Payload: token.Token}, nil, nil)
+		cs.Tokens = append(cs.Tokens, rec)
+	}
+	return cs
+}
+
+// controlEvent is a line of the event stream: a command from the accessory
+// or the session state after it changed
+type controlEvent struct {
+	Type    string               `json:"type"`
+	Command *trace.CommandRecord `json:"command,omitempty"`
+	State   *controlState        `json:"state,omitempty"`
+}
+
+// eventHub passes the events of a session to the event streams.
+// Events are dropped for streams that don't keep up.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan controlEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan controlEvent]struct{})}
+}
+
+func (h *eventHub) subscribe() chan controlEvent {
+	ch := make(chan controlEvent, 64)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan controlEvent) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) publish(ev controlEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Warn("control: event stream is behind, dropping an event")
+		}
+	}
+}
+
+func (h *eventHub) command(rec *trace.CommandRecord) {
+	h.publish(controlEvent{Type: "command", Command: rec})
+}
+
+func (h *eventHub) state(st sessionState) {
+	h.publish(controlEvent{Type: "state", State: newControlState(st)})
+}
+
+// sendRequest is the body of POST /send: a command by name with
+// Field=value fields like in the shell or a raw hex packet
+type sendRequest struct {
+	Name   string            `json:"name,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Packet string            `json:"packet,omitempty"`
+}
+
+type controlError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, controlError{err.Error()})
+}
+
+// controlHandler serves the control api of a session:
+//
+//	GET /state       session state and the now playing track
+//	GET /metadata    the now playing track
+//	PUT /metadata    update fields of the now playing track
+//	GET /events      json lines of commands from the accessory and state changes
+//	POST /send       send a command {"name": "...", "fields": {...}} or {"packet": "hex"}
+func controlHandler(ctx context.Context, s *session) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		writeJSON(w, http.StatusOK, newControlState(s.state()))
+	})
+	mux.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			// merged under the lock so concurrent updates don't undo each other
+			prev, track, err := devExtRemote.UpdateTrack(func(track *trackMetadata) error {
+				return json.Unmarshal(body, track)
+			})
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			log.WithField("title", track.Title).WithField("state", track.State).Info("control: track updated")
+			for _, note := range playStatusNotifications(s.state().PlayStatusMask, prev, track) {
+				if _, _, err := s.send(note); err != nil {
+					log.WithError(err).Warn("control: could not send the play status notification")
+				}
+			}
+			s.events.state(s.state())
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		writeJSON(w, http.StatusOK, devExtRemote.Track())
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+			return
+		}
+		ch := s.events.subscribe()
+		defer s.events.unsubscribe(ch)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.Encode(controlEvent{Type: "state", State: newControlState(s.state())})
+		flusher.Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ctx.Done():
+				return
+			case ev := <-ch:
+				if err := enc.Encode(ev); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		var req sendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		cmd, packet, err := sendControlRequest(s, &req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		rec := s.record(trace.DirOut, 0, cmd, packet, nil)
+		writeJSON(w, http.StatusOK, rec)
+	})
+	return mux
+}
+
+func sendControlRequest(s *session, req *sendRequest) (*ipod.Command, []byte, error) {
+	if req.Packet != "" {
+		if req.Name != "" {
+			return nil, nil, fmt.Errorf("either name or packet is expected")
+		}
+		packet, err := hex.DecodeString(strings.Replace(req.Packet, " ", "", -1))
+		if err != nil {
+			return nil, nil, fmt.Errorf("packet: %v", err)
+		}
+		cmd, err := s.sendPacket(packet)
+		return cmd, packet, err
+	}
+	_, payload, ok := ipod.LookupName(req.Name)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown command %q", req.Name)
+	}
+	var assigns []string
+	for k, v := range req.Fields {
+		assigns = append(assigns, k+"="+v)
+	}
+	sort.Strings(assigns)
+	if err := setFields(payload, assigns); err != nil {
+		return nil, nil, err
+	}
+	return s.send(payload)
+}
+
+// serveControl serves the control api on a unix socket until ctx is canceled
+func serveControl(ctx context.Context, path string, s *session) error {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s is in use by another serve", path)
+		}
+		// left over by a previous run
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: controlHandler(ctx, s)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.WithField("path", path).Warn("control socket listening")
+	err = srv.Serve(l)
+	os.Remove(path)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// controlClient talks to the control api of a running serve
+type controlClient struct {
+	http http.Client
+}
+
+func newControlClient(path string) *controlClient {
+	return &controlClient{http: http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+}
+
+// do sends a request with an optional json body and copies the response to w
+func (c *controlClient) do(method, url string, body interface{}, w io.Writer) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = strings.NewReader(string(data))
+	}
+	req, err := http.NewRequest(method, "http://ipod"+url, r)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e controlError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+		}
+		return fmt.Errorf("%s", e.Error)
+	}
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, werr := w.Write(line); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseAssigns parses key=value arguments
+func parseAssigns(args []string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, a := range args {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("bad argument %q: expected key=value", a)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// metadataUpdate converts key=value arguments to the fields of trackMetadata
+func metadataUpdate(args []string) (map[string]interface{}, error) {
+	assigns, err := parseAssigns(args)
+	if err != nil {
+		return nil, err
+	}
+	update := make(map[string]interface{})
+	for k, v := range assigns {
+		switch k {
+		case "title", "artist", "album", "state":
+			update[k] = v
+		case "length_ms", "position_ms":
+			var n uint32
+			if _, err := fmt.Sscan(v, &n); err != nil {
+				return nil, fmt.Errorf("%s: %v", k, err)
+			}
+			update[k] = n
+		default:
+			return nil, fmt.Errorf("unknown field %q: expected title, artist, album, length_ms, position_ms or state", k)
+		}
+	}
+	return update, nil
+}
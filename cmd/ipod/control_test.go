@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod"
+	extremote "github.com/oandrew/ipod/lingo-extremote"
+)
+
+// frameRecorder is a transport that keeps the written frames
+type frameRecorder struct {
+	frames [][]byte
+}
+
+func (r *frameRecorder) ReadFrame() ([]byte, error) {
+	return nil, io.EOF
+}
+
+func (r *frameRecorder) WriteFrame(data []byte) error {
+	r.frames = append(r.frames, append([]byte(nil), data...))
+	return nil
+}
+
+func TestControlHandler(t *testing.T) {
+	devExtRemote = newDevExtRemote()
+	defer func() { devExtRemote = newDevExtRemote() }()
+	tr := &frameRecorder{}
+	srv := httptest.NewServer(controlHandler(context.Background(), newSession(tr)))
+	defer srv.Close()
+
+	do := func(method, path, body string, wantStatus int, v interface{}) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("%s %s: got %s want %d", method, path, resp.Status, wantStatus)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var track trackMetadata
+	do("PUT", "/metadata", `{"title":"Song 2","state":"playing"}`, http.StatusOK, &track)
+	if track.Title != "Song 2" || track.State != "playing" || track.Artist != defaultTrack.Artist {
+		t.Errorf("got track %+v", track)
+	}
+	do("PUT", "/metadata", `{"state":"dancing"}`, http.StatusBadRequest, nil)
+	if _, _, state := devExtRemote.PlaybackStatus(); state != playerStates["playing"] {
+		t.Errorf("got state %v after a bad update", state)
+	}
+
+	var st controlState
+	do("GET", "/state", "", http.StatusOK, &st)
+	if st.UIMode != "standard" || st.Track.Title != "Song 2" {
+		t.Errorf("got state %+v", st)
+	}
+
+	do("POST", "/send", `{"name":"extremote.PlayStatusChangeNotification","fields":{"Status":"1"}}`, http.StatusOK, nil)
+	do("POST", "/send", `{"packet":"04 00 27 02"}`, http.StatusOK, nil)
+	do("POST", "/send", `{"name":"extremote.Nope"}`, http.StatusBadRequest, nil)
+	if len(tr.frames) != 2 {
+		t.Fatalf("got %d frames want 2", len(tr.frames))
+	}
+	for i, want := range [][]byte{{0x04, 0x00, 0x27, 0x01}, {0x04, 0x00, 0x27, 0x02}} {
+		pkt, err := ipod.NewPacketReader(tr.frames[i]).ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pkt, want) {
+			t.Errorf("frame %d: got packet % 02x want % 02x", i, pkt, want)
+		}
+	}
+}
+
+func TestControlMetadataNotifications(t *testing.T) {
+	devExtRemote = newDevExtRemote()
+	defer func() { devExtRemote = newDevExtRemote() }()
+	tr := &frameRecorder{}
+	s := newSession(tr)
+	s.playStatusMask = extremote.PlayStatusMaskExtended | extremote.PlayStatusMaskTrackIndex
+	srv := httptest.NewServer(controlHandler(context.Background(), s))
+	defer srv.Close()
+
+	put := func(body string) {
+		t.Helper()
+		req, err := http.NewRequest("PUT", srv.URL+"/metadata", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("PUT %s: got %s", body, resp.Status)
+		}
+	}
+	put(`{"title":"Song 2","state":"playing"}`)
+	// the position isn't enabled in the mask
+	put(`{"title":"Song 2","position_ms":1000}`)
+	want := [][]byte{
+		{0x04, 0x00, 0x27, 0x01, 0x00, 0x00, 0x00, 0x00},
+		{0x04, 0x00, 0x27, 0x06, 0x0A},
+	}
+	if len(tr.frames) != len(want) {
+		t.Fatalf("got %d frames want %d", len(tr.frames), len(want))
+	}
+	for i := range want {
+		pkt, err := ipod.NewPacketReader(tr.frames[i]).ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pkt, want[i]) {
+			t.Errorf("frame %d: got packet % 02x want % 02x", i, pkt, want[i])
+		}
+	}
+}
+
+func TestServeControlInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipod.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serveControl(ctx, path, newSession(&frameRecorder{})) }()
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := serveControl(ctx, path, newSession(&frameRecorder{})); err == nil {
+		t.Error("got no error for a socket in use")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
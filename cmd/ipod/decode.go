@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	"github.com/oandrew/ipod/trace"
+)
+
+// decodeTrace decodes the frames of both directions of a trace
+// and calls fn for each frame in the order the frames were started
+func decodeTrace(tr *trace.Reader, reportDefs hid.ReportDefs, fn func(*trace.Frame)) error {
+	d := trace.NewDecoder(tr, reportDefs)
+	for {
+		frame, err := d.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(frame)
+	}
+}
+
+// commandName returns the name of the command payload type i.e. general.ACK
+func commandName(cmd *ipod.Command) string {
+	if cmd == nil || cmd.Payload == nil {
+		return "<nil>"
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", cmd.Payload), "*")
+}
+
+// lingoName returns the name of the lingo of the command i.e. general
+// or its id if the command is unknown
+func lingoName(cmd *ipod.Command) string {
+	if _, ok := cmd.Payload.(ipod.UnknownPayload); ok || cmd.Payload == nil {
+		return fmt.Sprintf("%#02x", cmd.ID.LingoID())
+	}
+	name := commandName(cmd)
+	return name[:strings.Index(name, ".")]
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/trace"
+)
+
+// defaultIgnoreRules are fields that differ between any two sessions
+var defaultIgnoreRules = []string{
+	"*.Transaction",
+	"dispremote.InfoDateTime",
+}
+
+// ignoreRules decide which command fields are skipped when comparing.
+// A rule is a pattern (see path.Match) matched against the field path
+// i.e. general.RetAccessoryInfo.InfoData or against the type name of
+// the field value i.e. dispremote.InfoDateTime
+type ignoreRules []string
+
+func (rules ignoreRules) match(name string) bool {
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// commandField is a leaf field of a command
+type commandField struct {
+	Path  string
+	Value string
+}
+
+// commandFields flattens the command into leaf fields. Field paths start with the command name.
+func commandFields(cmd *ipod.Command, rules ignoreRules) []commandField {
+	name := commandName(cmd)
+	var fields []commandField
+	add := func(p string, value string) {
+		fields = append(fields, commandField{Path: p, Value: value})
+	}
+	if cmd.Transaction != nil && !rules.match(name+".Transaction") {
+		add(name+".Transaction", cmd.Transaction.String())
+	}
+	flattenValue(name, reflect.ValueOf(cmd.Payload), rules, add)
+	return fields
+}
+
+func flattenValue(p string, v reflect.Value, rules ignoreRules, add func(string, string)) {
+	if !v.IsValid() {
+		add(p, "<nil>")
+		return
+	}
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			add(p, "<nil>")
+			return
+		}
+		v = v.Elem()
+	}
+	if rules.match(v.Type().String()) {
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			fp := p + "." + f.Name
+			if rules.match(fp) {
+				continue
+			}
+			flattenValue(fp, v.Field(i), rules, add)
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			add(p, formatBytes(b))
+			return
+		}
+		add(p+".len", fmt.Sprint(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			flattenValue(fmt.Sprintf("%s[%d]", p, i), v.Index(i), rules, add)
+		}
+	default:
+		if s, ok := v.Interface().(fmt.Stringer); ok {
+			add(p, s.String())
+			return
+		}
+		add(p, fmt.Sprintf("%#v", v.Interface()))
+	}
+}
+
+// formatBytes shows null terminated strings as text and anything else as hex
+func formatBytes(b []byte) string {
+	if n := len(b); n > 0 && b[n-1] == 0 {
+		text := true
+		for _, c := range b[:n-1] {
+			if c >= unicode.MaxASCII || !unicode.IsPrint(rune(c)) {
+				text = false
+				break
+			}
+		}
+		if text {
+			return fmt.Sprintf("%q", b[:n-1])
+		}
+	}
+	return fmt.Sprintf("[% 02x]", b)
+}
+
+// traceCommand is a command decoded from a trace
+type traceCommand struct {
+	Dir   trace.Dir
+	Index uint
+	Cmd   *ipod.Command
+}
+
+func (c *traceCommand) String() string {
+	return dirPrefix(c.Dir, fmt.Sprintf("%s %v (#%d)", commandName(c.Cmd), c.Cmd.ID, c.Index))
+}
+
+// readTraceCommands decodes all commands of a trace
+func readTraceCommands(r io.Reader) ([]traceCommand, error) {
+	tr := trace.NewReader(r)
+	var cmds []traceCommand
+	err := decodeTrace(tr, traceReportDefs(tr), func(frame *trace.Frame) {
+		var index uint
+		if len(frame.Msgs) > 0 {
+			index = frame.Msgs[0].Index
+		}
+		if frame.Err != nil {
+			log.WithError(frame.Err).WithField("index", index).Warn("skipping a broken frame")
+		}
+		for _, p := range frame.Packets {
+			if p.Cmd == nil {
+				log.WithError(p.Err).WithField("index", index).Warn("skipping a broken packet")
+				continue
+			}
+			cmds = append(cmds, traceCommand{Dir: frame.Dir, Index: index, Cmd: p.Cmd})
+		}
+	})
+	return cmds, err
+}
+
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	// only in a
+	diffMissing
+	// only in b
+	diffExtra
+)
+
+type diffEdit struct {
+	Op   diffOp
+	A, B *traceCommand
+}
+
+// alignCommands aligns two command sequences by direction and command id
+// using the longest common subsequence. Hirschberg's algorithm keeps the
+// memory linear, long traces would need gigabytes for the full table.
+func alignCommands(a, b []traceCommand) []diffEdit {
+	var edits []diffEdit
+	// the common prefix and suffix need no table at all
+	pre := 0
+	for pre < len(a) && pre < len(b) && sameCommand(&a[pre], &b[pre]) {
+		edits = append(edits, diffEdit{Op: diffEqual, A: &a[pre], B: &b[pre]})
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && sameCommand(&a[len(a)-1-suf], &b[len(b)-1-suf]) {
+		suf++
+	}
+	edits = alignRange(edits, a[pre:len(a)-suf], b[pre:len(b)-suf])
+	for i := suf; i > 0; i-- {
+		edits = append(edits, diffEdit{Op: diffEqual, A: &a[len(a)-i], B: &b[len(b)-i]})
+	}
+	return edits
+}
+
+func sameCommand(a, b *traceCommand) bool {
+	return a.Dir == b.Dir && a.Cmd.ID == b.Cmd.ID
+}
+
+// alignRange appends the edits aligning a and b to edits
+func alignRange(edits []diffEdit, a, b []traceCommand) []diffEdit {
+	switch {
+	case len(a) == 0:
+		for j := range b {
+			edits = append(edits, diffEdit{Op: diffExtra, B: &b[j]})
+		}
+		return edits
+	case len(b) == 0:
+		for i := range a {
+			edits = append(edits, diffEdit{Op: diffMissing, A: &a[i]})
+		}
+		return edits
+	case len(a) == 1:
+		for j := range b {
+			if sameCommand(&a[0], &b[j]) {
+				edits = alignRange(edits, nil, b[:j])
+				edits = append(edits, diffEdit{Op: diffEqual, A: &a[0], B: &b[j]})
+				return alignRange(edits, nil, b[j+1:])
+			}
+		}
+		edits = append(edits, diffEdit{Op: diffMissing, A: &a[0]})
+		return alignRange(edits, nil, b)
+	}
+	// split b where the lcs of the two halves of a is the longest
+	mid := len(a) / 2
+	fwd, bwd := lcsForward(a[:mid], b), lcsBackward(a[mid:], b)
+	split, best := 0, int32(-1)
+	for j := 0; j <= len(b); j++ {
+		if n := fwd[j] + bwd[j]; n > best {
+			split, best = j, n
+		}
+	}
+	edits = alignRange(edits, a[:mid], b[:split])
+	return alignRange(edits, a[mid:], b[split:])
+}
+
+// lcsForward returns the lcs lengths of a and b[:j] for every j
+func lcsForward(a, b []traceCommand) []int32 {
+	prev, cur := make([]int32, len(b)+1), make([]int32, len(b)+1)
+	for i := range a {
+		for j := 1; j <= len(b); j++ {
+			switch {
+			case sameCommand(&a[i], &b[j-1]):
+				cur[j] = prev[j-1] + 1
+			case prev[j] >= cur[j-1]:
+				cur[j] = prev[j]
+			default:
+				cur[j] = cur[j-1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+// lcsBackward returns the lcs lengths of a and b[j:] for every j
+func lcsBackward(a, b []traceCommand) []int32 {
+	prev, cur := make([]int32, len(b)+1), make([]int32, len(b)+1)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case sameCommand(&a[i], &b[j]):
+				cur[j] = prev[j+1] + 1
+			case prev[j] >= cur[j+1]:
+				cur[j] = prev[j]
+			default:
+				cur[j] = cur[j+1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+// fieldDiff is a field that differs between two commands
+type fieldDiff struct {
+	Path string
+	A, B string
+}
+
+const fieldMissing = "<missing>"
+
+// diffFields compares the fields of two commands
+func diffFields(a, b *ipod.Command, rules ignoreRules) []fieldDiff {
+	fa, fb := commandFields(a, rules), commandFields(b, rules)
+	vb := make(map[string]string, len(fb))
+	for _, f := range fb {
+		vb[f.Path] = f.Value
+	}
+	var diffs []fieldDiff
+	seen := make(map[string]bool, len(fa))
+	for _, f := range fa {
+		seen[f.Path] = true
+		v, ok := vb[f.Path]
+		if !ok {
+			v = fieldMissing
+		}
+		if v != f.Value {
+			diffs = append(diffs, fieldDiff{Path: f.Path, A: f.Value, B: v})
+		}
+	}
+	for _, f := range fb {
+		if !seen[f.Path] {
+			diffs = append(diffs, fieldDiff{Path: f.Path, A: fieldMissing, B: f.Value})
+		}
+	}
+	return diffs
+}
+
+// diffSummary counts the differences between two traces
+type diffSummary struct {
+	Equal, Missing, Extra, Differing int
+}
+
+func (s diffSummary) Same() bool {
+	return s.Missing == 0 && s.Extra == 0 && s.Differing == 0
+}
+
+// diffCommands prints the differences between two command sequences.
+// Equal commands are printed only if all is set.
+func diffCommands(w io.Writer, a, b []traceCommand, rules ignoreRules, all bool) diffSummary {
+	var s diffSummary
+	for _, e := range alignCommands(a, b) {
+		switch e.Op {
+		case diffMissing:
+			s.Missing++
+			fmt.Fprintf(w, "- %v\n", e.A)
+		case diffExtra:
+			s.Extra++
+			fmt.Fprintf(w, "+ %v\n", e.B)
+		case diffEqual:
+			diffs := diffFields(e.A.Cmd, e.B.Cmd, rules)
+			if len(diffs) == 0 {
+				s.Equal++
+				if all {
+					fmt.Fprintf(w, "  %v\n", e.A)
+				}
+				continue
+			}
+			s.Differing++
+			fmt.Fprintf(w, "~ %v -> #%d\n", e.A, e.B.Index)
+			for _, d := range diffs {
+				fmt.Fprintf(w, "    %s: %s -> %s\n", strings.TrimPrefix(d.Path, commandName(e.A.Cmd)+"."), d.A, d.B)
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d equal, %d missing, %d extra, %d differing\n", s.Equal, s.Missing, s.Extra, s.Differing)
+	return s
+}
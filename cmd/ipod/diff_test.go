@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/trace"
+)
+
+func testCommands(ids ...uint8) []traceCommand {
+	cmds := make([]traceCommand, len(ids))
+	for i, id := range ids {
+		cmds[i] = traceCommand{Dir: trace.DirIn, Index: uint(i), Cmd: &ipod.Command{ID: ipod.NewLingoCmdID(0x00, uint16(id))}}
+	}
+	return cmds
+}
+
+// lcsLength is the textbook lcs of the command ids
+func lcsLength(a, b []traceCommand) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case sameCommand(&a[i], &b[j]):
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
+
+func TestAlignCommands(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		a := make([]uint8, rnd.Intn(20))
+		b := make([]uint8, rnd.Intn(20))
+		for i := range a {
+			a[i] = uint8(rnd.Intn(4))
+		}
+		for i := range b {
+			b[i] = uint8(rnd.Intn(4))
+		}
+		ca, cb := testCommands(a...), testCommands(b...)
+		edits := alignCommands(ca, cb)
+
+		// the edits walk both sequences in order and pair equal commands
+		var i, j, equal int
+		for _, e := range edits {
+			switch e.Op {
+			case diffEqual:
+				if e.A != &ca[i] || e.B != &cb[j] || !sameCommand(e.A, e.B) {
+					t.Fatalf("%v %v: bad equal edit at %d, %d", a, b, i, j)
+				}
+				i, j, equal = i+1, j+1, equal+1
+			case diffMissing:
+				if e.A != &ca[i] {
+					t.Fatalf("%v %v: bad missing edit at %d", a, b, i)
+				}
+				i++
+			case diffExtra:
+				if e.B != &cb[j] {
+					t.Fatalf("%v %v: bad extra edit at %d", a, b, j)
+				}
+				j++
+			}
+		}
+		if i != len(a) || j != len(b) {
+			t.Fatalf("%v %v: edits cover %d, %d", a, b, i, j)
+		}
+		if want := lcsLength(ca, cb); equal != want {
+			t.Errorf("%v %v: %d equal commands want %d", a, b, equal, want)
+		}
+	}
+}
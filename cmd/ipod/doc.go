@@ -29,6 +29,22 @@ represents an incoming request byte sequence from the accessory
 and an outgoing response byte sequence from the ipod
  0x02,0x01,0x00
 
+Traces written by this version start with a header of '!' lines
+describing how the trace was recorded and carry the time in seconds
+since the start of the trace before the data
+
+ !ipod-trace 2
+ !date 2020-03-01T10:00:00Z
+ !tool ipod dev
+ !device /dev/iap0
+ !legacy false
+ !reportdefs 01:12:in 02:14:in 03:20:in 04:63:in
+ < 0.000000 00 01 02
+ > 0.001500 02 01 00
+
+The report defs from the header are used to decode the trace.
+Traces without a header are still accepted.
+
 
 */
 package main
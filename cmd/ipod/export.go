@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oandrew/ipod/hid"
+	"github.com/oandrew/ipod/pcap"
+	"github.com/oandrew/ipod/trace"
+)
+
+// usb endpoints used for the exported reports
+const (
+	exportEndpointIn  = 0x81
+	exportEndpointOut = 0x01
+)
+
+// frameComment describes the commands of a frame
+func frameComment(frame *trace.Frame) string {
+	var parts []string
+	if frame.Err != nil {
+		parts = append(parts, "frame error: "+frame.Err.Error())
+	}
+	for _, p := range frame.Packets {
+		switch {
+		case p.Err != nil:
+			parts = append(parts, "packet error: "+p.Err.Error())
+		case p.CmdErr != nil:
+			parts = append(parts, commandName(p.Cmd)+" error: "+p.CmdErr.Error())
+		default:
+			parts = append(parts, commandName(p.Cmd)+" "+p.Cmd.ID.String())
+		}
+	}
+	return dirPrefix(frame.Dir, strings.Join(parts, "; "))
+}
+
+// exportPcapng writes the reports of a trace as usb interrupt transfers.
+// The last report of every frame is annotated with the decoded commands.
+func exportPcapng(path string, tr *trace.Reader, reportDefs hid.ReportDefs) (err error) {
+	start := time.Unix(0, 0)
+	if hdr, _ := tr.Header(); hdr != nil && !hdr.Date.IsZero() {
+		start = hdr.Date
+	}
+
+	var msgs []*trace.Msg
+	comments := map[*trace.Msg]string{}
+	err = decodeTrace(tr, reportDefs, func(frame *trace.Frame) {
+		msgs = append(msgs, frame.Msgs...)
+		if len(frame.Msgs) > 0 {
+			comments[frame.Msgs[len(frame.Msgs)-1]] = frameComment(frame)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Index < msgs[j].Index
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	w, err := pcap.NewNgWriter(f, pcap.LinkTypeUSBLinuxMMapped, 65535)
+	if err != nil {
+		return err
+	}
+	for i, msg := range msgs {
+		usb := pcap.USBPacket{
+			ID:        uint64(i),
+			Transfer:  pcap.TransferInterrupt,
+			Device:    1,
+			Bus:       1,
+			Timestamp: start.Add(msg.TS),
+			Length:    uint32(len(msg.Data)),
+			Data:      msg.Data,
+		}
+		p := pcap.Packet{
+			Timestamp: usb.Timestamp,
+			Comment:   comments[msg],
+		}
+		switch msg.Dir {
+		case trace.DirIn:
+			// host (accessory) to device (ipod)
+			usb.Type, usb.Endpoint = 'S', exportEndpointOut
+			p.Flags = pcap.FlagsInbound
+		case trace.DirOut:
+			usb.Type, usb.Endpoint = 'C', exportEndpointIn
+			p.Flags = pcap.FlagsOutbound
+		}
+		p.Data = usb.MarshalMMapped()
+		if err := w.WritePacket(&p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
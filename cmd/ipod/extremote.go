@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	extremote "github.com/oandrew/ipod/lingo-extremote"
+)
+
+// trackMetadata is the now playing track reported to the accessory
+type trackMetadata struct {
+	Title      string `json:"title"`
+	Artist     string `json:"artist"`
+	Album      string `json:"album"`
+	LengthMS   uint32 `json:"length_ms"`
+	PositionMS uint32 `json:"position_ms"`
+	// State is stopped, playing or paused
+	State string `json:"state"`
+}
+
+var defaultTrack = trackMetadata{
+	Title:      "title",
+	Artist:     "artist",
+	Album:      "album",
+	LengthMS:   300 * 1000,
+	PositionMS: 20 * 1000,
+	State:      "paused",
+}
+
+var playerStates = map[string]extremote.PlayerState{
+	"stopped": extremote.PlayerStateStopped,
+	"playing": extremote.PlayerStatePlaying,
+	"paused":  extremote.PlayerStatePaused,
+}
+
+// extendedStates are the play states of extended play status notifications
+var extendedStates = map[string]byte{
+	"stopped": extremote.ExtendedStateStopped,
+	"playing": extremote.ExtendedStatePlaying,
+	"paused":  extremote.ExtendedStatePaused,
+}
+
+// playStatusNotifications returns the notifications of the changes from
+// prev to track that the accessory enabled in mask
+func playStatusNotifications(mask uint32, prev, track trackMetadata) []interface{} {
+	var notes []interface{}
+	if mask&extremote.PlayStatusMaskTrackIndex != 0 && (prev.Title != track.Title ||
+		prev.Artist != track.Artist || prev.Album != track.Album || prev.LengthMS != track.LengthMS) {
+		// there is a single track, its index stays 0
+		notes = append(notes, &extremote.PlayStatusChangeNotificationValue{Status: extremote.PlayStatusTrackIndex})
+	}
+	if prev.State != track.State {
+		switch {
+		case mask&extremote.PlayStatusMaskExtended != 0:
+			notes = append(notes, &extremote.PlayStatusChangeNotificationState{
+				Status: extremote.PlayStatusExtended,
+				State:  extendedStates[track.State],
+			})
+		case mask&extremote.PlayStatusMaskBasic != 0 && track.State == "stopped":
+			notes = append(notes, &extremote.PlayStatusChangeNotification{Status: extremote.PlayStatusStopped})
+		}
+	}
+	if mask&extremote.PlayStatusMaskTrackPosition != 0 && prev.PositionMS != track.PositionMS {
+		notes = append(notes, &extremote.PlayStatusChangeNotificationValue{
+			Status: extremote.PlayStatusTrackPosition,
+			Value:  track.PositionMS,
+		})
+	}
+	return notes
+}
+
+func (m *trackMetadata) check() error {
+	if _, ok := playerStates[m.State]; !ok {
+		return fmt.Errorf("unknown state %q: expected stopped, playing or paused", m.State)
+	}
+	if m.PositionMS > m.LengthMS {
+		return fmt.Errorf("position %dms is past the track length %dms", m.PositionMS, m.LengthMS)
+	}
+	return nil
+}
+
+// DevExtRemote holds the now playing track, it can be updated
+// while serving
+type DevExtRemote struct {
+	mu    sync.Mutex
+	track trackMetadata
+}
+
+var _ extremote.DeviceExtRemote = &DevExtRemote{}
+var _ extremote.DeviceTrackInfo = &DevExtRemote{}
+
+func newDevExtRemote() *DevExtRemote {
+	return &DevExtRemote{track: defaultTrack}
+}
+
+func (d *DevExtRemote) Track() trackMetadata {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.track
+}
+
+func (d *DevExtRemote) SetTrack(track trackMetadata) error {
+	if err := track.check(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.track = track
+	return nil
+}
+
+// UpdateTrack changes the track with update and returns it along with
+// the previous one, the track is left alone if update or the check fails
+func (d *DevExtRemote) UpdateTrack(update func(track *trackMetadata) error) (prev, track trackMetadata, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	track = d.track
+	if err := update(&track); err != nil {
+		return prev, track, err
+	}
+	if err := track.check(); err != nil {
+		return prev, track, err
+	}
+	prev, d.track = d.track, track
+	return prev, track, nil
+}
+
+func (d *DevExtRemote) PlaybackStatus() (trackLength, trackPos uint32, state extremote.PlayerState) {
+	t := d.Track()
+	return t.LengthMS, t.PositionMS, playerStates[t.State]
+}
+
+func (d *DevExtRemote) TrackTitle() string {
+	return d.Track().Title
+}
+
+func (d *DevExtRemote) TrackArtistName() string {
+	return d.Track().Artist
+}
+
+func (d *DevExtRemote) TrackAlbumName() string {
+	return d.Track().Album
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/trace"
+)
+
+// viewLevel selects how much of a frame is shown
+type viewLevel int
+
+const (
+	viewLevelFrame viewLevel = iota
+	viewLevelPacket
+	viewLevelCmd
+)
+
+func parseViewLevel(s string) (viewLevel, error) {
+	switch s {
+	case "frame", "":
+		return viewLevelFrame, nil
+	case "packet":
+		return viewLevelPacket, nil
+	case "cmd":
+		return viewLevelCmd, nil
+	}
+	return 0, fmt.Errorf("unknown level %q: expected frame, packet or cmd", s)
+}
+
+// viewFilter selects the frames and packets of a trace to show.
+// Zero values match everything.
+type viewFilter struct {
+	Lingos []string
+	Cmds   []string
+	Dir    *trace.Dir
+	Trx    *ipod.Transaction
+	Errors bool
+
+	FromIndex, ToIndex *uint
+	FromTime, ToTime   *time.Duration
+}
+
+var viewFilterFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "lingo",
+		Usage: "only show commands of the `lingo` given by name (extremote) or id (0x04)",
+	},
+	cli.StringSliceFlag{
+		Name:  "cmd",
+		Usage: "only show commands matching the name `pattern` (extremote.GetDB*, RetDevAuthenticationInfo) or id (0x04,0x0016)",
+	},
+	cli.StringFlag{
+		Name:  "dir",
+		Usage: "only show frames of the `direction`: in (from the accessory) or out (to the accessory)",
+	},
+	cli.StringFlag{
+		Name:  "trx",
+		Usage: "only show commands with the transaction `id`",
+	},
+	cli.BoolFlag{
+		Name:  "errors",
+		Usage: "only show frames, packets and commands that could not be decoded",
+	},
+	cli.StringFlag{
+		Name:  "index",
+		Usage: "only show frames starting with a message in the index `range` i.e. 100-200, 100- or 42",
+	},
+	cli.StringFlag{
+		Name:  "time",
+		Usage: "only show frames starting in the time `range` i.e. 10s-1m30s or 2m-",
+	},
+}
+
+// parseRange parses a from-to range where either end may be omitted
+func parseRange(s string, parse func(string) error) error {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	for _, p := range parts {
+		if err := parse(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func viewFilterFromFlags(c *cli.Context) (*viewFilter, error) {
+	f := &viewFilter{
+		Lingos: c.StringSlice("lingo"),
+		Cmds:   c.StringSlice("cmd"),
+		Errors: c.Bool("errors"),
+	}
+	switch c.String("dir") {
+	case "":
+	case "in":
+		dir := trace.DirIn
+		f.Dir = &dir
+	case "out":
+		dir := trace.DirOut
+		f.Dir = &dir
+	default:
+		return nil, fmt.Errorf("unknown direction %q: expected in or out", c.String("dir"))
+	}
+	if s := c.String("trx"); s != "" {
+		trx, err := strconv.ParseUint(s, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad transaction id %q: %v", s, err)
+		}
+		f.Trx = ipod.NewTransaction(uint16(trx))
+	}
+	if s := c.String("index"); s != "" {
+		i := 0
+		err := parseRange(s, func(p string) error {
+			defer func() { i++ }()
+			if p == "" {
+				return nil
+			}
+			n, err := strconv.ParseUint(p, 10, 0)
+			if err != nil {
+				return fmt.Errorf("bad index range %q: %v", s, err)
+			}
+			index := uint(n)
+			if i == 0 {
+				f.FromIndex = &index
+			} else {
+				f.ToIndex = &index
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s := c.String("time"); s != "" {
+		i := 0
+		err := parseRange(s, func(p string) error {
+			defer func() { i++ }()
+			if p == "" {
+				return nil
+			}
+			d, err := time.ParseDuration(p)
+			if err != nil {
+				return fmt.Errorf("bad time range %q: %v", s, err)
+			}
+			if i == 0 {
+				f.FromTime = &d
+			} else {
+				f.ToTime = &d
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// hasCmdFilter reports whether packets are filtered by their command
+func (f *viewFilter) hasCmdFilter() bool {
+	return len(f.Lingos) > 0 || len(f.Cmds) > 0 || f.Trx != nil
+}
+
+// matchFrame checks the filters that apply to the frame as a whole
+func (f *viewFilter) matchFrame(frame *trace.Frame) bool {
+	if f.Dir != nil && frame.Dir != *f.Dir {
+		return false
+	}
+	if len(frame.Msgs) > 0 {
+		first := frame.Msgs[0]
+		if f.FromIndex != nil && first.Index < *f.FromIndex ||
+			f.ToIndex != nil && first.Index > *f.ToIndex {
+			return false
+		}
+		if f.FromTime != nil && first.TS < *f.FromTime ||
+			f.ToTime != nil && first.TS > *f.ToTime {
+			return false
+		}
+	}
+	if f.Errors && frame.Err == nil || f.hasCmdFilter() {
+		// show the frame if any of its packets is shown
+		for i := range frame.Packets {
+			if f.matchPacket(&frame.Packets[i]) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// matchPacket checks the filters that apply to a single packet
+func (f *viewFilter) matchPacket(p *trace.Packet) bool {
+	if f.Errors && p.Err == nil && p.CmdErr == nil {
+		return false
+	}
+	if !f.hasCmdFilter() {
+		return true
+	}
+	if p.Cmd == nil {
+		return false
+	}
+	if f.Trx != nil && (p.Cmd.Transaction == nil || *p.Cmd.Transaction != *f.Trx) {
+		return false
+	}
+	if len(f.Lingos) > 0 && !matchLingo(f.Lingos, p.Cmd) {
+		return false
+	}
+	if len(f.Cmds) > 0 && !matchCmd(f.Cmds, p.Cmd) {
+		return false
+	}
+	return true
+}
+
+func matchLingo(lingos []string, cmd *ipod.Command) bool {
+	name := commandName(cmd)
+	if i := strings.Index(name, "."); i != -1 {
+		name = name[:i]
+	}
+	for _, lingo := range lingos {
+		if strings.EqualFold(lingo, name) {
+			return true
+		}
+		if id, err := strconv.ParseUint(lingo, 0, 8); err == nil && uint8(id) == cmd.ID.LingoID() {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCmd(patterns []string, cmd *ipod.Command) bool {
+	name := commandName(cmd)
+	short := name[strings.Index(name, ".")+1:]
+	for _, pattern := range patterns {
+		for _, s := range []string{name, short, cmd.ID.String()} {
+			if ok, _ := path.Match(pattern, s); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/oandrew/ipod"
+	extremote "github.com/oandrew/ipod/lingo-extremote"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+func testViewFilter(t *testing.T, args ...string) (*viewFilter, error) {
+	t.Helper()
+	set := flag.NewFlagSet("view", flag.ContinueOnError)
+	for _, f := range viewFilterFlags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return viewFilterFromFlags(cli.NewContext(nil, set, nil))
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"100-200", []string{"100", "200"}},
+		{"100-", []string{"100", ""}},
+		{"-2m", []string{"", "2m"}},
+		{"42", []string{"42", "42"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		err := parseRange(tt.s, func(p string) error {
+			got = append(got, p)
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRange(%q) = %q, %v want %q", tt.s, got, err, tt.want)
+		}
+	}
+	bad := errors.New("bad")
+	if err := parseRange("1-2", func(string) error { return bad }); err != bad {
+		t.Errorf("parseRange() error = %v, want %v", err, bad)
+	}
+}
+
+func TestViewFilterFromFlags(t *testing.T) {
+	index := func(n uint) *uint { return &n }
+	dur := func(d time.Duration) *time.Duration { return &d }
+	dirOut := trace.DirOut
+	tests := []struct {
+		args    []string
+		want    *viewFilter
+		wantErr bool
+	}{
+		{nil, &viewFilter{}, false},
+		{[]string{"--index", "100-200"}, &viewFilter{FromIndex: index(100), ToIndex: index(200)}, false},
+		{[]string{"--index", "100-"}, &viewFilter{FromIndex: index(100)}, false},
+		{[]string{"--index", "42"}, &viewFilter{FromIndex: index(42), ToIndex: index(42)}, false},
+		{[]string{"--time", "-2m"}, &viewFilter{ToTime: dur(2 * time.Minute)}, false},
+		{[]string{"--time", "10s-1m30s"}, &viewFilter{FromTime: dur(10 * time.Second), ToTime: dur(90 * time.Second)}, false},
+		{[]string{"--dir", "out", "--trx", "0x10"}, &viewFilter{Dir: &dirOut, Trx: ipod.NewTransaction(0x10)}, false},
+		{
+			[]string{"--lingo", "extremote", "--lingo", "0x00", "--cmd", "GetDB*", "--errors"},
+			&viewFilter{Lingos: []string{"extremote", "0x00"}, Cmds: []string{"GetDB*"}, Errors: true},
+			false,
+		},
+		{[]string{"--index", "a-"}, nil, true},
+		{[]string{"--time", "1x-"}, nil, true},
+		{[]string{"--dir", "up"}, nil, true},
+		{[]string{"--trx", "0x10000"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := testViewFilter(t, tt.args...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		// unset slice flags are empty, not nil
+		if len(got.Lingos) == 0 {
+			got.Lingos = nil
+		}
+		if len(got.Cmds) == 0 {
+			got.Cmds = nil
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: filter = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func testCommand(t *testing.T, payload interface{}, trx *ipod.Transaction) *ipod.Command {
+	t.Helper()
+	cmd, err := ipod.BuildCommand(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Transaction = trx
+	return cmd
+}
+
+func TestMatchLingoCmd(t *testing.T) {
+	getDB := testCommand(t, &extremote.GetDBiTunesInfo{}, nil)
+	name := testCommand(t, &general.RequestiPodName{}, nil)
+	tests := []struct {
+		lingos, cmds []string
+		cmd          *ipod.Command
+		want         bool
+	}{
+		{[]string{"extremote"}, nil, getDB, true},
+		{[]string{"ExtRemote"}, nil, getDB, true},
+		{[]string{"0x04"}, nil, getDB, true},
+		{[]string{"4"}, nil, getDB, true},
+		{[]string{"general", "0x04"}, nil, name, true},
+		{[]string{"0x00"}, nil, getDB, false},
+		{[]string{"simpleremote"}, nil, name, false},
+		{nil, []string{"extremote.GetDB*"}, getDB, true},
+		{nil, []string{"GetDB*"}, getDB, true},
+		{nil, []string{"Get*Info"}, getDB, true},
+		{nil, []string{getDB.ID.String()}, getDB, true},
+		{nil, []string{"0x04,*"}, getDB, true},
+		{nil, []string{"general.GetDB*"}, getDB, false},
+		{nil, []string{"RequestiPodName", "GetDB*"}, name, true},
+		{nil, []string{"Request"}, name, false},
+	}
+	for _, tt := range tests {
+		var got bool
+		if tt.lingos != nil {
+			got = matchLingo(tt.lingos, tt.cmd)
+		} else {
+			got = matchCmd(tt.cmds, tt.cmd)
+		}
+		if got != tt.want {
+			t.Errorf("match %q %q on %s = %v, want %v", tt.lingos, tt.cmds, commandName(tt.cmd), got, tt.want)
+		}
+	}
+}
+
+func TestViewFilterMatch(t *testing.T) {
+	getDB := trace.Packet{Cmd: testCommand(t, &extremote.GetDBiTunesInfo{}, ipod.NewTransaction(0x10))}
+	name := trace.Packet{Cmd: testCommand(t, &general.RequestiPodName{}, nil)}
+	broken := trace.Packet{Err: errors.New("bad checksum")}
+	unknown := trace.Packet{
+		Cmd:    &ipod.Command{ID: ipod.NewLingoCmdID(0x04, 0x0fff), Payload: ipod.UnknownPayload{}},
+		CmdErr: errors.New("unknown command"),
+	}
+	frame := func(dir trace.Dir, index uint, ts time.Duration, err error, packets ...trace.Packet) *trace.Frame {
+		return &trace.Frame{
+			Dir:     dir,
+			Msgs:    []*trace.Msg{{Dir: dir, Index: index, TS: ts}},
+			Err:     err,
+			Packets: packets,
+		}
+	}
+	ok := frame(trace.DirIn, 100, 10*time.Second, nil, name, getDB)
+	bad := frame(trace.DirOut, 300, 3*time.Minute, nil, broken, unknown)
+	truncated := frame(trace.DirIn, 200, time.Minute, errors.New("truncated"))
+
+	tests := []struct {
+		args []string
+		// the frames and the packets of ok and bad that are shown
+		want    [3]bool
+		okPkts  []bool
+		badPkts []bool
+	}{
+		{nil, [3]bool{true, true, true}, []bool{true, true}, []bool{true, true}},
+		{[]string{"--dir", "out"}, [3]bool{false, true, false}, []bool{true, true}, []bool{true, true}},
+		{[]string{"--index", "150-"}, [3]bool{false, true, true}, []bool{true, true}, []bool{true, true}},
+		{[]string{"--index", "-200"}, [3]bool{true, false, true}, []bool{true, true}, []bool{true, true}},
+		{[]string{"--time", "-2m"}, [3]bool{true, false, true}, []bool{true, true}, []bool{true, true}},
+		{[]string{"--time", "2m-"}, [3]bool{false, true, false}, []bool{true, true}, []bool{true, true}},
+		{[]string{"--lingo", "extremote"}, [3]bool{true, false, false}, []bool{false, true}, []bool{false, false}},
+		{[]string{"--lingo", "0x04"}, [3]bool{true, true, false}, []bool{false, true}, []bool{false, true}},
+		{[]string{"--cmd", "Request*"}, [3]bool{true, false, false}, []bool{true, false}, []bool{false, false}},
+		{[]string{"--trx", "0x10"}, [3]bool{true, false, false}, []bool{false, true}, []bool{false, false}},
+		{[]string{"--errors"}, [3]bool{false, true, true}, []bool{false, false}, []bool{true, true}},
+		{[]string{"--errors", "--cmd", "0x04,*"}, [3]bool{false, true, false}, []bool{false, false}, []bool{false, true}},
+		{[]string{"--errors", "--cmd", "Request*"}, [3]bool{false, false, false}, []bool{false, false}, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		f, err := testViewFilter(t, tt.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, fr := range []*trace.Frame{ok, bad, truncated} {
+			if got := f.matchFrame(fr); got != tt.want[i] {
+				t.Errorf("%q: frame %d shown = %v, want %v", tt.args, fr.Msgs[0].Index, got, tt.want[i])
+			}
+		}
+		for i := range ok.Packets {
+			if got := f.matchPacket(&ok.Packets[i]); got != tt.okPkts[i] {
+				t.Errorf("%q: packet %s shown = %v, want %v", tt.args, commandName(ok.Packets[i].Cmd), got, tt.okPkts[i])
+			}
+		}
+		for i := range bad.Packets {
+			if got := f.matchPacket(&bad.Packets[i]); got != tt.badPkts[i] {
+				t.Errorf("%q: broken packet %d shown = %v, want %v", tt.args, i, got, tt.badPkts[i])
+			}
+		}
+	}
+}
@@ -2,23 +2,35 @@ package main
 
 import (
 	"bytes"
+	"crypto/x509"
 	"fmt"
 
 	"github.com/davecgh/go-spew/spew"
 
-	"github.com/oandrew/ipod"
 	general "github.com/oandrew/ipod/lingo-general"
 
 	"github.com/fullsailor/pkcs7"
 )
 
 type DevGeneral struct {
-	uimode general.UIMode
-	tokens []general.FIDTokenValue
+	uimode    general.UIMode
+	eventMask uint64
+	tokens    []general.FIDTokenValue
+	// accCert is the certificate the accessory sent during authentication
+	accCert *x509.Certificate
+	// cfg is the identity of the device, the default one if nil
+	cfg *deviceConfig
 }
 
 var _ general.DeviceGeneral = &DevGeneral{}
 
+func (d *DevGeneral) config() *deviceConfig {
+	if d.cfg == nil {
+		return resolvedDefaultConfig
+	}
+	return d.cfg
+}
+
 func (d *DevGeneral) UIMode() general.UIMode {
 	return d.uimode
 }
@@ -28,40 +40,35 @@ func (d *DevGeneral) SetUIMode(mode general.UIMode) {
 }
 
 func (d *DevGeneral) Name() string {
-	return "ipod-gadget"
+	return d.config().Name
 }
 
 func (d *DevGeneral) SoftwareVersion() (major uint8, minor uint8, rev uint8) {
-	return 7, 1, 2
+	v := d.config().softwareVersion
+	return v[0], v[1], v[2]
 }
 
 func (d *DevGeneral) SerialNum() string {
-	return "abcd1234"
+	return d.config().Serial
+}
+
+func (d *DevGeneral) ModelNum() (modelID uint32, model string) {
+	return d.config().ModelID, d.config().Model
 }
 
 func (d *DevGeneral) LingoProtocolVersion(lingo uint8) (major uint8, minor uint8) {
-	switch lingo {
-	case ipod.LingoGeneralID:
-		return 1, 9
-	case ipod.LingoDisplayRemoteID:
-		return 1, 5
-	case ipod.LingoExtRemoteID:
-		return 1, 12
-	case ipod.LingoDigitalAudioID:
-		return 1, 2
-	default:
+	if v, ok := d.config().lingoVersions[lingo]; ok {
+		return v[0], v[1]
+	}
+	if !d.config().strict {
+		// only a device that lists its lingoes turns accessories away
 		return 1, 1
 	}
+	return 0, 0
 }
 
 func (d *DevGeneral) LingoOptions(lingo uint8) uint64 {
-	switch lingo {
-	case ipod.LingoGeneralID:
-		return 0x000000063DEF73FF
-
-	default:
-		return 0
-	}
+	return d.config().lingoOptions[lingo]
 }
 
 func (d *DevGeneral) PrefSettingID(classID uint8) uint8 {
@@ -72,15 +79,15 @@ func (d *DevGeneral) SetPrefSettingID(classID uint8, settingID uint8, restoreOnE
 }
 
 func (d *DevGeneral) SetEventNotificationMask(mask uint64) {
-
+	d.eventMask = mask
 }
 
 func (d *DevGeneral) EventNotificationMask() uint64 {
-	return 0
+	return d.eventMask
 }
 
 func (d *DevGeneral) SupportedEventNotificationMask() uint64 {
-	return 0
+	return d.config().SupportedEvents
 }
 
 func (d *DevGeneral) CancelCommand(lingo uint8, cmd uint16, transaction uint16) {
@@ -88,7 +95,7 @@ func (d *DevGeneral) CancelCommand(lingo uint8, cmd uint16, transaction uint16)
 }
 
 func (d *DevGeneral) MaxPayload() uint16 {
-	return 65535
+	return d.config().MaxPayload
 }
 
 func (d *DevGeneral) StartIDPS() {
@@ -145,8 +152,8 @@ func (d *DevGeneral) AccAuthCert(cert []byte) {
 		return
 	}
 	if len(pkcs.Certificates) >= 1 {
-		cn := pkcs.Certificates[0].Subject.CommonName
-		log.Infof("cert: CN=%s", cn)
+		d.accCert = pkcs.Certificates[0]
+		log.Infof("cert: CN=%s", d.accCert.Subject.CommonName)
 	}
 
 }
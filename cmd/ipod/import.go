@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/oandrew/ipod/hid"
+	"github.com/oandrew/ipod/pcap"
+	"github.com/oandrew/ipod/trace"
+)
+
+// usb control request used by hosts to send reports over the control endpoint
+const (
+	usbRequestTypeClassIface = 0x21
+	usbRequestSetReport      = 0x09
+)
+
+type usbPacketReader interface {
+	ReadPacket() (*pcap.USBPacket, error)
+}
+
+type pcapUSBReader struct {
+	r *pcap.Reader
+}
+
+func (pr *pcapUSBReader) ReadPacket() (*pcap.USBPacket, error) {
+	for {
+		p, err := pr.r.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		switch p.LinkType {
+		case pcap.LinkTypeUSBLinux, pcap.LinkTypeUSBLinuxMMapped:
+			return pcap.ParseUSBPacket(p, pr.r.ByteOrder())
+		}
+	}
+}
+
+// newUSBPacketReader detects whether the capture is a pcap/pcapng file
+// or usbmon text output
+func newUSBPacketReader(r io.Reader) (usbPacketReader, error) {
+	br := bufio.NewReader(r)
+	pr, err := pcap.NewReader(br)
+	if err == pcap.ErrFormat {
+		return pcap.NewUSBMonTextReader(br), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pcapUSBReader{r: pr}, nil
+}
+
+// usbReport returns the hid report carried by the usb packet
+// and its trace direction
+func usbReport(p *pcap.USBPacket) (trace.Dir, []byte, bool) {
+	if len(p.Data) < 2 {
+		return 0, nil, false
+	}
+	switch p.Transfer {
+	case pcap.TransferInterrupt:
+		if p.In() && p.Type == 'C' && p.Status == 0 {
+			// device (ipod) to host (accessory)
+			return trace.DirOut, p.Data, true
+		}
+		if !p.In() && p.Type == 'S' {
+			return trace.DirIn, p.Data, true
+		}
+	case pcap.TransferControl:
+		if p.Type == 'S' && len(p.Setup) == 8 &&
+			p.Setup[0] == usbRequestTypeClassIface && p.Setup[1] == usbRequestSetReport {
+			return trace.DirIn, p.Data, true
+		}
+	}
+	return 0, nil, false
+}
+
+// isIAPReport reports whether the report looks like the start of an iap frame
+func isIAPReport(report []byte) bool {
+	return len(report) > 2 && report[1]&byte(hid.LinkControlContinue) == 0 && report[2] == 0x55
+}
+
+type usbAddr struct {
+	bus    uint16
+	device uint8
+}
+
+func (a usbAddr) String() string {
+	return fmt.Sprintf("%d:%03d", a.bus, a.device)
+}
+
+// importUSBMon converts the hid reports of a usb capture into a trace.
+// If addr is nil the first device that sends iap frames is used.
+func importUSBMon(in io.Reader, out io.Writer, addr *usbAddr) error {
+	r, err := newUSBPacketReader(in)
+	if err != nil {
+		return err
+	}
+
+	type report struct {
+		dir  trace.Dir
+		ts   time.Time
+		data []byte
+	}
+	var reports []report
+	var truncated int
+	// a report id can be used in both directions with different sizes
+	type defKey struct {
+		id  int
+		dir hid.ReportDir
+	}
+	defs := map[defKey]hid.ReportDef{}
+	for {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dir, data, ok := usbReport(p)
+		if !ok {
+			continue
+		}
+		pa := usbAddr{bus: p.Bus, device: p.Device}
+		if addr == nil {
+			if !isIAPReport(data) {
+				continue
+			}
+			addr = &pa
+			log.WithField("device", addr).Warn("found iap device")
+		}
+		if pa != *addr {
+			continue
+		}
+		if uint32(len(data)) < p.Length {
+			truncated++
+		}
+
+		if len(reports) == 0 && !isIAPReport(data) {
+			// skip the tail of a frame that started before the capture
+			continue
+		}
+		reports = append(reports, report{dir: dir, ts: p.Timestamp, data: data})
+
+		def := hid.ReportDef{ID: int(data[0]), Len: len(data) - 1, Dir: hid.ReportDirAccIn}
+		if dir == trace.DirIn {
+			def.Dir = hid.ReportDirAccOut
+		}
+		key := defKey{def.ID, def.Dir}
+		if old, ok := defs[key]; !ok || old.Len < def.Len {
+			defs[key] = def
+		}
+	}
+	if addr == nil || len(reports) == 0 {
+		return fmt.Errorf("no iap reports found")
+	}
+	if truncated > 0 {
+		log.WithField("reports", truncated).Warn("some reports are truncated, increase the usbmon text data limit or use a pcap capture")
+	}
+
+	var reportDefs hid.ReportDefs
+	for _, def := range defs {
+		reportDefs = append(reportDefs, def)
+	}
+	sort.Slice(reportDefs, func(i, j int) bool {
+		if reportDefs[i].ID != reportDefs[j].ID {
+			return reportDefs[i].ID < reportDefs[j].ID
+		}
+		return reportDefs[i].Dir < reportDefs[j].Dir
+	})
+
+	tw := trace.NewWriter(out)
+	err = tw.WriteHeader(&trace.Header{
+		Date:       reports[0].ts,
+		Tool:       "ipod " + version,
+		Device:     "usbmon " + addr.String(),
+		ReportDefs: reportDefs,
+	})
+	if err != nil {
+		return err
+	}
+	for _, rep := range reports {
+		err := tw.WriteMsg(&trace.Msg{
+			Dir:  rep.dir,
+			TS:   rep.ts.Sub(reports[0].ts),
+			Data: rep.data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"reports":    len(reports),
+		"reportdefs": reportDefs.String(),
+	}).Info("capture imported")
+	return nil
+}
+
+// parseUSBAddr parses a usb address in the bus:device form
+func parseUSBAddr(s string) (*usbAddr, error) {
+	var bus, dev uint
+	if _, err := fmt.Sscanf(s, "%d:%d", &bus, &dev); err != nil {
+		return nil, fmt.Errorf("bad usb address %q: expected bus:device", s)
+	}
+	return &usbAddr{bus: uint16(bus), device: uint8(dev)}, nil
+}
+
+// importUSBMonFile converts a capture file into a trace file
+func importUSBMonFile(path, out string, addr *usbAddr) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if err := importUSBMon(f, &buf, addr); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, buf.Bytes(), 0644)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/oandrew/ipod/hid"
+	"github.com/oandrew/ipod/trace"
+)
+
+func TestImportUSBMonReportDefs(t *testing.T) {
+	// the same report id is used in both directions with different sizes
+	capture := strings.Join([]string{
+		"ffff88003a1f6840 1000000 S Io:1:005:2 -115:8 4 = 01005501",
+		"ffff88003a1f6840 1001000 C Ii:1:005:1 0:8 8 = 01005502 03040506",
+		"ffff88003a1f6840 1002000 S Io:1:005:2 -115:8 4 = 01005501",
+	}, "\n") + "\n"
+
+	var buf bytes.Buffer
+	if err := importUSBMon(strings.NewReader(capture), &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := trace.NewReader(&buf).Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := hid.ReportDefs{
+		{ID: 0x01, Len: 7, Dir: hid.ReportDirAccIn},
+		{ID: 0x01, Len: 3, Dir: hid.ReportDirAccOut},
+	}
+	if !reflect.DeepEqual(hdr.ReportDefs, want) {
+		t.Errorf("report defs = %v, want %v", hdr.ReportDefs, want)
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"os"
@@ -36,24 +43,439 @@ func openDevice(path string) (*os.File, error) {
 	return f, nil
 }
 
-func openTraceFile(path string) (*os.File, error) {
-	f, err := os.Open(path)
+// openTraceFile opens the trace file preceded by its rotated segments
+func openTraceFile(path string) (io.ReadCloser, error) {
+	return trace.OpenSegments(path)
+}
+
+var traceFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "write-trace, w",
+		Usage: "Write trace to a `file`",
+	},
+	cli.BoolFlag{
+		Name:  "append",
+		Usage: "append to the trace file instead of truncating it and removing its rotated files, the timestamps continue after its last message",
+	},
+	cli.DurationFlag{
+		Name:  "flush-interval",
+		Usage: "write buffered trace messages to the file every `interval`",
+		Value: time.Second,
+	},
+	cli.StringFlag{
+		Name:  "rotate-size",
+		Usage: "start a new trace file once it reaches `size` i.e. 512K, 10M or 1G",
+	},
+	cli.DurationFlag{
+		Name:  "rotate-interval",
+		Usage: "start a new trace file every `interval`",
+	},
+	cli.BoolFlag{
+		Name:  "compress",
+		Usage: "gzip rotated trace files",
+	},
+	cli.IntFlag{
+		Name:  "max-files",
+		Usage: "keep at most `n` rotated trace files (0 keeps all)",
+	},
+	cli.BoolFlag{
+		Name:  "annotate",
+		Usage: "write the decoded commands as # comments after their reports",
+	},
+	cli.BoolFlag{
+		Name:  "stdin-markers",
+		Usage: "write every line typed on stdin as a # marker comment (SIGUSR1 always inserts a numbered marker)",
+	},
+	cli.StringFlag{
+		Name:  "write-commands",
+		Usage: "also write the decoded commands as json lines to a `file`",
+	},
+}
+
+// parseSize parses a byte count with an optional K, M or G suffix
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * mult, nil
+}
+
+// newTraceWriter creates a trace file for recording the device
+// and writes the trace header
+func newTraceWriter(c *cli.Context, path string, device string) (*trace.Writer, error) {
+	cfg := trace.RotateConfig{
+		MaxAge:   c.Duration("rotate-interval"),
+		Compress: c.Bool("compress"),
+		MaxFiles: c.Int("max-files"),
+	}
+	if size := c.String("rotate-size"); size != "" {
+		var err error
+		if cfg.MaxSize, err = parseSize(size); err != nil {
+			return nil, err
+		}
+	}
+	f, err := trace.OpenRotatingFile(path, c.Bool("append"), cfg)
 	if err != nil {
 		return nil, err
 	}
-	return f, nil
+	interval := c.Duration("flush-interval")
+	if interval <= 0 {
+		interval = time.Second
+	}
+	tw := trace.NewBufferedWriter(f, interval)
+	hdr := &trace.Header{
+		Date:       time.Now(),
+		Tool:       "ipod " + version,
+		Device:     device,
+		Legacy:     c.GlobalBool("legacy"),
+		ReportDefs: hidReportDefs,
+	}
+	if c.Bool("append") && f.Size() > 0 {
+		err = continueTrace(path, f, tw, hdr)
+	} else {
+		err = tw.WriteHeader(hdr)
+	}
+	if err != nil {
+		tw.Close()
+		return nil, err
+	}
+	return tw, nil
 }
 
-func newTraceFile(path string) (*os.File, error) {
-	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, os.ModePerm)
+// continueTrace makes tw append to the trace at path if it was recorded
+// with the same descriptor, otherwise the trace is rotated and a new
+// one is started
+func continueTrace(path string, f *trace.RotatingFile, tw *trace.Writer, hdr *trace.Header) error {
+	last, err := lastTraceTS(path, hdr)
+	if err == nil {
+		log.WithField("last", last).Info("continuing the trace")
+		return tw.Continue(hdr, last)
+	}
+	log.WithError(err).Warn("could not continue the trace, starting a new one")
+	if err := f.Rotate(); err != nil {
+		return err
+	}
+	return tw.WriteHeader(hdr)
 }
 
+// lastTraceTS returns the timestamp of the last message of the trace
+// at path, the trace must have a header matching hdr
+func lastTraceTS(path string, hdr *trace.Header) (time.Duration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	tr := trace.NewReader(f)
+	old, err := tr.Header()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case old == nil:
+		return 0, fmt.Errorf("trace has no header")
+	case old.Legacy != hdr.Legacy || old.ReportDefs.String() != hdr.ReportDefs.String():
+		return 0, fmt.Errorf("trace was recorded with other report defs")
+	}
+	var last time.Duration
+	for {
+		var msg trace.Msg
+		err := tr.ReadMsg(&msg)
+		if err == io.EOF {
+			return last, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		last = msg.TS
+	}
+}
+
+// traceReportDefs returns the report defs the trace was recorded with
+// falling back to the ones selected on the command line
+func traceReportDefs(tr *trace.Reader) hid.ReportDefs {
+	hdr, err := tr.Header()
+	if err != nil {
+		log.WithError(err).Warn("could not read the trace header")
+		return hidReportDefs
+	}
+	if hdr == nil {
+		return hidReportDefs
+	}
+	log.WithFields(logrus.Fields{
+		"version": hdr.Version,
+		"date":    hdr.Date,
+		"tool":    hdr.Tool,
+		"device":  hdr.Device,
+		"legacy":  hdr.Legacy,
+	}).Info("trace header")
+	if len(hdr.ReportDefs) == 0 {
+		return hidReportDefs
+	}
+	return hdr.ReportDefs
+}
+
+// signalContext returns a context that is canceled on SIGINT or SIGTERM.
+// onSignal functions are called before the context is canceled.
+func signalContext(onSignal ...func()) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sig:
+			log.Warnf("received %v, shutting down", s)
+			for _, fn := range onSignal {
+				fn()
+			}
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+	}()
+	return ctx, cancel
+}
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 type UsageError struct {
 	error
 }
 
 var hidReportDefs = hid.DefaultReportDefs
 
+var writerFlags = []cli.Flag{
+	cli.DurationFlag{
+		Name:  "report-delay",
+		Usage: "minimum `delay` between two reports written to the device",
+	},
+	cli.DurationFlag{
+		Name:  "write-timeout",
+		Usage: "give up writing a frame after `timeout` (0 to disable, a busy device is still given up on after 10s)",
+	},
+}
+
+var faultFlags = []cli.Flag{
+	cli.Float64Flag{
+		Name:  "inject-faults",
+		Usage: "inject transport faults into frames with the given `probability` (0..1)",
+	},
+	cli.StringFlag{
+		Name:  "faults",
+		Usage: "comma separated `list` of faults to inject: drop,duplicate,delay,reorder,truncate,corrupt",
+		Value: ipod.FaultAll.String(),
+	},
+	cli.Int64Flag{
+		Name:  "fault-seed",
+		Usage: "random `seed` for fault injection (0 for a random seed)",
+	},
+}
+
+var deviceFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "profile",
+		Usage: "emulate a device of the built-in catalog by `name` (see ipod profiles)",
+	},
+	cli.StringFlag{
+		Name:  "config",
+		Usage: "read the device identity (name, serial, versions, model...) from a yaml `file`, on top of the profile if given",
+	},
+}
+
+var controlFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "control",
+		Usage: "serve the control api (state, metadata, events, send) on a unix socket at `path` for ipod ctl",
+	},
+}
+
+// setupDevice configures the emulated device from the command line
+func setupDevice(c *cli.Context) error {
+	devGeneral = &DevGeneral{}
+	devExtRemote = newDevExtRemote()
+	cfg := &defaultDeviceConfig
+	if name := c.String("profile"); name != "" {
+		var err error
+		if cfg, err = lookupProfile(name); err != nil {
+			return UsageError{err}
+		}
+		devGeneral.cfg = cfg
+		log.WithField("profile", name).Warn("device profile selected")
+	}
+	if path := c.String("config"); path != "" {
+		var err error
+		if cfg, err = loadDeviceConfig(path, cfg); err != nil {
+			return err
+		}
+		devGeneral.cfg = cfg
+		log.WithField("path", path).Warn("device config loaded")
+	}
+	if devGeneral.cfg != nil {
+		log.WithFields(logrus.Fields{
+			"name":  cfg.Name,
+			"model": cfg.Model,
+			"sw":    cfg.SoftwareVersion,
+		}).Info("device")
+	}
+	return nil
+}
+
+// serveDevice responds to the requests from the char device given on the
+// command line until it is closed or interrupted. attach, if set, is started
+// along with the session and can stop it with cancel.
+func serveDevice(c *cli.Context, attach func(ctx context.Context, cancel context.CancelFunc, s *session)) error {
+	path := c.Args().First()
+	if path == "" {
+		return UsageError{fmt.Errorf("device path is missing")}
+	}
+	if err := setupDevice(c); err != nil {
+		return err
+	}
+	return withDevice(c, path, func(ctx context.Context, cancel context.CancelFunc, t ipod.FrameReadWriter) error {
+		frameTransport, err := withFaults(c, t)
+		if err != nil {
+			return err
+		}
+		s := newSession(frameTransport)
+		if sockPath := c.String("control"); sockPath != "" {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if err := serveControl(ctx, sockPath, s); err != nil {
+					log.WithError(err).WithField("path", sockPath).Errorf("could not serve the control api")
+				}
+			}()
+			// wait for the socket to be removed
+			defer func() { <-done }()
+			defer cancel()
+		}
+		if attach != nil {
+			go attach(ctx, cancel, s)
+		}
+		s.run(ctx)
+		return nil
+	})
+}
+
+// withDevice opens the char device, sets up the traces given on the
+// command line and calls run with the frame transport of the device.
+// ctx is canceled on SIGINT or SIGTERM.
+func withDevice(c *cli.Context, path string, run func(ctx context.Context, cancel context.CancelFunc, t ipod.FrameReadWriter) error) error {
+	f, err := openDevice(path)
+	le := log.WithField("path", path)
+	if err != nil {
+		le.WithError(err).Errorf("could not open the device")
+		return err
+	}
+	defer f.Close()
+	le.Info("device opened")
+
+	var rw io.ReadWriter = f
+	var flush []func()
+	if tracePath := c.String("write-trace"); tracePath != "" {
+		tw, err := newTraceWriter(c, tracePath, path)
+		le := log.WithField("path", tracePath)
+		if err != nil {
+			le.WithError(err).Errorf("could not create a trace file")
+			return err
+		}
+		defer tw.Close()
+		flush = append(flush, func() { tw.Flush() })
+		le.Warningf("writing trace")
+		rw = trace.NewTracerWriter(tw, f)
+		annotator = &traceAnnotator{tw: tw, commands: c.Bool("annotate")}
+		var markers io.Reader
+		if c.Bool("stdin-markers") {
+			markers = os.Stdin
+		}
+		handleMarkers(markers)
+	}
+	if cmdPath := c.String("write-commands"); cmdPath != "" {
+		ct, err := newCommandTracer(cmdPath, c.Bool("append"))
+		le := log.WithField("path", cmdPath)
+		if err != nil {
+			le.WithError(err).Errorf("could not create a command trace file")
+			return err
+		}
+		defer ct.Close()
+		le.Warningf("writing command trace")
+		cmdTracer = ct
+	}
+
+	ctx, cancel := signalContext(flush...)
+	defer cancel()
+
+	reportR, reportW := hid.NewReportReader(rw), hid.NewReportWriterOptions(rw, writerOptions(c))
+	return run(ctx, cancel, hid.NewTransport(reportR, reportW, hidReportDefs))
+}
+
+// ignoreFlags select the command fields diff and verify don't compare
+var ignoreFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "ignore",
+		Usage: "ignore command fields matching the `pattern` i.e. general.RetiPodOptions.Options or dispremote.InfoDateTime",
+	},
+	cli.BoolFlag{
+		Name:  "no-default-ignore",
+		Usage: "compare transaction ids and other volatile fields too",
+	},
+}
+
+func ignoreRulesFromFlags(c *cli.Context) ignoreRules {
+	var rules ignoreRules
+	if !c.Bool("no-default-ignore") {
+		rules = append(rules, defaultIgnoreRules...)
+	}
+	return append(rules, c.StringSlice("ignore")...)
+}
+
+// withFaults wraps the transport with a FaultyTransport if fault injection is enabled
+func withFaults(c *cli.Context, t ipod.FrameReadWriter) (ipod.FrameReadWriter, error) {
+	p := c.Float64("inject-faults")
+	if p <= 0 {
+		return t, nil
+	}
+	faults, err := ipod.ParseFaults(c.String("faults"))
+	if err != nil {
+		return nil, UsageError{err}
+	}
+	seed := c.Int64("fault-seed")
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.WithFields(logrus.Fields{
+		"probability": p,
+		"faults":      faults,
+		"seed":        seed,
+	}).Warn("fault injection enabled")
+	return ipod.NewFaultyTransport(t, ipod.FaultConfig{
+		Probability: p,
+		Faults:      faults,
+		Seed:        seed,
+	}), nil
+}
+
+func writerOptions(c *cli.Context) hid.WriterOptions {
+	return hid.WriterOptions{
+		ReportDelay:  c.Duration("report-delay"),
+		FrameTimeout: c.Duration("write-timeout"),
+	}
+}
+
 func main() {
 	logOut := os.Stdout
 	log.Formatter = &TextFormatter{
@@ -120,82 +542,315 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "profiles",
+			Usage: "print the built-in device profiles for serve --profile",
+			Action: func(c *cli.Context) error {
+				for _, name := range profileNames() {
+					p := deviceProfiles[name]
+					fmt.Printf("%-10s %-36s model=%s sw=%s\n", name, p.Description, p.Config.Model, p.Config.SoftwareVersion)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "selftest",
+			Usage: "run the serve handlers against a simulated head unit: identification, authentication, digital audio, remote ui and extremote",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "flow",
+					Usage: "only run the `name`d flow: " + strings.Join(selftestFlows, " or "),
+				},
+			}, deviceFlags...),
+			Action: func(c *cli.Context) error {
+				if err := setupDevice(c); err != nil {
+					return err
+				}
+				cfg := devGeneral.cfg
+				reset := func() {
+					devGeneral = &DevGeneral{cfg: cfg}
+					devExtRemote = newDevExtRemote()
+				}
+				byName, err := selftestScenarios()
+				if err != nil {
+					return err
+				}
+				names := selftestFlows
+				if flow := c.String("flow"); flow != "" {
+					if byName[flow] == nil {
+						return UsageError{fmt.Errorf("unknown flow %q: expected %s", flow, strings.Join(selftestFlows, " or "))}
+					}
+					names = []string{flow}
+				}
+				var scenarios []*scenario
+				for _, name := range names {
+					scenarios = append(scenarios, byName[name])
+				}
+				// the report is enough unless debugging
+				if !c.GlobalBool("debug") {
+					log.SetLevel(logrus.WarnLevel)
+				}
+				ctx, cancel := signalContext()
+				defer cancel()
+				return runSelftest(ctx, scenarios, reset, os.Stdout)
+			},
+		},
 		{
 			Name:      "serve",
 			Aliases:   []string{"s"},
 			ArgsUsage: "<dev>",
 			Usage:     "respond to requests from a char device i.e. /dev/iap0",
+			Flags:     append(append(append(append([]cli.Flag{}, deviceFlags...), controlFlags...), traceFlags...), append(writerFlags, faultFlags...)...),
+			Action: func(c *cli.Context) error {
+				return serveDevice(c, nil)
+			},
+		},
+		{
+			Name:      "shell",
+			ArgsUsage: "<dev>",
+			Usage:     "serve a char device and read commands to send, the session state and markers from stdin",
+			Flags:     append(append(append(append([]cli.Flag{}, deviceFlags...), controlFlags...), traceFlags...), writerFlags...),
+			Action: func(c *cli.Context) error {
+				if c.Bool("stdin-markers") {
+					return UsageError{fmt.Errorf("stdin is read by the shell, use its mark command instead")}
+				}
+				return serveDevice(c, func(ctx context.Context, cancel context.CancelFunc, s *session) {
+					runShell(ctx, os.Stdin, os.Stdout, s)
+					cancel()
+				})
+			},
+		},
+		{
+			Name:  "ctl",
+			Usage: "control a running serve through its control socket",
 			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "write-trace, w",
-					Usage: "Write trace to a `file`",
+					Name:  "socket, s",
+					Usage: "control socket `path` of the serve process",
+					Value: defaultControlSocket,
+				},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "state",
+					Usage: "print the session state and the now playing track",
+					Action: func(c *cli.Context) error {
+						return newControlClient(c.Parent().String("socket")).do("GET", "/state", nil, os.Stdout)
+					},
+				},
+				{
+					Name:      "metadata",
+					Usage:     "print or update the now playing track",
+					ArgsUsage: "[title=.. artist=.. album=.. length_ms=.. position_ms=.. state=stopped|playing|paused]",
+					Action: func(c *cli.Context) error {
+						client := newControlClient(c.Parent().String("socket"))
+						if c.NArg() == 0 {
+							return client.do("GET", "/metadata", nil, os.Stdout)
+						}
+						update, err := metadataUpdate(c.Args())
+						if err != nil {
+							return UsageError{err}
+						}
+						return client.do("PUT", "/metadata", update, os.Stdout)
+					},
+				},
+				{
+					Name:  "events",
+					Usage: "print the commands from the accessory and the state changes as json lines",
+					Action: func(c *cli.Context) error {
+						return newControlClient(c.Parent().String("socket")).do("GET", "/events", nil, os.Stdout)
+					},
+				},
+				{
+					Name:      "send",
+					Usage:     "send a command to the accessory i.e. send extremote.PlayStatusChangeNotification Status=1",
+					ArgsUsage: "<lingo.Command> [Field=value...]",
+					Action: func(c *cli.Context) error {
+						if c.NArg() == 0 {
+							return UsageError{fmt.Errorf("command name is missing")}
+						}
+						fields, err := parseAssigns(c.Args()[1:])
+						if err != nil {
+							return UsageError{err}
+						}
+						req := &sendRequest{Name: c.Args().First(), Fields: fields}
+						return newControlClient(c.Parent().String("socket")).do("POST", "/send", req, os.Stdout)
+					},
+				},
+				{
+					Name:      "raw",
+					Usage:     "send a raw iap packet given in hex i.e. raw 04 00 27 01",
+					ArgsUsage: "<hex>...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() == 0 {
+							return UsageError{fmt.Errorf("packet is missing")}
+						}
+						req := &sendRequest{Packet: strings.Join(c.Args(), "")}
+						return newControlClient(c.Parent().String("socket")).do("POST", "/send", req, os.Stdout)
+					},
 				},
 			},
+		},
+		{
+			Name:    "replay",
+			Aliases: []string{"r"},
+			Usage:   "respond to requests from a trace file",
+			Flags: append([]cli.Flag{
+				cli.Float64Flag{
+					Name:  "speed",
+					Usage: "replay speed `factor` i.e. 2 replays twice as fast",
+					Value: 1,
+				},
+				cli.BoolFlag{
+					Name:  "no-timing",
+					Usage: "ignore the recorded timestamps and replay as fast as possible",
+				},
+			}, append(deviceFlags, faultFlags...)...),
 			Action: func(c *cli.Context) error {
 				path := c.Args().First()
 				if path == "" {
-					return UsageError{fmt.Errorf("device path is missing")}
+					return UsageError{cli.NewExitError("trace file path is missing", 1)}
+				}
+				if err := setupDevice(c); err != nil {
+					return err
 				}
-				f, err := openDevice(path)
+
+				f, err := openTraceFile(path)
 				le := log.WithField("path", path)
 				if err != nil {
-					le.WithError(err).Errorf("could not open the device")
+					le.WithError(err).Errorf("could not open the trace file")
 					return err
 				}
-				le.Info("device opened")
+				le.Warningf("trace file opened")
 
-				var rw io.ReadWriter = f
-				if tracePath := c.String("write-trace"); tracePath != "" {
-					traceFile, err := newTraceFile(tracePath)
-					le := log.WithField("path", tracePath)
-					if err != nil {
-						le.WithError(err).Errorf("could not create a trace file")
+				ctx, cancel := signalContext()
+				defer cancel()
+
+				speed := c.Float64("speed")
+				if speed <= 0 {
+					return UsageError{fmt.Errorf("speed must be positive")}
+				}
+
+				br := bufio.NewReader(f)
+				var tr *trace.Reader
+				if isCommandTraceFile(path, br) {
+					if tr, err = encodeCommandTrace(br, c.GlobalBool("legacy")); err != nil {
+						le.WithError(err).Errorf("could not encode the command trace")
 						return err
 					}
-					le.Warningf("writing trace")
-					rw = trace.NewTracer(traceFile, f)
+					le.Warningf("command trace encoded")
+				} else {
+					tr = trace.NewReader(br)
 				}
-
-				reportR, reportW := hid.NewReportReader(rw), hid.NewReportWriter(rw)
-				frameTransport := hid.NewTransport(reportR, reportW, hidReportDefs)
-				processFrames(frameTransport)
+				reportDefs := traceReportDefs(tr)
+				rp, err := newReplayer(ctx, tr, reportDefs, speed, !c.Bool("no-timing"))
+				if err != nil {
+					le.WithError(err).Errorf("could not read the trace file")
+					return err
+				}
+				reportR, reportW := hid.NewReportReader(rp), hid.NewReportWriter(rp)
+				frameTransport, err := withFaults(c, hid.NewTransport(reportR, reportW, reportDefs))
+				if err != nil {
+					return err
+				}
+				processFrames(ctx, frameTransport)
+				rp.logSummary()
 				return nil
 			},
 		},
 		{
-			Name:    "replay",
-			Aliases: []string{"r"},
-			Usage:   "respond to requests from a trace file",
+			Name:    "view",
+			Aliases: []string{"v"},
+			Usage:   "view a trace file",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "level",
+					Usage: "show frames, packets and commands (frame), packets and commands (packet) or just commands (cmd), frames and packets that could not be decoded are always shown",
+					Value: "frame",
+				},
+				cli.BoolFlag{
+					Name:  "follow, f",
+					Usage: "keep reading the trace as it grows like tail -f",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "print log lines (text) or one record per command as json lines, csv or an aligned table (json, csv, table)",
+					Value: "text",
+				},
+			}, viewFilterFlags...),
 			Action: func(c *cli.Context) error {
 				path := c.Args().First()
 				if path == "" {
 					return UsageError{cli.NewExitError("trace file path is missing", 1)}
 				}
+				level, err := parseViewLevel(c.String("level"))
+				if err != nil {
+					return UsageError{err}
+				}
+				filter, err := viewFilterFromFlags(c)
+				if err != nil {
+					return UsageError{err}
+				}
+				format, err := parseViewFormat(c.String("format"))
+				if err != nil {
+					return UsageError{err}
+				}
+				if format == viewFormatTable && c.Bool("follow") {
+					return UsageError{fmt.Errorf("table format can't be followed, use csv or json")}
+				}
+				if format != viewFormatText {
+					// keep stdout for the records
+					log.Out = os.Stderr
+				}
 
-				f, err := openTraceFile(path)
+				var f io.ReadCloser
+				if c.Bool("follow") {
+					ctx, cancel := signalContext()
+					defer cancel()
+					f, err = trace.OpenFollow(ctx, path, 200*time.Millisecond)
+				} else {
+					f, err = openTraceFile(path)
+				}
 				le := log.WithField("path", path)
 				if err != nil {
 					le.WithError(err).Errorf("could not open the trace file")
 					return err
 				}
+				defer f.Close()
 				le.Warningf("trace file opened")
-
 				tr := trace.NewReader(f)
-				tdr := trace.NewTraceDirReader(tr, trace.DirIn)
-				reportR, reportW := hid.NewReportReader(tdr), hid.NewReportWriter(ioutil.Discard)
-				frameTransport := hid.NewTransport(reportR, reportW, hidReportDefs)
-				processFrames(frameTransport)
+				if format != viewFormatText {
+					return writeViewRecords(os.Stdout, tr, traceReportDefs(tr), filter, format)
+				}
+				dumpTrace(tr, traceReportDefs(tr), filter, level)
 				return nil
 			},
 		},
 		{
-			Name:    "view",
-			Aliases: []string{"v"},
-			Usage:   "view a trace file",
+			Name:      "export",
+			Usage:     "export a trace file to another format",
+			ArgsUsage: "<trace>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "pcapng",
+					Usage: "write the reports as usb packets to a pcapng `file` for wireshark",
+				},
+				cli.StringFlag{
+					Name:  "commands",
+					Usage: "write the decoded commands as json lines to a `file`",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				path := c.Args().First()
 				if path == "" {
-					return UsageError{cli.NewExitError("trace file path is missing", 1)}
+					return UsageError{fmt.Errorf("trace file path is missing")}
+				}
+				out, cmdOut := c.String("pcapng"), c.String("commands")
+				if out == "" && cmdOut == "" {
+					return UsageError{fmt.Errorf("output file is missing")}
+				}
+				if out != "" && cmdOut != "" {
+					return UsageError{fmt.Errorf("only one output file is supported")}
 				}
 
 				f, err := openTraceFile(path)
@@ -204,83 +859,284 @@ func main() {
 					le.WithError(err).Errorf("could not open the trace file")
 					return err
 				}
+				defer f.Close()
 				le.Warningf("trace file opened")
+
 				tr := trace.NewReader(f)
-				dumpTrace(tr)
+				if cmdOut != "" {
+					if err := exportCommands(cmdOut, tr, traceReportDefs(tr)); err != nil {
+						log.WithError(err).WithField("path", cmdOut).Errorf("could not export the trace")
+						return err
+					}
+					log.WithField("path", cmdOut).Warningf("command trace written")
+					return nil
+				}
+				if err := exportPcapng(out, tr, traceReportDefs(tr)); err != nil {
+					log.WithError(err).WithField("path", out).Errorf("could not export the trace")
+					return err
+				}
+				log.WithField("path", out).Warningf("pcapng written")
 				return nil
 			},
 		},
 		{
-			Name: "send",
+			Name:      "import",
+			Usage:     "import a capture from another format into a trace file",
+			ArgsUsage: "<out.trace>",
 			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "write-trace, w",
-					Usage: "Write trace to a `file`",
+					Name:  "usbmon",
+					Usage: "read usb hid reports from a usbmon text or pcap/pcapng `file`",
+				},
+				cli.StringFlag{
+					Name:  "device",
+					Usage: "usb `bus:device` of the ipod (default: the first device sending iap frames)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				out := c.Args().First()
+				if out == "" {
+					return UsageError{fmt.Errorf("output trace file path is missing")}
+				}
+				in := c.String("usbmon")
+				if in == "" {
+					return UsageError{fmt.Errorf("capture file is missing")}
+				}
+				var addr *usbAddr
+				if c.IsSet("device") {
+					var err error
+					if addr, err = parseUSBAddr(c.String("device")); err != nil {
+						return UsageError{err}
+					}
+				}
+
+				if err := importUSBMonFile(in, out, addr); err != nil {
+					log.WithError(err).WithField("path", in).Errorf("could not import the capture")
+					return err
+				}
+				log.WithField("path", out).Warningf("trace written")
+				return nil
+			},
+		},
+		{
+			Name:      "diff",
+			Usage:     "compare two trace files command by command",
+			ArgsUsage: "<a.trace> <b.trace>",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "print equal commands too",
+				},
+			}, ignoreFlags...),
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 2 {
+					return UsageError{fmt.Errorf("two trace files are required")}
+				}
+				var cmds [2][]traceCommand
+				for i, path := range c.Args()[:2] {
+					f, err := openTraceFile(path)
+					le := log.WithField("path", path)
+					if err != nil {
+						le.WithError(err).Errorf("could not open the trace file")
+						return err
+					}
+					cmds[i], err = readTraceCommands(f)
+					f.Close()
+					if err != nil {
+						le.WithError(err).Errorf("could not read the trace file")
+						return err
+					}
+				}
+
+				s := diffCommands(os.Stdout, cmds[0], cmds[1], ignoreRulesFromFlags(c), c.Bool("all"))
+				if !s.Same() {
+					return fmt.Errorf("traces differ")
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "redact",
+			Usage:     "replace serial numbers, certificates and other private fields in a trace file",
+			ArgsUsage: "<in.trace> <out.trace>",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "field",
+					Usage: "also redact the `field` i.e. general.ReturniPodName.Name or general.FIDAccInfoToken{AccInfoType=1}.Value",
+				},
+				cli.BoolFlag{
+					Name:  "no-default-fields",
+					Usage: "only redact the fields given with --field",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 2 {
+					return UsageError{fmt.Errorf("input and output trace files are required")}
+				}
+				var fields []string
+				if !c.Bool("no-default-fields") {
+					fields = append(fields, defaultRedactRules...)
+				}
+				rules, err := parseRedactRules(append(fields, c.StringSlice("field")...))
+				if err != nil {
+					return UsageError{err}
+				}
+
+				path, out := c.Args()[0], c.Args()[1]
+				f, err := openTraceFile(path)
+				le := log.WithField("path", path)
+				if err != nil {
+					le.WithError(err).Errorf("could not open the trace file")
+					return err
+				}
+				defer f.Close()
+
+				var buf bytes.Buffer
+				n, err := redactTrace(trace.NewReader(f), &buf, rules)
+				if err != nil {
+					le.WithError(err).Errorf("could not redact the trace")
+					return err
+				}
+				if err := ioutil.WriteFile(out, buf.Bytes(), 0644); err != nil {
+					return err
+				}
+				log.WithField("path", out).WithField("frames", n).Warningf("redacted trace written")
+				return nil
+			},
+		},
+		{
+			Name:      "verify",
+			Usage:     "check that the current handlers respond to the requests of trace files like recorded",
+			ArgsUsage: "<trace or dir>...",
+			Flags: append(append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "print equal commands too",
 				},
+			}, ignoreFlags...), deviceFlags...),
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return UsageError{fmt.Errorf("trace file path is missing")}
+				}
+				files, err := traceFiles(c.Args())
+				if err != nil {
+					return err
+				}
+				if !c.GlobalBool("debug") {
+					// the handler logs would drown the report
+					log.SetLevel(logrus.WarnLevel)
+				}
+				if err := setupDevice(c); err != nil {
+					return err
+				}
+				return verifyTraces(os.Stdout, files, devGeneral.cfg, ignoreRulesFromFlags(c), c.Bool("all"))
 			},
-			Usage: "acc mode / send accessory requests from a trace file",
+		},
+		{
+			Name:      "stats",
+			Usage:     "print command counts, decode errors, the handshake and response latencies of a trace file",
+			ArgsUsage: "<trace>",
 			Action: func(c *cli.Context) error {
-				path := c.Args().Get(0)
+				path := c.Args().First()
 				if path == "" {
-					return UsageError{fmt.Errorf("device path is missing")}
+					return UsageError{fmt.Errorf("trace file path is missing")}
 				}
-				f, err := openDevice(path)
+				f, err := openTraceFile(path)
 				le := log.WithField("path", path)
 				if err != nil {
-					le.WithError(err).Errorf("could not open the device")
+					le.WithError(err).Errorf("could not open the trace file")
 					return err
 				}
-				le.Info("device opened")
+				defer f.Close()
+				if !c.GlobalBool("debug") {
+					log.SetLevel(logrus.WarnLevel)
+				}
 
-				tpath := c.Args().Get(1)
+				tr := trace.NewReader(f)
+				s, err := collectStats(tr, traceReportDefs(tr))
+				if err != nil {
+					le.WithError(err).Errorf("could not read the trace file")
+					return err
+				}
+				s.print(os.Stdout)
+				return nil
+			},
+		},
+		{
+			Name:      "script",
+			ArgsUsage: "<dev> <scenario>",
+			Usage:     "acc mode / run a yaml or json scenario of commands to send and expect against a device",
+			Flags:     append(append([]cli.Flag{}, traceFlags...), writerFlags...),
+			Action: func(c *cli.Context) error {
+				path, scPath := c.Args().Get(0), c.Args().Get(1)
+				if path == "" {
+					return UsageError{fmt.Errorf("device path is missing")}
+				}
+				if scPath == "" {
+					return UsageError{fmt.Errorf("scenario file path is missing")}
+				}
+				sc, err := loadScenario(scPath)
+				if err != nil {
+					return err
+				}
+				return withDevice(c, path, func(ctx context.Context, _ context.CancelFunc, t ipod.FrameReadWriter) error {
+					return runScenario(ctx, t, sc, os.Stdout)
+				})
+			},
+		},
+		{
+			Name:      "send",
+			ArgsUsage: "<dev> <trace>",
+			Flags: append(append([]cli.Flag{
+				cli.DurationFlag{
+					Name:  "wait",
+					Usage: "keep reading responses for `duration` after the last packet (0 to wait until interrupted)",
+					Value: 2 * time.Second,
+				},
+				cli.BoolFlag{
+					Name:  "no-timing",
+					Usage: "send the packets as soon as the recorded responses arrive instead of keeping the recorded gaps",
+				},
+			}, traceFlags...), writerFlags...),
+			Usage: "acc mode / send the accessory packets of a trace file one by one and expect the recorded responses",
+			Action: func(c *cli.Context) error {
+				path, tpath := c.Args().Get(0), c.Args().Get(1)
+				if path == "" {
+					return UsageError{fmt.Errorf("device path is missing")}
+				}
 				if tpath == "" {
-					return UsageError{cli.NewExitError("trace file path is missing", 1)}
+					return UsageError{fmt.Errorf("trace file path is missing")}
 				}
-
 				tf, err := openTraceFile(tpath)
 				tle := log.WithField("path", tpath)
 				if err != nil {
 					tle.WithError(err).Errorf("could not open the trace file")
 					return err
 				}
-				tle.Warningf("trace file opened")
+				defer tf.Close()
 				tr := trace.NewReader(tf)
-				tdr := trace.NewTraceDirReader(tr, trace.DirIn)
+				sc, err := scenarioFromTrace(tpath, tr, traceReportDefs(tr), !c.Bool("no-timing"))
+				if err != nil {
+					tle.WithError(err).Errorf("could not read the trace file")
+					return err
+				}
+				tle.Warningf("trace file opened")
 
-				var rw io.ReadWriter = f
-				if tracePath := c.String("write-trace"); tracePath != "" {
-					traceFile, err := newTraceFile(tracePath)
-					le := log.WithField("path", tracePath)
-					if err != nil {
-						le.WithError(err).Errorf("could not create a trace file")
+				return withDevice(c, path, func(ctx context.Context, _ context.CancelFunc, t ipod.FrameReadWriter) error {
+					if err := runScenario(ctx, t, sc, os.Stdout); err != nil {
 						return err
 					}
-					le.Warningf("writing trace")
-					rw = trace.NewTracer(traceFile, f)
-				}
-				reportR, reportW := hid.NewReportReader(rw), hid.NewReportWriter(rw)
-				dummyW := hid.NewReportWriter(ioutil.Discard)
-				traceR := hid.NewReportReader(tdr)
-
-				frameTransport := hid.NewTransport(reportR, dummyW, hidReportDefs)
-
-				go processFrames(frameTransport)
-
-				for {
-					report, err := traceR.ReadReport()
-					if err != nil {
-						break
+					// the responses are logged while waiting
+					var wait <-chan time.Time
+					if d := c.Duration("wait"); d > 0 {
+						wait = time.After(d)
 					}
-
-					reportW.WriteReport(report)
-					log.Infof("writing report\n%s", spew.Sdump(report))
-
-					time.Sleep(1000 * time.Millisecond)
-				}
-
-				select {}
-
-				return nil
+					select {
+					case <-wait:
+					case <-ctx.Done():
+					}
+					return nil
+				})
 			},
 		},
 	}
@@ -323,67 +1179,14 @@ func logCmd(cmd *ipod.Command, err error, msg string) {
 		return
 	}
 	le.Infof(msg)
-	if log.Level == logrus.DebugLevel {
+	if log.Level == logrus.DebugLevel || debugLingos.enabled(cmd) {
 		spew.Fdump(log.Out, cmd)
 	}
 
 }
 
-func processFrames(frameTransport ipod.FrameReadWriter) {
-	serde := ipod.CommandSerde{}
-
-	for {
-		inFrame, err := frameTransport.ReadFrame()
-		if err == io.EOF {
-			break
-		}
-		logFrame(inFrame, err, "<< FRAME")
-		if err != nil {
-			continue
-		}
-
-		packetReader := ipod.NewPacketReader(inFrame)
-		inCmdBuf := ipod.CmdBuffer{}
-		for {
-			inPacket, err := packetReader.ReadPacket()
-			if err == io.EOF {
-				break
-			}
-			logPacket(inPacket, err, "<< PACKET")
-			if err != nil {
-				continue
-			}
-
-			inCmd, err := serde.UnmarshalCmd(inPacket)
-			logCmd(inCmd, err, "<< CMD")
-			inCmdBuf.WriteCommand(inCmd)
-		}
-
-		outCmdBuf := ipod.CmdBuffer{}
-		for i := range inCmdBuf.Commands {
-			//todo: check return error
-			handlePacket(&outCmdBuf, inCmdBuf.Commands[i])
-		}
-
-		for i := range outCmdBuf.Commands {
-			outCmd := outCmdBuf.Commands[i]
-			logCmd(outCmd, nil, ">> CMD")
-
-			outPacket, err := serde.MarshalCmd(outCmd)
-			logPacket(outPacket, err, ">> PACKET")
-
-			packetWriter := ipod.NewPacketWriter()
-			packetWriter.WritePacket(outPacket)
-			outFrame := packetWriter.Bytes()
-			outFrameErr := frameTransport.WriteFrame(outFrame)
-			logFrame(outFrame, outFrameErr, ">> FRAME")
-		}
-
-	}
-	log.Warnf("EOF")
-}
-
 var devGeneral = &DevGeneral{}
+var devExtRemote = newDevExtRemote()
 
 func handlePacket(cmdWriter ipod.CommandWriter, cmd *ipod.Command) {
 	switch cmd.ID.LingoID() {
@@ -401,7 +1204,7 @@ func handlePacket(cmdWriter ipod.CommandWriter, cmd *ipod.Command) {
 	case ipod.LingoDisplayRemoteID:
 		dispremote.HandleDispRemote(cmd, cmdWriter, nil)
 	case ipod.LingoExtRemoteID:
-		extremote.HandleExtRemote(cmd, cmdWriter, nil)
+		extremote.HandleExtRemote(cmd, cmdWriter, devExtRemote)
 	case ipod.LingoDigitalAudioID:
 		audio.HandleAudio(cmd, cmdWriter, nil)
 	}
@@ -416,54 +1219,31 @@ func dirPrefix(dir trace.Dir, text string) string {
 		return "?? " + text
 	}
 }
-func dumpTrace(tr *trace.Reader) {
-	q := trace.Queue{}
-	for {
-		var msg trace.Msg
-		err := tr.ReadMsg(&msg)
-		if err == io.EOF {
-			break
+func dumpTrace(tr *trace.Reader, reportDefs hid.ReportDefs, filter *viewFilter, level viewLevel) {
+	err := decodeTrace(tr, reportDefs, func(frame *trace.Frame) {
+		if !filter.matchFrame(frame) {
+			return
 		}
-		if err != nil {
-			log.Fatal(err)
+		// a broken frame has no commands to show it by
+		if level <= viewLevelFrame || frame.Err != nil {
+			logFrame(frame.Data, frame.Err, dirPrefix(frame.Dir, "FRAME"))
 		}
-		q.Enqueue(&msg)
-	}
-
-	serde := ipod.CommandSerde{}
-
-	for {
-		head := q.Head()
-		if head == nil {
-			break
-		}
-		dir := head.Dir
-		tdr := trace.NewQueueDirReader(&q, dir)
-		d := hid.NewDecoder(hid.NewReportReader(tdr), hidReportDefs)
-
-		frame, err := d.ReadFrame()
-		if err == io.EOF {
-			break
-		}
-		logFrame(frame, err, dirPrefix(dir, "FRAME"))
-		if err != nil {
-			continue
-		}
-
-		packetReader := ipod.NewPacketReader(frame)
-		for {
-			packet, err := packetReader.ReadPacket()
-			if err == io.EOF {
-				break
+		for i := range frame.Packets {
+			p := &frame.Packets[i]
+			if !filter.matchPacket(p) {
+				continue
+			}
+			if level <= viewLevelPacket || p.Err != nil {
+				logPacket(p.Data, p.Err, dirPrefix(frame.Dir, "PACKET"))
 			}
-			logPacket(packet, err, dirPrefix(dir, "PACKET"))
-			if err != nil {
+			if p.Err != nil {
 				continue
 			}
-
-			cmd, err := serde.UnmarshalCmd(packet)
-			logCmd(cmd, err, dirPrefix(dir, "CMD"))
+			logCmd(p.Cmd, p.CmdErr, dirPrefix(frame.Dir, "CMD"))
 		}
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 	log.Warnf("EOF")
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	"github.com/oandrew/ipod/trace"
+)
+
+// viewFormat selects how view prints the trace
+type viewFormat int
+
+const (
+	viewFormatText viewFormat = iota
+	viewFormatJSON
+	viewFormatCSV
+	viewFormatTable
+)
+
+func parseViewFormat(s string) (viewFormat, error) {
+	switch s {
+	case "text", "":
+		return viewFormatText, nil
+	case "json":
+		return viewFormatJSON, nil
+	case "csv":
+		return viewFormatCSV, nil
+	case "table":
+		return viewFormatTable, nil
+	}
+	return 0, fmt.Errorf("unknown format %q: expected text, json, csv or table", s)
+}
+
+// viewRecord is a decoded command or a decode error of a trace
+type viewRecord struct {
+	Index  uint                   `json:"index"`
+	TS     float64                `json:"ts"`
+	Dir    string                 `json:"dir"`
+	Lingo  string                 `json:"lingo,omitempty"`
+	Name   string                 `json:"name,omitempty"`
+	ID     string                 `json:"id,omitempty"`
+	Trx    *uint16                `json:"trx,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+
+	cmd *ipod.Command
+}
+
+func dirName(dir trace.Dir) string {
+	if dir == trace.DirOut {
+		return "out"
+	}
+	return "in"
+}
+
+// viewRecords returns the records of the packets of a frame
+// matching the filter
+func viewRecords(frame *trace.Frame, filter *viewFilter) []*viewRecord {
+	rec := func() *viewRecord {
+		r := &viewRecord{
+			TS:  frame.TS.Seconds(),
+			Dir: dirName(frame.Dir),
+		}
+		if len(frame.Msgs) > 0 {
+			r.Index = frame.Msgs[0].Index
+		}
+		return r
+	}
+	if frame.Err != nil {
+		r := rec()
+		r.Error = "frame: " + frame.Err.Error()
+		return []*viewRecord{r}
+	}
+
+	var recs []*viewRecord
+	for i := range frame.Packets {
+		p := &frame.Packets[i]
+		if !filter.matchPacket(p) {
+			continue
+		}
+		r := rec()
+		if p.Err != nil {
+			r.Error = "packet: " + p.Err.Error()
+			recs = append(recs, r)
+			continue
+		}
+		cmdRec := trace.NewCommandRecord(frame.Dir, 0, p.Cmd, p.Data, p.CmdErr)
+		r.Lingo = lingoName(p.Cmd)
+		r.Name = commandName(p.Cmd)
+		r.ID = cmdRec.ID
+		r.Trx = cmdRec.Trx
+		r.Fields = cmdRec.Fields
+		r.Error = cmdRec.Error
+		r.cmd = p.Cmd
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+var viewColumns = []string{"index", "ts", "dir", "lingo", "name", "trx", "error", "fields"}
+
+// columns returns the record for csv and table output.
+// Field values longer than maxValue are cut (0 keeps them whole).
+func (r *viewRecord) columns(maxValue int) []string {
+	trx := ""
+	if r.Trx != nil {
+		trx = fmt.Sprintf("%#04x", *r.Trx)
+	}
+	fields := ""
+	if r.cmd != nil {
+		fields = fieldSummary(r.cmd, maxValue)
+	}
+	return []string{
+		strconv.FormatUint(uint64(r.Index), 10),
+		strconv.FormatFloat(r.TS, 'f', 6, 64),
+		r.Dir,
+		r.Lingo,
+		r.Name,
+		trx,
+		r.Error,
+		fields,
+	}
+}
+
+// writeViewRecords writes one record per command of the trace
+// in a machine readable format
+func writeViewRecords(w io.Writer, tr *trace.Reader, reportDefs hid.ReportDefs, filter *viewFilter, format viewFormat) error {
+	var write func(r *viewRecord) error
+	var flush func() error
+	switch format {
+	case viewFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		write = func(r *viewRecord) error { return enc.Encode(r) }
+		flush = func() error { return nil }
+	case viewFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(viewColumns)
+		write = func(r *viewRecord) error { return cw.Write(r.columns(0)) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case viewFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(viewColumns, "\t")))
+		write = func(r *viewRecord) error {
+			_, err := fmt.Fprintln(tw, strings.Join(r.columns(maxAnnotationValue), "\t"))
+			return err
+		}
+		flush = tw.Flush
+	default:
+		return fmt.Errorf("unsupported format %v", format)
+	}
+
+	var writeErr error
+	err := decodeTrace(tr, reportDefs, func(frame *trace.Frame) {
+		if writeErr != nil || !filter.matchFrame(frame) {
+			return
+		}
+		for _, r := range viewRecords(frame, filter) {
+			if writeErr = write(r); writeErr != nil {
+				return
+			}
+		}
+		// a followed trace shows every frame as it comes, the table
+		// is only aligned once the trace ends
+		if format != viewFormatTable {
+			writeErr = flush()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return flush()
+}
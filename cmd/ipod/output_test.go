@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+func TestWriteViewRecords(t *testing.T) {
+	var buf bytes.Buffer
+	tw := trace.NewWriter(&buf)
+	if err := tw.WriteHeader(&trace.Header{ReportDefs: hid.DefaultReportDefs}); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCommand(t, tw, trace.DirIn, 0, testCommand(t, &general.StartIDPS{}, ipod.NewTransaction(0x12)))
+	writeTestCommand(t, tw, trace.DirOut, 250*time.Millisecond,
+		testCommand(t, &general.ACK{Status: general.ACKStatusSuccess, CmdID: 0x38}, ipod.NewTransaction(0x12)))
+	for _, msg := range []*trace.Msg{
+		// a packet with a broken checksum
+		{Dir: trace.DirIn, TS: 500 * time.Millisecond, Data: []byte{0x01, 0x00, 0x55, 0x02, 0x00, 0x07, 0x00}},
+		// a frame that never ends
+		{Dir: trace.DirOut, TS: 750 * time.Millisecond, Data: []byte{0x01, 0x02, 0x55, 0x04}},
+	} {
+		if err := tw.WriteMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		format viewFormat
+		filter viewFilter
+		want   string
+	}{
+		{"json", viewFormatJSON, viewFilter{}, "" +
+			`{"index":0,"ts":0,"dir":"in","lingo":"general","name":"general.StartIDPS","id":"0x00,0x38","trx":18}` + "\n" +
+			`{"index":1,"ts":0.25,"dir":"out","lingo":"general","name":"general.ACK","id":"0x00,0x02","trx":18,"fields":{"CmdID":56,"Status":0}}` + "\n" +
+			`{"index":2,"ts":0.5,"dir":"in","error":"packet: invalid checksum"}` + "\n" +
+			`{"index":3,"ts":0.75,"dir":"out","error":"frame: unexpected EOF"}` + "\n",
+		},
+		{"csv", viewFormatCSV, viewFilter{}, "" +
+			"index,ts,dir,lingo,name,trx,error,fields\n" +
+			"0,0.000000,in,general,general.StartIDPS,0x0012,,\n" +
+			"1,0.250000,out,general,general.ACK,0x0012,,Status=0x0 CmdID=0x38\n" +
+			"2,0.500000,in,,,,packet: invalid checksum,\n" +
+			"3,0.750000,out,,,,frame: unexpected EOF,\n",
+		},
+		{"csv-errors", viewFormatCSV, viewFilter{Errors: true}, "" +
+			"index,ts,dir,lingo,name,trx,error,fields\n" +
+			"2,0.500000,in,,,,packet: invalid checksum,\n" +
+			"3,0.750000,out,,,,frame: unexpected EOF,\n",
+		},
+		{"table", viewFormatTable, viewFilter{}, "" +
+			"INDEX  TS        DIR  LINGO    NAME               TRX     ERROR                     FIELDS\n" +
+			"0      0.000000  in   general  general.StartIDPS  0x0012                            \n" +
+			"1      0.250000  out  general  general.ACK        0x0012                            Status=0x0 CmdID=0x38\n" +
+			"2      0.500000  in                                       packet: invalid checksum  \n" +
+			"3      0.750000  out                                      frame: unexpected EOF     \n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := trace.NewReader(bytes.NewReader(buf.Bytes()))
+			var out bytes.Buffer
+			if err := writeViewRecords(&out, tr, traceReportDefs(tr), &tt.filter, tt.format); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
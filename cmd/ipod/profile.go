@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// deviceProfile is a device of the built-in catalog
+type deviceProfile struct {
+	Description string
+	Config      deviceConfig
+}
+
+// iosLingoVersions are the lingoes supported by iOS devices
+var iosLingoVersions = map[string]string{
+	"general":      "1.9",
+	"simpleremote": "1.4",
+	"dispremote":   "1.5",
+	"extremote":    "1.14",
+	"audio":        "1.2",
+}
+
+// iosOptions are the general lingo options of iOS devices:
+// remote ui, notifications, app launch and the rest of the iOS features
+const iosOptions = 0x000000063DEF73FF
+
+// deviceProfiles is the catalog of devices that can be emulated.
+// The lingo versions list the supported lingoes, the version of
+// any other lingo is refused.
+var deviceProfiles = map[string]deviceProfile{
+	"classic6g": {
+		Description: "iPod classic 6th generation (80GB)",
+		Config: deviceConfig{
+			Name:            "iPod",
+			Serial:          "8K1234ABYMV",
+			SoftwareVersion: "1.1.2",
+			ModelID:         0x000B0010,
+			Model:           "MB029",
+			MaxPayload:      65535,
+			LingoVersions: map[string]string{
+				"general":      "1.9",
+				"simpleremote": "1.3",
+				"dispremote":   "1.5",
+				"extremote":    "1.12",
+				"audio":        "1.2",
+			},
+			LingoOptions: map[string]uint64{
+				"general": 0x00000000000DF3FF,
+			},
+		},
+	},
+	"nano5g": {
+		Description: "iPod nano 5th generation (8GB)",
+		Config: deviceConfig{
+			Name:            "iPod",
+			Serial:          "5U1234AB71X",
+			SoftwareVersion: "1.0.2",
+			ModelID:         0x00100008,
+			Model:           "MC031",
+			MaxPayload:      65535,
+			LingoVersions: map[string]string{
+				"general":      "1.9",
+				"simpleremote": "1.4",
+				"dispremote":   "1.5",
+				"extremote":    "1.13",
+				"audio":        "1.2",
+			},
+			LingoOptions: map[string]uint64{
+				"general": 0x00000000001DF3FF,
+			},
+		},
+	},
+	"touch4g": {
+		Description: "iPod touch 4th generation (8GB)",
+		Config: deviceConfig{
+			Name:            "iPod touch",
+			Serial:          "C3TF1234DCP7",
+			SoftwareVersion: "6.1.6",
+			ModelID:         0x00130004,
+			Model:           "MC540",
+			MaxPayload:      65535,
+			LingoVersions:   iosLingoVersions,
+			LingoOptions: map[string]uint64{
+				"general": iosOptions,
+			},
+		},
+	},
+	"iphone4": {
+		Description: "iPhone 4 (16GB)",
+		Config: deviceConfig{
+			Name:            "iPhone",
+			Serial:          "88034ABCA4S",
+			SoftwareVersion: "7.1.2",
+			ModelID:         0x00110004,
+			Model:           "MC603",
+			MaxPayload:      65535,
+			LingoVersions:   iosLingoVersions,
+			LingoOptions: map[string]uint64{
+				"general": iosOptions,
+			},
+		},
+	},
+	"iphone4s": {
+		Description: "iPhone 4S (16GB)",
+		Config: deviceConfig{
+			Name:            "iPhone",
+			Serial:          "DNPG1234DTD0",
+			SoftwareVersion: "9.3.5",
+			ModelID:         0x00140004,
+			Model:           "MD234",
+			MaxPayload:      65535,
+			LingoVersions:   iosLingoVersions,
+			LingoOptions: map[string]uint64{
+				"general": iosOptions,
+			},
+		},
+	},
+	"iphone5": {
+		Description: "iPhone 5 (16GB)",
+		Config: deviceConfig{
+			Name:            "iPhone",
+			Serial:          "F2LJ1234DTTN",
+			SoftwareVersion: "10.3.4",
+			ModelID:         0x00150004,
+			Model:           "MD297",
+			MaxPayload:      65535,
+			LingoVersions:   iosLingoVersions,
+			LingoOptions: map[string]uint64{
+				"general": iosOptions,
+			},
+		},
+	},
+}
+
+// profileNames returns the names of the catalog sorted
+func profileNames() []string {
+	var names []string
+	for name := range deviceProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupProfile returns the resolved config of a profile
+func lookupProfile(name string) (*deviceConfig, error) {
+	p, ok := deviceProfiles[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q: expected one of %s", name, strings.Join(profileNames(), ", "))
+	}
+	cfg := copyDeviceConfig(&p.Config)
+	if err := cfg.resolve(); err != nil {
+		return nil, fmt.Errorf("profile %s: %v", name, err)
+	}
+	cfg.strict = true
+	return cfg, nil
+}
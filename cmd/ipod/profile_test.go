@@ -0,0 +1,283 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/oandrew/ipod"
+	general "github.com/oandrew/ipod/lingo-general"
+)
+
+// handleGeneral runs the general lingo handler and returns the payload of the response
+func handleGeneral(t *testing.T, dev *DevGeneral, payload interface{}) interface{} {
+	t.Helper()
+	req, err := ipod.BuildCommand(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cbuf ipod.CmdBuffer
+	if err := general.HandleGeneral(req, &cbuf, dev); err != nil {
+		t.Fatal(err)
+	}
+	if len(cbuf.Commands) != 1 {
+		t.Fatalf("%T: got %d responses want 1", payload, len(cbuf.Commands))
+	}
+	return cbuf.Commands[0].Payload
+}
+
+func TestProfiles(t *testing.T) {
+	tests := []struct {
+		profile  string
+		name     string
+		sw       general.ReturniPodSoftwareVersion
+		model    general.ReturniPodModelNum
+		versions map[uint8][2]uint8
+		options  uint64
+	}{
+		{
+			profile: "classic6g",
+			name:    "iPod",
+			sw:      general.ReturniPodSoftwareVersion{Major: 1, Minor: 1, Rev: 2},
+			model:   general.ReturniPodModelNum{ModelID: 0x000B0010, Model: []byte("MB029\x00")},
+			versions: map[uint8][2]uint8{
+				ipod.LingoGeneralID:       {1, 9},
+				ipod.LingoSimpleRemoteID:  {1, 3},
+				ipod.LingoExtRemoteID:     {1, 12},
+				ipod.LingoDigitalAudioID:  {1, 2},
+				ipod.LingoDisplayRemoteID: {1, 5},
+			},
+			options: 0x00000000000DF3FF,
+		},
+		{
+			profile: "nano5g",
+			name:    "iPod",
+			sw:      general.ReturniPodSoftwareVersion{Major: 1, Minor: 0, Rev: 2},
+			model:   general.ReturniPodModelNum{ModelID: 0x00100008, Model: []byte("MC031\x00")},
+			versions: map[uint8][2]uint8{
+				ipod.LingoGeneralID:   {1, 9},
+				ipod.LingoExtRemoteID: {1, 13},
+			},
+			options: 0x00000000001DF3FF,
+		},
+		{
+			profile: "touch4g",
+			name:    "iPod touch",
+			sw:      general.ReturniPodSoftwareVersion{Major: 6, Minor: 1, Rev: 6},
+			model:   general.ReturniPodModelNum{ModelID: 0x00130004, Model: []byte("MC540\x00")},
+			versions: map[uint8][2]uint8{
+				ipod.LingoGeneralID:   {1, 9},
+				ipod.LingoExtRemoteID: {1, 14},
+			},
+			options: 0x000000063DEF73FF,
+		},
+		{
+			profile: "iphone4",
+			name:    "iPhone",
+			sw:      general.ReturniPodSoftwareVersion{Major: 7, Minor: 1, Rev: 2},
+			model:   general.ReturniPodModelNum{ModelID: 0x00110004, Model: []byte("MC603\x00")},
+			versions: map[uint8][2]uint8{
+				ipod.LingoGeneralID:   {1, 9},
+				ipod.LingoExtRemoteID: {1, 14},
+			},
+			options: 0x000000063DEF73FF,
+		},
+		{
+			profile: "iphone4s",
+			name:    "iPhone",
+			sw:      general.ReturniPodSoftwareVersion{Major: 9, Minor: 3, Rev: 5},
+			model:   general.ReturniPodModelNum{ModelID: 0x00140004, Model: []byte("MD234\x00")},
+			versions: map[uint8][2]uint8{
+				ipod.LingoGeneralID:      {1, 9},
+				ipod.LingoSimpleRemoteID: {1, 4},
+				ipod.LingoExtRemoteID:    {1, 14},
+			},
+			options: 0x000000063DEF73FF,
+		},
+		{
+			profile: "iphone5",
+			name:    "iPhone",
+			sw:      general.ReturniPodSoftwareVersion{Major: 10, Minor: 3, Rev: 4},
+			model:   general.ReturniPodModelNum{ModelID: 0x00150004, Model: []byte("MD297\x00")},
+			versions: map[uint8][2]uint8{
+				ipod.LingoGeneralID:      {1, 9},
+				ipod.LingoDigitalAudioID: {1, 2},
+			},
+			options: 0x000000063DEF73FF,
+		},
+	}
+	if len(tests) != len(deviceProfiles) {
+		t.Errorf("got %d profiles want %d", len(deviceProfiles), len(tests))
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			cfg, err := lookupProfile(tt.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dev := &DevGeneral{cfg: cfg}
+
+			name := handleGeneral(t, dev, &general.RequestiPodName{})
+			if got := string(name.(*general.ReturniPodName).Name); got != tt.name+"\x00" {
+				t.Errorf("name: got %q want %q", got, tt.name)
+			}
+			if got := handleGeneral(t, dev, &general.RequestiPodSoftwareVersion{}); !reflect.DeepEqual(got, &tt.sw) {
+				t.Errorf("software version: got %+v want %+v", got, tt.sw)
+			}
+			if got := handleGeneral(t, dev, &general.RequestiPodModelNum{}); !reflect.DeepEqual(got, &tt.model) {
+				t.Errorf("model: got %+v want %+v", got, tt.model)
+			}
+			for lingo, v := range tt.versions {
+				want := &general.ReturnLingoProtocolVersion{Lingo: lingo, Major: v[0], Minor: v[1]}
+				if got := handleGeneral(t, dev, &general.RequestLingoProtocolVersion{Lingo: lingo}); !reflect.DeepEqual(got, want) {
+					t.Errorf("lingo %#02x version: got %+v want %+v", lingo, got, want)
+				}
+			}
+			wantOptions := &general.RetiPodOptionsForLingo{LingoID: ipod.LingoGeneralID, Options: tt.options}
+			if got := handleGeneral(t, dev, &general.GetiPodOptionsForLingo{LingoID: ipod.LingoGeneralID}); !reflect.DeepEqual(got, wantOptions) {
+				t.Errorf("options: got %+v want %+v", got, wantOptions)
+			}
+			wantMax := &general.ReturnTransportMaxPayloadSize{MaxPayload: 65535}
+			if got := handleGeneral(t, dev, &general.RequestTransportMaxPayloadSize{}); !reflect.DeepEqual(got, wantMax) {
+				t.Errorf("max payload: got %+v want %+v", got, wantMax)
+			}
+		})
+	}
+}
+
+func TestProfileUnsupportedLingo(t *testing.T) {
+	cfg, err := lookupProfile("classic6g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &general.RequestLingoProtocolVersion{Lingo: ipod.LingoStorageID}
+	want := &general.ACK{Status: general.ACKStatusBadParam, CmdID: 0x0F}
+	if got := handleGeneral(t, &DevGeneral{cfg: cfg}, req); !reflect.DeepEqual(got, want) {
+		t.Errorf("storage version: got %+v want %+v", got, want)
+	}
+	// without a profile every lingo is answered
+	want2 := &general.ReturnLingoProtocolVersion{Lingo: ipod.LingoStorageID, Major: 1, Minor: 1}
+	if got := handleGeneral(t, &DevGeneral{}, req); !reflect.DeepEqual(got, want2) {
+		t.Errorf("storage version: got %+v want %+v", got, want2)
+	}
+}
+
+func TestConfigUnsupportedLingo(t *testing.T) {
+	req := &general.RequestLingoProtocolVersion{Lingo: ipod.LingoSimpleRemoteID}
+	refused := &general.ACK{Status: general.ACKStatusBadParam, CmdID: 0x0F}
+	answered := &general.ReturnLingoProtocolVersion{Lingo: ipod.LingoSimpleRemoteID, Major: 1, Minor: 1}
+
+	// a config that keeps the default lingoes answers every lingo like the default device
+	cfg, err := parseDeviceConfig([]byte("name: foo\n"), &defaultDeviceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := handleGeneral(t, &DevGeneral{cfg: cfg}, req); !reflect.DeepEqual(got, answered) {
+		t.Errorf("simpleremote version: got %+v want %+v", got, answered)
+	}
+
+	// one that lists its lingoes refuses the others
+	cfg, err = parseDeviceConfig([]byte("lingo_versions: {general: 1.9, extremote: 1.12}\n"), &defaultDeviceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := handleGeneral(t, &DevGeneral{cfg: cfg}, req); !reflect.DeepEqual(got, refused) {
+		t.Errorf("simpleremote version: got %+v want %+v", got, refused)
+	}
+}
+
+func TestProfileIdentifyUnsupportedLingo(t *testing.T) {
+	cfg, err := lookupProfile("classic6g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		dev  *DevGeneral
+		req  interface{}
+		want interface{}
+	}{
+		{
+			"legacy-storage",
+			&DevGeneral{cfg: cfg},
+			&general.IdentifyDeviceLingoes{Lingos: general.LingoMask(general.LingoGeneralBit | general.LingoStorageBit)},
+			&general.ACK{Status: general.ACKStatusBadParam, CmdID: 0x13},
+		},
+		{
+			"legacy-extremote",
+			&DevGeneral{cfg: cfg},
+			&general.IdentifyDeviceLingoes{Lingos: general.LingoMask(general.LingoGeneralBit | general.LingoExtRemoteBit)},
+			&general.ACK{Status: general.ACKStatusSuccess, CmdID: 0x13},
+		},
+		{
+			"legacy-storage-default",
+			&DevGeneral{},
+			&general.IdentifyDeviceLingoes{Lingos: general.LingoMask(general.LingoGeneralBit | general.LingoStorageBit)},
+			&general.ACK{Status: general.ACKStatusSuccess, CmdID: 0x13},
+		},
+		{
+			"idps-usbhost",
+			&DevGeneral{cfg: cfg},
+			identifyToken(ipod.LingoGeneralID, ipod.LingoUSBHostID),
+			identifyTokenACK(general.FIDTokenACKStatusFailed),
+		},
+		{
+			"idps-extremote",
+			&DevGeneral{cfg: cfg},
+			identifyToken(ipod.LingoGeneralID, ipod.LingoExtRemoteID),
+			identifyTokenACK(general.FIDTokenACKStatusAccepted),
+		},
+		{
+			"idps-usbhost-default",
+			&DevGeneral{},
+			identifyToken(ipod.LingoGeneralID, ipod.LingoUSBHostID),
+			identifyTokenACK(general.FIDTokenACKStatusAccepted),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := handleGeneral(t, tt.dev, tt.req); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+var identifyTokenID = general.TokenID{FIDType: 0x00, FIDSubtype: 0x00}
+
+func identifyToken(lingoes ...uint8) *general.SetFIDTokenValues {
+	return &general.SetFIDTokenValues{FIDTokenValues: []general.FIDTokenValue{
+		{ID: identifyTokenID, Token: &general.FIDIdentifyToken{AccLingoes: lingoes}},
+	}}
+}
+
+func identifyTokenACK(status byte) *general.RetFIDTokenValueACKs {
+	return &general.RetFIDTokenValueACKs{FIDTokenValueACKs: []general.FIDTokenValueACK{
+		{ID: identifyTokenID, ACK: []byte{status}},
+	}}
+}
+
+func TestProfileUnknown(t *testing.T) {
+	if _, err := lookupProfile("zune"); err == nil {
+		t.Error("got no error for an unknown profile")
+	}
+}
+
+func TestProfileWithConfig(t *testing.T) {
+	base, err := lookupProfile("iphone4s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseDeviceConfig([]byte("name: car test\n"), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "car test" {
+		t.Errorf("name: got %q want %q", cfg.Name, "car test")
+	}
+	if cfg.Model != "MD234" || cfg.softwareVersion != [3]uint8{9, 3, 5} {
+		t.Errorf("got model %s version %v want the profile ones", cfg.Model, cfg.softwareVersion)
+	}
+	if v := cfg.lingoVersions[ipod.LingoExtRemoteID]; v != [2]uint8{1, 14} {
+		t.Errorf("extremote version: got %v want 1.14", v)
+	}
+}
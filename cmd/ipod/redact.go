@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	"github.com/oandrew/ipod/trace"
+)
+
+// defaultRedactRules cover the fields that identify the accessory or the device
+var defaultRedactRules = []string{
+	"general.FIDAccInfoToken{AccInfoType=8}.Value",
+	"general.RetDevAuthenticationInfo.CertData",
+	"general.ReturniPodSerialNum.Serial",
+}
+
+// redactRule selects a field of a payload type i.e.
+//
+//	general.ReturniPodSerialNum.Serial
+//
+// optionally only if another field of the same struct has the given value
+//
+//	general.FIDAccInfoToken{AccInfoType=8}.Value
+type redactRule struct {
+	Type         string
+	Field        string
+	CondField    string
+	CondValue    string
+	hasCondition bool
+}
+
+func parseRedactRule(s string) (redactRule, error) {
+	var rule redactRule
+	dot := strings.LastIndex(s, ".")
+	if dot <= 0 || dot == len(s)-1 {
+		return rule, fmt.Errorf("bad redact rule %q: expected pkg.Type.Field", s)
+	}
+	rule.Type, rule.Field = s[:dot], s[dot+1:]
+	if i := strings.Index(rule.Type, "{"); i != -1 {
+		cond := rule.Type[i:]
+		rule.Type = rule.Type[:i]
+		if !strings.HasSuffix(cond, "}") {
+			return rule, fmt.Errorf("bad redact rule %q: unterminated condition", s)
+		}
+		kv := strings.SplitN(cond[1:len(cond)-1], "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return rule, fmt.Errorf("bad redact rule %q: expected {Field=value}", s)
+		}
+		rule.CondField, rule.CondValue, rule.hasCondition = kv[0], kv[1], true
+	}
+	if !strings.Contains(rule.Type, ".") {
+		return rule, fmt.Errorf("bad redact rule %q: expected pkg.Type.Field", s)
+	}
+	return rule, nil
+}
+
+func parseRedactRules(rules []string) ([]redactRule, error) {
+	parsed := make([]redactRule, len(rules))
+	for i, s := range rules {
+		var err error
+		if parsed[i], err = parseRedactRule(s); err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
+
+// matchValue compares a field value with the value from a rule
+func matchValue(v reflect.Value, s string) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, 64)
+		return err == nil && v.Uint() == n
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, 64)
+		return err == nil && v.Int() == n
+	}
+	return fmt.Sprint(v.Interface()) == s
+}
+
+func (rule *redactRule) match(v reflect.Value) bool {
+	if strings.TrimPrefix(v.Type().String(), "*") != rule.Type {
+		return false
+	}
+	if !rule.hasCondition {
+		return true
+	}
+	cond := v.FieldByName(rule.CondField)
+	return cond.IsValid() && matchValue(cond, rule.CondValue)
+}
+
+// placeholder derives a replacement of the same length from the value
+// so the same value is always replaced with the same placeholder.
+// Null terminated strings stay printable and null terminated.
+func placeholder(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	out := make([]byte, len(b))
+	if n := len(b); n > 0 && b[n-1] == 0 {
+		text := []byte(fmt.Sprintf("%X", sum[:]))
+		if n-1 >= len("REDACTED-")+4 {
+			// long enough to be obviously redacted and still distinct
+			text = append([]byte("REDACTED-"), text...)
+		}
+		for i := 0; i < n-1; i++ {
+			out[i] = text[i%len(text)]
+		}
+		return out
+	}
+	for i := 0; i < len(out); i += len(sum) {
+		copy(out[i:], sum[:])
+		sum = sha256.Sum256(sum[:])
+	}
+	return out
+}
+
+// redactValue replaces the fields of v selected by the rules and
+// reports whether anything was replaced
+func redactValue(v reflect.Value, rules []redactRule) (bool, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return false, nil
+		}
+		v = v.Elem()
+	}
+
+	changed := false
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, rule := range rules {
+			if !rule.match(v) {
+				continue
+			}
+			f := v.FieldByName(rule.Field)
+			if !f.IsValid() {
+				return changed, fmt.Errorf("%s has no field %s", rule.Type, rule.Field)
+			}
+			if err := redactField(f); err != nil {
+				return changed, fmt.Errorf("%s.%s: %v", rule.Type, rule.Field, err)
+			}
+			changed = true
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			c, err := redactValue(v.Field(i), rules)
+			changed = changed || c
+			if err != nil {
+				return changed, err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return false, nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			c, err := redactValue(v.Index(i), rules)
+			changed = changed || c
+			if err != nil {
+				return changed, err
+			}
+		}
+	}
+	return changed, nil
+}
+
+func redactField(f reflect.Value) error {
+	if !f.CanSet() {
+		return fmt.Errorf("field can not be set")
+	}
+	v := f
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch {
+	case !v.IsValid():
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		f.Set(reflect.ValueOf(placeholder(v.Bytes())).Convert(v.Type()))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		b := make([]byte, v.Len())
+		reflect.Copy(reflect.ValueOf(b), v)
+		reflect.Copy(f, reflect.ValueOf(placeholder(b)))
+	default:
+		return fmt.Errorf("can not redact a %v", v.Type())
+	}
+	return nil
+}
+
+// redactFrame replaces the selected fields in the commands of the frame
+// and returns the new frame data or nil if nothing was replaced
+func redactFrame(frame *trace.Frame, rules []redactRule) ([]byte, error) {
+	if frame.Err != nil {
+		return nil, nil
+	}
+	changed := false
+	pw := ipod.NewPacketWriter()
+	for _, p := range frame.Packets {
+		if p.Err != nil || p.CmdErr != nil {
+			// leave frames we don't fully understand alone
+			return nil, nil
+		}
+		c, err := redactValue(reflect.ValueOf(p.Cmd.Payload), rules)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", commandName(p.Cmd), err)
+		}
+		pkt := p.Data
+		if c {
+			serde := ipod.CommandSerde{TrxEnabled: p.Cmd.Transaction != nil}
+			if pkt, err = serde.MarshalCmd(p.Cmd); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+		pw.WritePacket(pkt)
+	}
+	if !changed {
+		return nil, nil
+	}
+	return pw.Bytes(), nil
+}
+
+// reportCollector collects reports written by a hid encoder
+type reportCollector struct {
+	reports []hid.Report
+}
+
+func (rc *reportCollector) WriteReport(report hid.Report) error {
+	rc.reports = append(rc.reports, report)
+	return nil
+}
+
+// reframe splits new frame data into reports. If the length did not change
+// the data is written over the original reports, otherwise the frame is
+// encoded from scratch.
+func reframe(frame *trace.Frame, data []byte, reportDefs hid.ReportDefs) ([]*trace.Msg, error) {
+	msgs := frame.Msgs
+	if len(data) == len(frame.Data) {
+		out := make([]*trace.Msg, len(msgs))
+		offset := 0
+		for i, msg := range msgs {
+			m := *msg
+			m.Data = append([]byte(nil), msg.Data...)
+			n := reportPayloadLen(msg, reportDefs)
+			offset += copy(m.Data[2:2+n], data[offset:])
+			out[i] = &m
+		}
+		return out, nil
+	}
+
+	rc := &reportCollector{}
+	if err := hid.NewEncoderDir(rc, reportDefs, frame.Dir.ReportDir()).WriteFrame(data); err != nil {
+		return nil, err
+	}
+	out := make([]*trace.Msg, len(rc.reports))
+	for i, report := range rc.reports {
+		orig := msgs[len(msgs)-1]
+		if i < len(msgs) {
+			orig = msgs[i]
+		}
+		out[i] = &trace.Msg{
+			Dir:   orig.Dir,
+			TS:    orig.TS,
+			Index: orig.Index,
+			Data:  append([]byte{report.ID, byte(report.LinkControl)}, report.Data...),
+		}
+	}
+	return out, nil
+}
+
+// reportPayloadLen returns the number of frame bytes carried by a report
+func reportPayloadLen(msg *trace.Msg, reportDefs hid.ReportDefs) int {
+	if len(msg.Data) < 2 {
+		return 0
+	}
+	n := len(msg.Data) - 2
+	if def, err := reportDefs.Find(int(msg.Data[0])); err == nil && def.MaxPayload() < n {
+		n = def.MaxPayload()
+	}
+	return n
+}
+
+// redactTrace copies a trace replacing the fields selected by the rules
+func redactTrace(tr *trace.Reader, w io.Writer, rules []redactRule) (int, error) {
+	reportDefs := traceReportDefs(tr)
+	hdr, _ := tr.Header()
+
+	var msgs []*trace.Msg
+	redacted := 0
+	var redactErr error
+	err := decodeTrace(tr, reportDefs, func(frame *trace.Frame) {
+		data, err := redactFrame(frame, rules)
+		if err == nil && data != nil {
+			var out []*trace.Msg
+			if out, err = reframe(frame, data, reportDefs); err == nil {
+				msgs = append(msgs, out...)
+				redacted++
+				return
+			}
+		}
+		if err != nil && redactErr == nil {
+			redactErr = err
+		}
+		msgs = append(msgs, frame.Msgs...)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if redactErr != nil {
+		return 0, redactErr
+	}
+	// stable so reports that replaced a single report stay in order
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Index < msgs[j].Index
+	})
+
+	tw := trace.NewWriter(w)
+	if hdr != nil {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return 0, err
+		}
+	}
+	for _, msg := range msgs {
+		if err := tw.WriteMsg(msg); err != nil {
+			return 0, err
+		}
+	}
+	return redacted, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+func TestParseRedactRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    redactRule
+		wantErr string
+	}{
+		{"general.ReturniPodSerialNum.Serial", redactRule{Type: "general.ReturniPodSerialNum", Field: "Serial"}, ""},
+		{
+			"general.FIDAccInfoToken{AccInfoType=8}.Value",
+			redactRule{Type: "general.FIDAccInfoToken", Field: "Value", CondField: "AccInfoType", CondValue: "8", hasCondition: true},
+			"",
+		},
+		{
+			"general.FIDAccInfoToken{AccInfoType=}.Value",
+			redactRule{Type: "general.FIDAccInfoToken", Field: "Value", CondField: "AccInfoType", hasCondition: true},
+			"",
+		},
+		{"Serial", redactRule{}, "expected pkg.Type.Field"},
+		{"general.ReturniPodSerialNum.", redactRule{}, "expected pkg.Type.Field"},
+		{"ReturniPodSerialNum.Serial", redactRule{}, "expected pkg.Type.Field"},
+		{"general.FIDAccInfoToken{AccInfoType=8.Value", redactRule{}, "unterminated condition"},
+		{"general.FIDAccInfoToken{AccInfoType}.Value", redactRule{}, "expected {Field=value}"},
+		{"general.FIDAccInfoToken{=8}.Value", redactRule{}, "expected {Field=value}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			got, err := parseRedactRule(tt.rule)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseRedactRule() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRedactRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	binary := bytes.Repeat([]byte{0x01, 0x02, 0x03}, 40)
+	for _, b := range [][]byte{nil, {0x00}, []byte("8K123\x00"), []byte("ACC-SERIAL-0001\x00"), binary} {
+		p := placeholder(b)
+		if len(p) != len(b) {
+			t.Errorf("placeholder(%q) has %d bytes, want %d", b, len(p), len(b))
+		}
+		if !bytes.Equal(p, placeholder(append([]byte(nil), b...))) {
+			t.Errorf("placeholder(%q) is not deterministic", b)
+		}
+		if len(b) > 1 && bytes.Equal(p, b) {
+			t.Errorf("placeholder(%q) did not change the value", b)
+		}
+	}
+
+	// null terminated strings stay printable and null terminated
+	short := placeholder([]byte("8K123\x00"))
+	if short[len(short)-1] != 0 || bytes.IndexByte(short[:len(short)-1], 0) != -1 {
+		t.Errorf("placeholder is not a null terminated string: %q", short)
+	}
+	if !strings.HasPrefix(string(placeholder([]byte("ACC-SERIAL-0001\x00"))), "REDACTED-") {
+		t.Errorf("long placeholder is not marked as redacted")
+	}
+	if bytes.Equal(placeholder([]byte("a\x00")), placeholder([]byte("b\x00"))) {
+		t.Errorf("different values share a placeholder")
+	}
+	// binary values longer than a hash don't repeat it
+	if p := placeholder(binary); bytes.Equal(p[:32], p[32:64]) {
+		t.Errorf("binary placeholder repeats the hash")
+	}
+}
+
+// testFrame decodes a single frame of the default report defs
+func testFrame(t *testing.T, dir trace.Dir, payload interface{}) *trace.Frame {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := trace.NewWriter(&buf)
+	if err := tw.WriteHeader(&trace.Header{ReportDefs: hid.DefaultReportDefs}); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCommand(t, tw, dir, 0, payload)
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var frames []*trace.Frame
+	if err := decodeTrace(trace.NewReader(&buf), hid.DefaultReportDefs, func(f *trace.Frame) {
+		frames = append(frames, f)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("decoded %d frames, want 1", len(frames))
+	}
+	return frames[0]
+}
+
+func TestReframe(t *testing.T) {
+	// a frame that takes several reports
+	frame := testFrame(t, trace.DirIn, &general.RetDevAuthenticationInfo{
+		Major: 2, CertMaxSection: 1, CertData: bytes.Repeat([]byte{0xab}, 200),
+	})
+	if len(frame.Msgs) < 2 {
+		t.Fatalf("frame has %d reports, want several", len(frame.Msgs))
+	}
+
+	// the same length is written over the original reports
+	data := bytes.Repeat([]byte{0xcd}, len(frame.Data))
+	msgs, err := reframe(frame, data, hid.DefaultReportDefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != len(frame.Msgs) {
+		t.Fatalf("got %d reports, want %d", len(msgs), len(frame.Msgs))
+	}
+	var got []byte
+	for i, msg := range msgs {
+		orig := frame.Msgs[i]
+		if !bytes.Equal(msg.Data[:2], orig.Data[:2]) || len(msg.Data) != len(orig.Data) || msg.Index != orig.Index {
+			t.Errorf("report %d = % 02x, want the layout of % 02x", i, msg.Data, orig.Data)
+		}
+		got = append(got, msg.Data[2:2+reportPayloadLen(msg, hid.DefaultReportDefs)]...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("reports carry % 02x, want % 02x", got, data)
+	}
+	if frame.Msgs[0].Data[2] != 0x55 {
+		t.Errorf("the original reports were modified")
+	}
+
+	// another length is encoded from scratch
+	data = bytes.Repeat([]byte{0xcd}, len(frame.Data)+100)
+	msgs, err = reframe(frame, data, hid.DefaultReportDefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports []hid.Report
+	for _, msg := range msgs {
+		if msg.Dir != frame.Dir {
+			t.Errorf("report direction = %v, want %v", msg.Dir, frame.Dir)
+		}
+		reports = append(reports, hid.Report{ID: msg.Data[0], LinkControl: hid.LinkControl(msg.Data[1]), Data: msg.Data[2:]})
+	}
+	rc := &reportCollector{}
+	if err := hid.NewEncoderDir(rc, hid.DefaultReportDefs, frame.Dir.ReportDir()).WriteFrame(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reports, rc.reports) {
+		t.Errorf("reports = %v, want %v", reports, rc.reports)
+	}
+}
+
+func TestRedactTrace(t *testing.T) {
+	accSerial := []byte("ACC-SERIAL-0001\x00")
+	accName := []byte("Accessory\x00")
+	serial := []byte("8K123ABCD\x00")
+	certs := [][]byte{
+		bytes.Repeat([]byte{0x30}, 300),
+		bytes.Repeat([]byte{0x31}, 300),
+		bytes.Repeat([]byte{0x32}, 120),
+	}
+
+	var in bytes.Buffer
+	tw := trace.NewWriter(&in)
+	if err := tw.WriteHeader(&trace.Header{ReportDefs: hid.DefaultReportDefs}); err != nil {
+		t.Fatal(err)
+	}
+	cmds := []struct {
+		dir     trace.Dir
+		payload interface{}
+	}{
+		{trace.DirIn, &general.SetFIDTokenValues{FIDTokenValues: []general.FIDTokenValue{
+			{ID: general.TokenID{FIDType: 0x00, FIDSubtype: 0x02}, Token: &general.FIDAccInfoToken{AccInfoType: 0x01, Value: accName}},
+			{ID: general.TokenID{FIDType: 0x00, FIDSubtype: 0x02}, Token: &general.FIDAccInfoToken{AccInfoType: 0x08, Value: accSerial}},
+		}}},
+		{trace.DirIn, &general.RequestiPodSerialNum{}},
+		{trace.DirOut, &general.ReturniPodSerialNum{Serial: serial}},
+	}
+	for i, cert := range certs {
+		cmds = append(cmds, struct {
+			dir     trace.Dir
+			payload interface{}
+		}{trace.DirIn, &general.RetDevAuthenticationInfo{Major: 2, CertCurrentSection: byte(i), CertMaxSection: byte(len(certs) - 1), CertData: cert}})
+	}
+	for i, c := range cmds {
+		writeTestCommand(t, tw, c.dir, time.Duration(i)*100*time.Millisecond, c.payload)
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	inLen := in.Len()
+
+	rules, err := parseRedactRules(defaultRedactRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	n, err := redactTrace(trace.NewReader(bytes.NewReader(in.Bytes())), &out, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 2 + len(certs); n != want {
+		t.Errorf("redacted %d frames, want %d", n, want)
+	}
+	if out.Len() != inLen {
+		t.Errorf("redacted trace has %d bytes, want %d", out.Len(), inLen)
+	}
+
+	// every frame and checksum is still valid
+	tr := trace.NewReader(&out)
+	var got []*ipod.Command
+	var dirs []trace.Dir
+	err = decodeTrace(tr, traceReportDefs(tr), func(frame *trace.Frame) {
+		if frame.Err != nil {
+			t.Errorf("broken frame: %v", frame.Err)
+		}
+		for _, p := range frame.Packets {
+			if p.Err != nil || p.CmdErr != nil {
+				t.Errorf("broken packet: %v %v", p.Err, p.CmdErr)
+				continue
+			}
+			got = append(got, p.Cmd)
+			dirs = append(dirs, frame.Dir)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(cmds) {
+		t.Fatalf("decoded %d commands, want %d", len(got), len(cmds))
+	}
+	for i, c := range cmds {
+		if dirs[i] != c.dir || commandName(got[i]) != commandName(&ipod.Command{Payload: c.payload}) {
+			t.Errorf("command %d = %v %s, want %v %T", i, dirs[i], commandName(got[i]), c.dir, c.payload)
+		}
+	}
+
+	tokens := got[0].Payload.(*general.SetFIDTokenValues).FIDTokenValues
+	if v := tokens[0].Token.(*general.FIDAccInfoToken).Value; !reflect.DeepEqual(v, accName) {
+		t.Errorf("accessory name = %q, want it kept", v)
+	}
+	if v := tokens[1].Token.(*general.FIDAccInfoToken).Value; !reflect.DeepEqual(v, placeholder(accSerial)) {
+		t.Errorf("accessory serial = %q, want %q", v, placeholder(accSerial))
+	}
+	if v := got[2].Payload.(*general.ReturniPodSerialNum).Serial; !bytes.Equal(v, placeholder(serial)) {
+		t.Errorf("ipod serial = %q, want %q", v, placeholder(serial))
+	}
+	for i, cert := range certs {
+		info := got[3+i].Payload.(*general.RetDevAuthenticationInfo)
+		if info.CertCurrentSection != byte(i) || !bytes.Equal(info.CertData, placeholder(cert)) {
+			t.Errorf("cert section %d = %d % 02x, want the placeholder", i, info.CertCurrentSection, info.CertData[:4])
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	"github.com/oandrew/ipod/trace"
+)
+
+// replayMatchWindow is how many pending recorded responses are
+// searched for the one a written frame answers
+const replayMatchWindow = 32
+
+// recordedResponse is an outbound frame of the trace
+type recordedResponse struct {
+	cmd *ipod.Command
+	ts  time.Duration
+	// inTS is the timestamp of the last inbound report before the
+	// response, hasIn is false if there was none
+	inTS  time.Duration
+	hasIn bool
+	index uint
+}
+
+// replayer feeds inbound reports of a trace honoring the recorded
+// inter-message gaps. The frames written back are matched with the
+// recorded responses by command and transaction, their latency is
+// compared with the recorded one.
+type replayer struct {
+	ctx        context.Context
+	q          trace.Queue
+	reportDefs hid.ReportDefs
+	speed      float64
+	timing     bool
+
+	start    time.Time
+	first    time.Duration
+	lastIn   *trace.Msg
+	lastInAt time.Time
+
+	recorded []*recordedResponse
+	wbuf     bytes.Buffer
+
+	matched, unexpected int
+	compared            int
+	maxDelta            time.Duration
+	totalDelta          time.Duration
+}
+
+func newReplayer(ctx context.Context, tr *trace.Reader, reportDefs hid.ReportDefs, speed float64, timing bool) (*replayer, error) {
+	r := &replayer{
+		ctx:        ctx,
+		reportDefs: reportDefs,
+		speed:      speed,
+		timing:     timing,
+	}
+	hasTS := false
+	var lastIn *trace.Msg
+	err := decodeTrace(tr, reportDefs, func(frame *trace.Frame) {
+		for _, msg := range frame.Msgs {
+			hasTS = hasTS || msg.TS != 0
+		}
+		if frame.Dir == trace.DirIn {
+			for _, msg := range frame.Msgs {
+				r.q.Enqueue(msg)
+			}
+			if len(frame.Msgs) > 0 {
+				lastIn = frame.Msgs[len(frame.Msgs)-1]
+			}
+			return
+		}
+		cmds := frame.Commands()
+		if len(cmds) == 0 {
+			return
+		}
+		rec := &recordedResponse{cmd: cmds[0], ts: frame.TS, index: frame.Msgs[0].Index}
+		if lastIn != nil {
+			rec.inTS, rec.hasIn = lastIn.TS, true
+		}
+		r.recorded = append(r.recorded, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.timing && !hasTS {
+		log.Warn("trace has no timestamps, replaying without timing")
+		r.timing = false
+	}
+	return r, nil
+}
+
+// traceTime converts a wall clock duration to trace time
+func (r *replayer) traceTime(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * r.speed)
+}
+
+func (r *replayer) wait(msg *trace.Msg) error {
+	if r.start.IsZero() {
+		r.start = time.Now()
+		r.first = msg.TS
+		return nil
+	}
+	at := r.start.Add(time.Duration(float64(msg.TS-r.first) / r.speed))
+	t := time.NewTimer(time.Until(at))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+func (r *replayer) Read(p []byte) (int, error) {
+	msg := r.q.DequeueDir(trace.DirIn)
+	if msg == nil {
+		return 0, io.EOF
+	}
+	if r.timing {
+		if err := r.wait(msg); err != nil {
+			return 0, err
+		}
+	}
+	r.lastIn, r.lastInAt = msg, time.Now()
+	return copy(p, msg.Data), nil
+}
+
+// Write collects the reports of a frame and matches the frame
+// once it is complete
+func (r *replayer) Write(p []byte) (int, error) {
+	if len(p) < 2 {
+		return len(p), nil
+	}
+	def, err := r.reportDefs.Find(int(p[0]))
+	if err != nil {
+		log.WithError(err).Warn("replay: unknown report written")
+		return len(p), nil
+	}
+	lc, data := hid.LinkControl(p[1]), p[2:]
+	if len(data) > def.MaxPayload() {
+		data = data[:def.MaxPayload()]
+	}
+	if lc&hid.LinkControlContinue == 0 {
+		r.wbuf.Reset()
+	}
+	r.wbuf.Write(data)
+	if lc&hid.LinkControlMoreToFollow == 0 {
+		r.response(r.wbuf.Bytes())
+	}
+	return len(p), nil
+}
+
+// match returns the index of the pending recorded response with the
+// command id and transaction of the packet or -1
+func (r *replayer) match(pkt []byte) (int, *ipod.Command) {
+	for i, rec := range r.recorded {
+		if i == replayMatchWindow {
+			break
+		}
+		// the recorded response tells whether transactions are in use
+		serde := ipod.CommandSerde{TrxEnabled: rec.cmd.Transaction != nil}
+		cmd, err := serde.UnmarshalCmd(pkt)
+		if err != nil || cmd.ID != rec.cmd.ID {
+			continue
+		}
+		if cmd.Transaction != nil && *cmd.Transaction != *rec.cmd.Transaction {
+			continue
+		}
+		return i, cmd
+	}
+	return -1, nil
+}
+
+func (r *replayer) response(frame []byte) {
+	pkt, err := ipod.NewPacketReader(frame).ReadPacket()
+	if err != nil {
+		log.WithError(err).Warn("replay: could not read the written frame")
+		return
+	}
+	i, cmd := r.match(pkt)
+	if i < 0 {
+		r.unexpected++
+		log.WithField("packet", pkt).Warn("replay: response is not in the trace")
+		return
+	}
+	rec := r.recorded[i]
+	r.recorded = append(r.recorded[:i], r.recorded[i+1:]...)
+	r.matched++
+
+	le := CommandLogEntry(logrus.NewEntry(log), cmd).WithField("index", rec.index)
+	if !r.timing || !rec.hasIn || r.lastIn == nil {
+		le.Info(">> MATCHED")
+		return
+	}
+	latency := r.traceTime(time.Since(r.lastInAt))
+	recordedLatency := rec.ts - rec.inTS
+	delta := latency - recordedLatency
+	r.compared++
+	r.totalDelta += delta
+	if r.compared == 1 || delta > r.maxDelta {
+		r.maxDelta = delta
+	}
+	le.WithFields(logrus.Fields{
+		"latency":  latency,
+		"recorded": recordedLatency,
+		"delta":    delta,
+	}).Info(">> MATCHED")
+}
+
+func (r *replayer) logSummary() {
+	le := log.WithFields(logrus.Fields{
+		"matched":    r.matched,
+		"unexpected": r.unexpected,
+		"missing":    len(r.recorded),
+	})
+	if r.compared > 0 {
+		le = le.WithFields(logrus.Fields{
+			"avg_delta": r.totalDelta / time.Duration(r.compared),
+			"max_delta": r.maxDelta,
+		})
+	}
+	le.Warn("replay summary")
+}
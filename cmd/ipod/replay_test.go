@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+// reportRecorder keeps each written report as a trace message
+type reportRecorder struct {
+	tw  *trace.Writer
+	dir trace.Dir
+	ts  time.Duration
+}
+
+func (r *reportRecorder) Write(p []byte) (int, error) {
+	return len(p), r.tw.WriteMsg(&trace.Msg{Dir: r.dir, TS: r.ts, Data: append([]byte(nil), p...)})
+}
+
+// testTrace encodes the commands as a trace alternating between
+// the accessory and the ipod, 100ms apart
+func testTrace(t *testing.T, payloads ...interface{}) *trace.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := trace.NewWriter(&buf)
+	if err := tw.WriteHeader(&trace.Header{ReportDefs: hid.DefaultReportDefs}); err != nil {
+		t.Fatal(err)
+	}
+	for i, payload := range payloads {
+		dir := trace.DirIn
+		if i%2 == 1 {
+			dir = trace.DirOut
+		}
+		writeTestCommand(t, tw, dir, time.Duration(i)*100*time.Millisecond, payload)
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return trace.NewReader(&buf)
+}
+
+// writeTestCommand encodes payload as a frame of the default report defs,
+// payload may be a *ipod.Command to send it with a transaction id
+func writeTestCommand(t *testing.T, tw *trace.Writer, dir trace.Dir, ts time.Duration, payload interface{}) {
+	t.Helper()
+	cmd, ok := payload.(*ipod.Command)
+	if !ok {
+		var err error
+		if cmd, err = ipod.BuildCommand(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serde := ipod.CommandSerde{TrxEnabled: cmd.Transaction != nil}
+	pkt, err := serde.MarshalCmd(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := ipod.NewPacketWriter()
+	pw.WritePacket(pkt)
+	rw := hid.NewReportWriter(&reportRecorder{tw: tw, dir: dir, ts: ts})
+	if err := hid.NewEncoder(rw, hid.DefaultReportDefs).WriteFrame(pw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayMatch(t *testing.T) {
+	devGeneral = &DevGeneral{}
+	defer func() { devGeneral = &DevGeneral{} }()
+
+	tr := testTrace(t,
+		&general.RequestiPodName{}, &general.ReturniPodName{Name: ipod.StringToBytes("ipod-gadget")},
+		// a recorded answer the handlers don't give
+		&general.RequestiPodSoftwareVersion{}, &general.ACK{},
+		&general.RequestiPodSerialNum{}, &general.ReturniPodSerialNum{Serial: ipod.StringToBytes("serial")},
+	)
+	ctx := context.Background()
+	rp, err := newReplayer(ctx, tr, hid.DefaultReportDefs, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processFrames(ctx, hid.NewTransport(hid.NewReportReader(rp), hid.NewReportWriter(rp), hid.DefaultReportDefs))
+	if rp.matched != 2 || rp.unexpected != 1 || len(rp.recorded) != 1 {
+		t.Errorf("got %d matched, %d unexpected, %d missing want 2, 1, 1", rp.matched, rp.unexpected, len(rp.recorded))
+	}
+	if len(rp.recorded) == 1 && rp.recorded[0].cmd.ID != ipod.NewLingoCmdID(0x00, 0x02) {
+		t.Errorf("missing %v want the recorded ACK", rp.recorded[0].cmd.ID)
+	}
+}
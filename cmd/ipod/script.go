@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	"github.com/oandrew/ipod/trace"
+)
+
+// defaultScenarioTimeout is how long expect steps wait by default
+const defaultScenarioTimeout = 2 * time.Second
+
+// scenario drives the accessory mode: the steps the accessory sends and
+// expects from the ipod, written in yaml or json i.e.
+//
+//	name: remote ui
+//	timeout: 2s
+//	steps:
+//	- send: general.IdentifyDeviceLingoes
+//	  fields: {Lingos: 0x1d, Options: 0x2, DeviceID: 0x0}
+//	- expect: general.ACK
+//	  fields: {Status: 0x0, CmdID: 0x13}
+//	- expect: general.GetDevAuthenticationInfo
+//	  timeout: 500ms
+//	  else:
+//	  - raw: 00 05
+//	- repeat: 3
+//	  steps:
+//	  - send: extremote.GetPlayStatus
+//	  - expect: extremote.*
+//	- sleep: 1s
+//
+// Fields take the values of the shell send command. An expect step waits
+// for a command matching the name pattern (see path.Match) and fields,
+// skipping others. It fails the scenario on timeout unless it has else
+// steps to run instead, then steps run when it matches.
+type scenario struct {
+	Name    string         `yaml:"name"`
+	Timeout time.Duration  `yaml:"timeout"`
+	Steps   []scenarioStep `yaml:"steps"`
+}
+
+type scenarioStep struct {
+	// Label describes the step in the report
+	Label   string                 `yaml:"label"`
+	Send    string                 `yaml:"send"`
+	Raw     string                 `yaml:"raw"`
+	Expect  string                 `yaml:"expect"`
+	Fields  map[string]interface{} `yaml:"fields"`
+	Timeout time.Duration          `yaml:"timeout"`
+	Sleep   time.Duration          `yaml:"sleep"`
+	Repeat  int                    `yaml:"repeat"`
+	Steps   []scenarioStep         `yaml:"steps"`
+	Then    []scenarioStep         `yaml:"then"`
+	Else    []scenarioStep         `yaml:"else"`
+
+	// payload is sent as is instead of looking up Send, used by
+	// built-in scenarios for commands that fields can't describe
+	payload interface{}
+	// verify checks the device state instead of talking to it
+	verify func() error
+}
+
+// assigns returns the fields as Field=value arguments sorted by field
+func (st *scenarioStep) assigns() []string {
+	var assigns []string
+	for k, v := range st.Fields {
+		assigns = append(assigns, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(assigns)
+	return assigns
+}
+
+func (st *scenarioStep) String() string {
+	if st.Label != "" {
+		return st.Label
+	}
+	switch {
+	case st.Send != "":
+		return strings.Join(append([]string{"send", st.Send}, st.assigns()...), " ")
+	case st.Raw != "":
+		return "raw " + st.Raw
+	case st.Expect != "":
+		return strings.Join(append([]string{"expect", st.Expect}, st.assigns()...), " ")
+	case st.Sleep != 0:
+		return "sleep " + st.Sleep.String()
+	case st.verify != nil:
+		return "verify"
+	default:
+		return fmt.Sprintf("repeat %d", st.Repeat)
+	}
+}
+
+func parseRawPacket(s string) ([]byte, error) {
+	return hex.DecodeString(strings.Replace(s, " ", "", -1))
+}
+
+// check validates the step before anything is sent
+func (st *scenarioStep) check() error {
+	actions := 0
+	for _, set := range []bool{st.Send != "", st.Raw != "", st.Expect != "", st.Sleep != 0, st.Repeat != 0, st.verify != nil} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("expected exactly one of send, raw, expect, sleep or repeat")
+	}
+	if st.Fields != nil && st.Send == "" && st.Expect == "" {
+		return fmt.Errorf("fields are only used by send and expect")
+	}
+	if (st.Then != nil || st.Else != nil) && st.Expect == "" {
+		return fmt.Errorf("then and else are only used by expect")
+	}
+	if st.Steps != nil && st.Repeat == 0 {
+		return fmt.Errorf("steps are only used by repeat")
+	}
+	switch {
+	case st.payload != nil:
+	case st.Send != "":
+		_, payload, ok := ipod.LookupName(st.Send)
+		if !ok {
+			return fmt.Errorf("unknown command %q", st.Send)
+		}
+		if err := setFields(payload, st.assigns()); err != nil {
+			return err
+		}
+	case st.Raw != "":
+		if _, err := parseRawPacket(st.Raw); err != nil {
+			return fmt.Errorf("raw: %v", err)
+		}
+	case st.Expect != "":
+		if _, err := path.Match(st.Expect, ""); err != nil {
+			return fmt.Errorf("expect %q: %v", st.Expect, err)
+		}
+		// fields of a single command can be checked already
+		if _, payload, ok := ipod.LookupName(st.Expect); ok {
+			if err := setFields(payload, st.assigns()); err != nil {
+				return err
+			}
+		}
+	case st.Repeat < 0:
+		return fmt.Errorf("repeat must be positive")
+	}
+	for _, steps := range [][]scenarioStep{st.Steps, st.Then, st.Else} {
+		if err := checkSteps(steps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkSteps(steps []scenarioStep) error {
+	for i := range steps {
+		if err := steps[i].check(); err != nil {
+			return fmt.Errorf("step %d (%s): %v", i+1, steps[i].String(), err)
+		}
+	}
+	return nil
+}
+
+func parseScenario(data []byte) (*scenario, error) {
+	var sc scenario
+	if err := yaml.UnmarshalStrict(data, &sc); err != nil {
+		return nil, err
+	}
+	if len(sc.Steps) == 0 {
+		return nil, fmt.Errorf("no steps")
+	}
+	if sc.Timeout == 0 {
+		sc.Timeout = defaultScenarioTimeout
+	}
+	if err := checkSteps(sc.Steps); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+func loadScenario(path string) (*scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := parseScenario(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if sc.Name == "" {
+		sc.Name = path
+	}
+	return sc, nil
+}
+
+// scenarioFromTrace sends the accessory packets of a trace one by one
+// and expects the commands the ipod answered with, by name only as
+// another ipod fills them in its own way. With timing the recorded
+// gaps before the accessory packets are kept.
+func scenarioFromTrace(name string, tr *trace.Reader, reportDefs hid.ReportDefs, timing bool) (*scenario, error) {
+	sc := &scenario{Name: name, Timeout: defaultScenarioTimeout}
+	sends := 0
+	var last time.Duration
+	err := decodeTrace(tr, reportDefs, func(frame *trace.Frame) {
+		if len(frame.Msgs) == 0 {
+			return
+		}
+		gap := frame.Msgs[0].TS - last
+		last = frame.Msgs[len(frame.Msgs)-1].TS
+		for _, p := range frame.Packets {
+			if p.Err != nil {
+				continue
+			}
+			if frame.Dir == trace.DirOut {
+				if p.Cmd == nil || p.CmdErr != nil {
+					continue
+				}
+				if _, ok := p.Cmd.Payload.(ipod.UnknownPayload); ok {
+					continue
+				}
+				sc.Steps = append(sc.Steps, scenarioStep{Expect: commandName(p.Cmd)})
+				continue
+			}
+			if timing && gap > 0 {
+				sc.Steps = append(sc.Steps, scenarioStep{Sleep: gap})
+				gap = 0
+			}
+			st := scenarioStep{Raw: fmt.Sprintf("% 02x", p.Data)}
+			if p.Cmd != nil {
+				st.Label = "raw " + commandName(p.Cmd)
+			}
+			sc.Steps = append(sc.Steps, st)
+			sends++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sends == 0 {
+		return nil, fmt.Errorf("no accessory packets in the trace")
+	}
+	return sc, nil
+}
+
+// scenarioRunner plays the accessory side of a scenario
+type scenarioRunner struct {
+	w         io.Writer
+	transport ipod.FrameReadWriter
+	timeout   time.Duration
+
+	mu    sync.Mutex
+	serde ipod.CommandSerde
+	trx   uint16
+	recv  chan *ipod.Command
+
+	passed, failed int
+}
+
+// errScenarioFailed stops the scenario at the first failed step
+var errScenarioFailed = fmt.Errorf("step failed")
+
+// runScenario runs the steps against the ipod on the transport and
+// writes a report to w. It returns an error if a step failed.
+func runScenario(ctx context.Context, transport ipod.FrameReadWriter, sc *scenario, w io.Writer) error {
+	r := &scenarioRunner{
+		w:         w,
+		transport: transport,
+		timeout:   sc.Timeout,
+		recv:      make(chan *ipod.Command, 256),
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go r.receive(ctx)
+
+	fmt.Fprintf(w, "=== %s\n", sc.Name)
+	start := time.Now()
+	err := r.runSteps(ctx, "", sc.Steps)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	result := "ok"
+	if err != nil {
+		result = "FAIL"
+	}
+	fmt.Fprintf(w, "--- %s %s: %d passed, %d failed (%v)\n", result, sc.Name, r.passed, r.failed, time.Since(start).Round(time.Millisecond))
+	if err == errScenarioFailed {
+		return fmt.Errorf("scenario %s failed", sc.Name)
+	}
+	return err
+}
+
+// receive decodes the commands from the ipod until ctx is canceled
+func (r *scenarioRunner) receive(ctx context.Context) {
+	defer close(r.recv)
+	for {
+		frame, err := ipod.ReadFrameContext(ctx, r.transport)
+		if err == io.EOF || ctx.Err() != nil {
+			return
+		}
+		logFrame(frame, err, "<< FRAME")
+		frameNum := cmdTracer.nextFrame()
+		if err != nil {
+			continue
+		}
+		pr := ipod.NewPacketReader(frame)
+		for {
+			pkt, err := pr.ReadPacket()
+			if err == io.EOF {
+				break
+			}
+			logPacket(pkt, err, "<< PACKET")
+			if err != nil {
+				continue
+			}
+			r.mu.Lock()
+			cmd, err := r.serde.UnmarshalCmd(pkt)
+			r.mu.Unlock()
+			logCmd(cmd, err, "<< CMD")
+			cmdTracer.record(trace.DirOut, frameNum, cmd, pkt, err)
+			annotator.command(trace.DirOut, cmd, err)
+			if err != nil {
+				continue
+			}
+			select {
+			case r.recv <- cmd:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (r *scenarioRunner) runSteps(ctx context.Context, prefix string, steps []scenarioStep) error {
+	for i := range steps {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := r.runStep(ctx, fmt.Sprintf("%s%d", prefix, i+1), &steps[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *scenarioRunner) report(ok bool, id string, st *scenarioStep, format string, args ...interface{}) {
+	result := "ok  "
+	if ok {
+		r.passed++
+	} else {
+		result = "FAIL"
+		r.failed++
+	}
+	detail := fmt.Sprintf(format, args...)
+	if detail != "" {
+		detail = ": " + detail
+	}
+	fmt.Fprintf(r.w, "%s %s %s%s\n", result, id, st.String(), detail)
+}
+
+func (r *scenarioRunner) runStep(ctx context.Context, id string, st *scenarioStep) error {
+	switch {
+	case st.Send != "":
+		payload := st.payload
+		if payload == nil {
+			_, payload, _ = ipod.LookupName(st.Send)
+			if err := setFields(payload, st.assigns()); err != nil {
+				r.report(false, id, st, "%v", err)
+				return errScenarioFailed
+			}
+		}
+		cmd, err := ipod.BuildCommand(payload)
+		if err == nil {
+			err = r.sendCommand(cmd)
+		}
+		if err != nil {
+			r.report(false, id, st, "%v", err)
+			return errScenarioFailed
+		}
+		r.report(true, id, st, "")
+	case st.Raw != "":
+		pkt, _ := parseRawPacket(st.Raw)
+		if err := r.sendPacket(pkt); err != nil {
+			r.report(false, id, st, "%v", err)
+			return errScenarioFailed
+		}
+		r.report(true, id, st, "")
+	case st.Expect != "":
+		timeout := st.Timeout
+		if timeout == 0 {
+			timeout = r.timeout
+		}
+		start := time.Now()
+		cmd, skipped, err := r.expect(ctx, st, timeout)
+		if err != nil {
+			if st.Else != nil {
+				fmt.Fprintf(r.w, "     %s %s: %v, running else\n", id, st.String(), err)
+				return r.runSteps(ctx, id+".else.", st.Else)
+			}
+			if len(skipped) > 0 {
+				err = fmt.Errorf("%v, received %s", err, strings.Join(skipped, ", "))
+			}
+			r.report(false, id, st, "%v", err)
+			return errScenarioFailed
+		}
+		r.report(true, id, st, "%s after %v", commandSummary(cmd), time.Since(start).Round(time.Millisecond))
+		return r.runSteps(ctx, id+".", st.Then)
+	case st.Sleep != 0:
+		select {
+		case <-time.After(st.Sleep):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		r.report(true, id, st, "")
+	case st.verify != nil:
+		if err := st.verify(); err != nil {
+			r.report(false, id, st, "%v", err)
+			return errScenarioFailed
+		}
+		r.report(true, id, st, "")
+	default:
+		for i := 1; i <= st.Repeat; i++ {
+			if err := r.runSteps(ctx, fmt.Sprintf("%s#%d.", id, i), st.Steps); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expect waits for a command matching the step, the names of the
+// commands skipped meanwhile are returned too
+func (r *scenarioRunner) expect(ctx context.Context, st *scenarioStep, timeout time.Duration) (*ipod.Command, []string, error) {
+	var skipped []string
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case cmd, ok := <-r.recv:
+			if !ok {
+				return nil, skipped, fmt.Errorf("device closed")
+			}
+			if matchCommand(cmd, st.Expect, st.assigns()) {
+				return cmd, skipped, nil
+			}
+			skipped = append(skipped, commandName(cmd))
+		case <-deadline.C:
+			return nil, skipped, fmt.Errorf("timeout after %v", timeout)
+		case <-ctx.Done():
+			return nil, skipped, ctx.Err()
+		}
+	}
+}
+
+// matchCommand checks the name of the command against a path.Match
+// pattern and its fields against Field=value arguments
+func matchCommand(cmd *ipod.Command, pattern string, assigns []string) bool {
+	name := commandName(cmd)
+	if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); !ok {
+		return false
+	}
+	for _, a := range assigns {
+		kv := strings.SplitN(a, "=", 2)
+		v, err := fieldByPath(cmd.Payload, kv[0])
+		if err != nil {
+			return false
+		}
+		want := reflect.New(v.Type()).Elem()
+		if err := setValue(want, kv[1]); err != nil {
+			return false
+		}
+		if !reflect.DeepEqual(v.Interface(), want.Interface()) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *scenarioRunner) sendCommand(cmd *ipod.Command) error {
+	r.mu.Lock()
+	r.trx++
+	cmd.Transaction = ipod.NewTransaction(r.trx)
+	pkt, err := r.serde.MarshalCmd(cmd)
+	r.mu.Unlock()
+	logCmd(cmd, err, ">> CMD")
+	if err != nil {
+		return err
+	}
+	return r.writePacket(cmd, pkt)
+}
+
+func (r *scenarioRunner) sendPacket(pkt []byte) error {
+	r.mu.Lock()
+	cmd, err := r.serde.UnmarshalCmd(pkt)
+	r.mu.Unlock()
+	logCmd(cmd, err, ">> CMD")
+	return r.writePacket(cmd, pkt)
+}
+
+func (r *scenarioRunner) writePacket(cmd *ipod.Command, pkt []byte) error {
+	logPacket(pkt, nil, ">> PACKET")
+	cmdTracer.record(trace.DirIn, cmdTracer.nextFrame(), cmd, pkt, nil)
+	pw := ipod.NewPacketWriter()
+	pw.WritePacket(pkt)
+	frame := pw.Bytes()
+	err := r.transport.WriteFrame(frame)
+	logFrame(frame, err, ">> FRAME")
+	annotator.command(trace.DirIn, cmd, nil)
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	general "github.com/oandrew/ipod/lingo-general"
+)
+
+func TestParseScenario(t *testing.T) {
+	sc, err := parseScenario([]byte(`
+steps:
+- send: general.RequestiPodName
+- expect: general.ReturniPodName
+  timeout: 100ms
+  else:
+  - raw: 00 07
+- repeat: 2
+  steps:
+  - sleep: 1ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Timeout != defaultScenarioTimeout || len(sc.Steps) != 3 || sc.Steps[1].Timeout != 100*time.Millisecond {
+		t.Errorf("got scenario %+v", sc)
+	}
+
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{`steps: []`, "no steps"},
+		{`steps: [{send: general.Nope}]`, "unknown command"},
+		{`steps: [{send: general.RequestiPodName, expect: general.ACK}]`, "exactly one"},
+		{`steps: [{raw: zz}]`, "raw"},
+		{`steps: [{expect: "general.[", timeout: 1s}]`, "syntax error"},
+		{`steps: [{send: general.ACK, fields: {Nope: 1}}]`, "Nope"},
+		{`steps: [{sleep: 1s, then: [{sleep: 1s}]}]`, "then and else"},
+		{`steps: [{repeat: 2, steps: [{raw: "00"}, {}]}]`, "step 2"},
+		{`steps: [{send: general.ACK}]
+unknown: 1`, "unknown"},
+	}
+	for _, tt := range tests {
+		_, err := parseScenario([]byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %v want %q", tt.data, err, tt.err)
+		}
+	}
+}
+
+func TestMatchCommand(t *testing.T) {
+	cmd, err := ipod.BuildCommand(&general.ACK{Status: general.ACKStatusSuccess, CmdID: 0x13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pattern string
+		assigns []string
+		want    bool
+	}{
+		{"general.ACK", nil, true},
+		{"general.ack", nil, true},
+		{"general.*", []string{"CmdID=0x13"}, true},
+		{"general.ACK", []string{"CmdID=0x13", "Status=0"}, true},
+		{"general.ACK", []string{"CmdID=0x14"}, false},
+		{"general.ACK", []string{"Nope=1"}, false},
+		{"extremote.*", nil, false},
+	}
+	for _, tt := range tests {
+		if got := matchCommand(cmd, tt.pattern, tt.assigns); got != tt.want {
+			t.Errorf("%s %v: got %v want %v", tt.pattern, tt.assigns, got, tt.want)
+		}
+	}
+}
+
+func TestRunScenario(t *testing.T) {
+	devGeneral = &DevGeneral{}
+	defer func() { devGeneral = &DevGeneral{} }()
+
+	run := func(data string) (string, error) {
+		t.Helper()
+		sc, err := parseScenario([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc.Name = "test"
+		ctx, cancel := context.WithCancel(context.Background())
+		acc, dev := ipod.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			newSession(dev).run(ctx)
+		}()
+		var buf bytes.Buffer
+		err = runScenario(ctx, acc, sc, &buf)
+		cancel()
+		acc.Close()
+		<-done
+		return buf.String(), err
+	}
+
+	out, err := run(`
+steps:
+- send: general.RequestiPodName
+- expect: general.ReturniPodName
+  fields: {Name: '"ipod-gadget"'}
+- send: general.RequestiPodName
+- expect: general.ACK
+  timeout: 50ms
+  else:
+  - send: general.RequestiPodName
+  - expect: general.ReturniPodName
+- repeat: 2
+  steps:
+  - raw: 00 07
+  - expect: general.*
+`)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	for _, want := range []string{"ok   2 expect general.ReturniPodName", "running else", "ok   4.else.2", "ok   5#2.2", "--- ok test: 9 passed, 0 failed"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in report:\n%s", want, out)
+		}
+	}
+
+	out, err = run(`
+steps:
+- send: general.RequestiPodName
+- expect: general.ACK
+  timeout: 50ms
+- send: general.RequestiPodName
+`)
+	if err == nil {
+		t.Fatalf("expected an error\n%s", out)
+	}
+	for _, want := range []string{"FAIL 2 expect general.ACK: timeout after 50ms, received general.ReturniPodName", "--- FAIL test: 1 passed, 1 failed"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in report:\n%s", want, out)
+		}
+	}
+}
+
+func TestScenarioFromTrace(t *testing.T) {
+	payloads := []interface{}{
+		&general.RequestiPodName{}, &general.ReturniPodName{Name: ipod.StringToBytes("ipod-gadget")},
+		&general.RequestiPodSoftwareVersion{}, &general.ReturniPodSoftwareVersion{Major: 1},
+	}
+	steps := func(timing bool) string {
+		sc, err := scenarioFromTrace("test", testTrace(t, payloads...), hid.DefaultReportDefs, timing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i := range sc.Steps {
+			got = append(got, sc.Steps[i].String())
+		}
+		return strings.Join(got, "\n")
+	}
+	want := strings.Join([]string{
+		"raw general.RequestiPodName",
+		"expect general.ReturniPodName",
+		"raw general.RequestiPodSoftwareVersion",
+		"expect general.ReturniPodSoftwareVersion",
+	}, "\n")
+	if got := steps(false); got != want {
+		t.Errorf("got steps\n%s\nwant\n%s", got, want)
+	}
+	// the sleep keeps the 100ms between the answer and the next request
+	want = strings.Replace(want, "raw general.RequestiPodSoftwareVersion", "sleep 100ms\nraw general.RequestiPodSoftwareVersion", 1)
+	if got := steps(true); got != want {
+		t.Errorf("got steps\n%s\nwant\n%s", got, want)
+	}
+}
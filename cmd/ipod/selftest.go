@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fullsailor/pkcs7"
+
+	"github.com/oandrew/ipod"
+	audio "github.com/oandrew/ipod/lingo-audio"
+	extremote "github.com/oandrew/ipod/lingo-extremote"
+	general "github.com/oandrew/ipod/lingo-general"
+)
+
+// selftestCertCN is the common name of the certificate the simulated
+// head unit authenticates with
+const selftestCertCN = "ipod selftest accessory"
+
+// selftestCertSection is the size of the certificate sections, small
+// enough for the certificate to take several
+const selftestCertSection = 128
+
+// selftestCert returns a self-signed certificate wrapped in pkcs7 like
+// the ones of real accessories
+func selftestCert() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: selftestCertCN},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return pkcs7.DegenerateCertificate(der)
+}
+
+// sendPayloadStep sends a payload built in go
+func sendPayloadStep(label string, payload interface{}) scenarioStep {
+	name := strings.TrimPrefix(fmt.Sprintf("%T", payload), "*")
+	return scenarioStep{Label: label, Send: name, payload: payload}
+}
+
+func expectStep(label, name string, fields map[string]interface{}) scenarioStep {
+	return scenarioStep{Label: label, Expect: name, Fields: fields}
+}
+
+func verifyStep(label string, fn func() error) scenarioStep {
+	return scenarioStep{Label: label, verify: fn}
+}
+
+func ackFields(cmdID uint16) map[string]interface{} {
+	return map[string]interface{}{"Status": 0, "CmdID": cmdID}
+}
+
+const selftestLingos = general.LingoGeneralBit | general.LingoExtRemoteBit | general.LingoDigitalAudioBit
+
+// legacyIdentifySteps identifies with IdentifyDeviceLingoes which
+// starts the authentication
+func legacyIdentifySteps() []scenarioStep {
+	return []scenarioStep{
+		sendPayloadStep("identify: IdentifyDeviceLingoes general, extremote, audio", &general.IdentifyDeviceLingoes{
+			Lingos:   general.LingoMask(selftestLingos),
+			Options:  0x2,
+			DeviceID: 0x200,
+		}),
+		expectStep("identify: lingoes acked", "general.ACK", ackFields(0x13)),
+		expectStep("identify: authentication requested", "general.GetDevAuthenticationInfo", nil),
+	}
+}
+
+// idpsIdentifySteps identifies with IDPS tokens which starts the
+// authentication
+func idpsIdentifySteps() []scenarioStep {
+	tokens := &general.SetFIDTokenValues{FIDTokenValues: []general.FIDTokenValue{
+		{ID: general.TokenID{FIDType: 0x00, FIDSubtype: 0x00}, Token: &general.FIDIdentifyToken{
+			AccLingoes:    []uint8{ipod.LingoGeneralID, ipod.LingoExtRemoteID, ipod.LingoDigitalAudioID},
+			DeviceOptions: 0x2,
+			DeviceID:      0x200,
+		}},
+		{ID: general.TokenID{FIDType: 0x00, FIDSubtype: 0x01}, Token: &general.FIDAccCapsToken{
+			AccCapsBitmask: uint64(general.AccCapUSBAudio),
+		}},
+		{ID: general.TokenID{FIDType: 0x00, FIDSubtype: 0x02}, Token: &general.FIDAccInfoToken{
+			AccInfoType: byte(general.AccInfoName),
+			Value:       ipod.StringToBytes("ipod selftest"),
+		}},
+	}}
+	return []scenarioStep{
+		sendPayloadStep("identify: StartIDPS", &general.StartIDPS{}),
+		expectStep("identify: idps started", "general.ACK", ackFields(0x38)),
+		sendPayloadStep("identify: SetFIDTokenValues identify, caps, name", tokens),
+		expectStep("identify: tokens acked", "general.RetFIDTokenValueACKs", nil),
+		verifyStep("identify: tokens stored", func() error {
+			if n := len(devGeneral.tokens); n != len(tokens.FIDTokenValues) {
+				return fmt.Errorf("got %d tokens want %d", n, len(tokens.FIDTokenValues))
+			}
+			return nil
+		}),
+		sendPayloadStep("identify: EndIDPS", &general.EndIDPS{AccEndIDPSStatus: general.AccEndIDPSStatusContinue}),
+		expectStep("identify: idps accepted", "general.IDPSStatus", map[string]interface{}{"Status": 0}),
+		expectStep("identify: authentication requested", "general.GetDevAuthenticationInfo", nil),
+	}
+}
+
+// authSteps sends the certificate in sections and signs the challenge
+// (auth v2). The ipod asks for the sample rates once the certificate is
+// complete, before acking it.
+func authSteps(cert []byte) []scenarioStep {
+	var steps []scenarioStep
+	sections := (len(cert) + selftestCertSection - 1) / selftestCertSection
+	for i := 0; i < sections; i++ {
+		end := (i + 1) * selftestCertSection
+		if end > len(cert) {
+			end = len(cert)
+		}
+		steps = append(steps, sendPayloadStep(fmt.Sprintf("auth: certificate section %d/%d", i+1, sections), &general.RetDevAuthenticationInfo{
+			Major:              2,
+			Minor:              0,
+			CertCurrentSection: byte(i),
+			CertMaxSection:     byte(sections - 1),
+			CertData:           cert[i*selftestCertSection : end],
+		}))
+		if i < sections-1 {
+			steps = append(steps, expectStep(fmt.Sprintf("auth: section %d acked", i+1), "general.ACK", ackFields(0x15)))
+		}
+	}
+	return append(steps,
+		expectStep("audio: sample rates requested", "audio.GetAccSampleRateCaps", nil),
+		expectStep("auth: certificate accepted", "general.AckDevAuthenticationInfo", map[string]interface{}{"Status": 0}),
+		verifyStep("auth: certificate parsed", func() error {
+			if devGeneral.accCert == nil {
+				return fmt.Errorf("no certificate")
+			}
+			if cn := devGeneral.accCert.Subject.CommonName; cn != selftestCertCN {
+				return fmt.Errorf("got CN=%s want CN=%s", cn, selftestCertCN)
+			}
+			return nil
+		}),
+		expectStep("auth: signature requested", "general.GetDevAuthenticationSignatureV2", nil),
+		sendPayloadStep("auth: RetDevAuthenticationSignature", &general.RetDevAuthenticationSignature{
+			Signature: make([]byte, 64),
+		}),
+		expectStep("auth: passed", "general.AckDevAuthenticationStatus", map[string]interface{}{"Status": 0}),
+	)
+}
+
+// audioSteps negotiates the sample rate of the digital audio
+func audioSteps() []scenarioStep {
+	return []scenarioStep{
+		sendPayloadStep("audio: RetAccSampleRateCaps 32000, 44100, 48000", &audio.RetAccSampleRateCaps{
+			SampleRates: []uint32{32000, 44100, 48000},
+		}),
+		expectStep("audio: sample rate selected", "audio.TrackNewAudioAttributes", map[string]interface{}{"SampleRate": 44100}),
+		sendPayloadStep("audio: AccAck", &audio.AccAck{CmdID: 0x04}),
+	}
+}
+
+func remoteUISteps() []scenarioStep {
+	return []scenarioStep{
+		sendPayloadStep("remote ui: EnterRemoteUIMode", &general.EnterRemoteUIMode{}),
+		expectStep("remote ui: pending", "general.ACKPending", map[string]interface{}{"CmdID": 0x05}),
+		expectStep("remote ui: entered", "general.ACK", ackFields(0x05)),
+		sendPayloadStep("remote ui: RequestRemoteUIMode", &general.RequestRemoteUIMode{}),
+		expectStep("remote ui: extended mode reported", "general.ReturnRemoteUIMode", map[string]interface{}{"Mode": 1}),
+	}
+}
+
+// extRemoteSteps browses the database, starts playback and reads the
+// now playing track
+func extRemoteSteps() []scenarioStep {
+	track := defaultTrack
+	return []scenarioStep{
+		sendPayloadStep("browse: ResetDBSelection", &extremote.ResetDBSelection{}),
+		expectStep("browse: selection reset", "extremote.ACK", ackFields(0x16)),
+		sendPayloadStep("browse: GetNumberCategorizedDBRecords playlist", &extremote.GetNumberCategorizedDBRecords{
+			CategoryType: extremote.DbCategoryPlaylist,
+		}),
+		expectStep("browse: playlists counted", "extremote.ReturnNumberCategorizedDBRecords", map[string]interface{}{"RecordCount": 1}),
+		sendPayloadStep("browse: RetrieveCategorizedDatabaseRecords playlist 0..1", &extremote.RetrieveCategorizedDatabaseRecords{
+			CategoryType: extremote.DbCategoryPlaylist,
+			Offset:       0,
+			Count:        1,
+		}),
+		expectStep("browse: playlist returned", "extremote.ReturnCategorizedDatabaseRecord", nil),
+		sendPayloadStep("browse: SelectDBRecord playlist 0", &extremote.SelectDBRecord{
+			CategoryType: extremote.DbCategoryPlaylist,
+			RecordIndex:  0,
+		}),
+		expectStep("browse: playlist selected", "extremote.ACK", ackFields(0x17)),
+		sendPayloadStep("playback: PlayCurrentSelection 0", &extremote.PlayCurrentSelection{SelectedTrackIndex: 0}),
+		expectStep("playback: selection playing", "extremote.ACK", ackFields(0x28)),
+		sendPayloadStep("playback: PlayControl play", &extremote.PlayControl{Cmd: extremote.PlayControlPlay}),
+		expectStep("playback: play acked", "extremote.ACK", ackFields(0x29)),
+		sendPayloadStep("playback: SetPlayStatusChangeNotification", &extremote.SetPlayStatusChangeNotification{EventMask: 0x1}),
+		expectStep("playback: notifications enabled", "extremote.ACK", ackFields(0x26)),
+		sendPayloadStep("playback: GetPlayStatus", &extremote.GetPlayStatus{}),
+		expectStep("playback: status returned", "extremote.ReturnPlayStatus", map[string]interface{}{
+			"TrackLength":   track.LengthMS,
+			"TrackPosition": track.PositionMS,
+			"State":         uint8(playerStates[track.State]),
+		}),
+		sendPayloadStep("playback: GetIndexedPlayingTrackTitle 0", &extremote.GetIndexedPlayingTrackTitle{TrackIndex: 0}),
+		expectStep("playback: title returned", "extremote.ReturnIndexedPlayingTrackTitle", map[string]interface{}{
+			"Title": strconv.Quote(track.Title),
+		}),
+	}
+}
+
+// selftestScenarios returns the flows of the simulated head unit by name:
+// identification with IdentifyDeviceLingoes or IDPS, then the same
+// authentication, digital audio, remote ui and extremote steps
+func selftestScenarios() (map[string]*scenario, error) {
+	cert, err := selftestCert()
+	if err != nil {
+		return nil, err
+	}
+	flows := map[string][]scenarioStep{
+		"legacy": legacyIdentifySteps(),
+		"idps":   idpsIdentifySteps(),
+	}
+	scenarios := make(map[string]*scenario)
+	for name, steps := range flows {
+		steps = append(steps, authSteps(cert)...)
+		steps = append(steps, audioSteps()...)
+		steps = append(steps, remoteUISteps()...)
+		steps = append(steps, extRemoteSteps()...)
+		if err := checkSteps(steps); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		scenarios[name] = &scenario{Name: name, Timeout: defaultScenarioTimeout, Steps: steps}
+	}
+	return scenarios, nil
+}
+
+// selftestFlows is the order the flows run in
+var selftestFlows = []string{"legacy", "idps"}
+
+// runSelftest runs each scenario against a new session of the serve
+// handlers over an in-memory transport, reset prepares the device
+// before each. It returns an error if a flow failed.
+func runSelftest(ctx context.Context, scenarios []*scenario, reset func(), w io.Writer) error {
+	var failed []string
+	for _, sc := range scenarios {
+		reset()
+		sctx, cancel := context.WithCancel(ctx)
+		acc, dev := ipod.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			newSession(dev).run(sctx)
+		}()
+		err := runScenario(sctx, acc, sc, w)
+		cancel()
+		acc.Close()
+		<-done
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			failed = append(failed, sc.Name)
+		}
+	}
+	fmt.Fprintf(w, "selftest: %d of %d flows passed\n", len(scenarios)-len(failed), len(scenarios))
+	if len(failed) > 0 {
+		return fmt.Errorf("selftest failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
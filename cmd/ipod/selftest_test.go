@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelftest(t *testing.T) {
+	byName, err := selftestScenarios()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scenarios []*scenario
+	for _, name := range selftestFlows {
+		scenarios = append(scenarios, byName[name])
+	}
+	defer func() {
+		devGeneral = &DevGeneral{}
+		devExtRemote = newDevExtRemote()
+	}()
+
+	var buf bytes.Buffer
+	reset := func() {
+		devGeneral = &DevGeneral{}
+		devExtRemote = newDevExtRemote()
+	}
+	if err := runSelftest(context.Background(), scenarios, reset, &buf); err != nil {
+		t.Fatalf("%v\n%s", err, buf.String())
+	}
+	for _, want := range []string{"--- ok legacy", "--- ok idps", "auth: certificate parsed", "selftest: 2 of 2 flows passed"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in report:\n%s", want, buf.String())
+		}
+	}
+
+	// a device that reports another track fails both flows
+	for _, sc := range scenarios {
+		sc.Timeout = 100 * time.Millisecond
+	}
+	buf.Reset()
+	reset = func() {
+		devGeneral = &DevGeneral{}
+		devExtRemote = newDevExtRemote()
+		track := defaultTrack
+		track.Title = "other"
+		devExtRemote.SetTrack(track)
+	}
+	err = runSelftest(context.Background(), scenarios, reset, &buf)
+	if err == nil || err.Error() != "selftest failed: legacy, idps" {
+		t.Fatalf("got error %v\n%s", err, buf.String())
+	}
+	// the step number depends on the length of the flow
+	failed := regexp.MustCompile(`(?m)FAIL\s+\d+\s+playback: title returned`)
+	if !failed.MatchString(buf.String()) {
+		t.Errorf("missing the failed step in report:\n%s", buf.String())
+	}
+}
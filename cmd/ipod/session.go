@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/oandrew/ipod"
+	extremote "github.com/oandrew/ipod/lingo-extremote"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+// session responds to the requests read from the transport.
+// Commands initiated by the device i.e. notifications can be sent
+// while it runs.
+type session struct {
+	mu        sync.Mutex
+	transport ipod.FrameReadWriter
+	serde     ipod.CommandSerde
+
+	// playStatusMask is the last extremote play status notification mask
+	// set by the accessory
+	playStatusMask uint32
+
+	start  time.Time
+	events *eventHub
+	last   sessionState
+}
+
+func newSession(transport ipod.FrameReadWriter) *session {
+	return &session{
+		transport: transport,
+		start:     time.Now(),
+		events:    newEventHub(),
+	}
+}
+
+// processFrames responds to the requests until EOF or ctx is canceled
+func processFrames(ctx context.Context, frameTransport ipod.FrameReadWriter) {
+	newSession(frameTransport).run(ctx)
+}
+
+func (s *session) run(ctx context.Context) {
+	for {
+		inFrame, err := ipod.ReadFrameContext(ctx, s.transport)
+		if err == io.EOF {
+			break
+		}
+		if ctx.Err() != nil {
+			log.WithError(ctx.Err()).Warnf("stopped")
+			return
+		}
+		s.mu.Lock()
+		s.handleFrame(inFrame, err)
+		s.mu.Unlock()
+	}
+	log.Warnf("EOF")
+}
+
+// handleFrame decodes the requests of the frame and writes the responses,
+// s.mu must be held
+func (s *session) handleFrame(inFrame []byte, err error) {
+	logFrame(inFrame, err, "<< FRAME")
+	frameNum := cmdTracer.nextFrame()
+	if err != nil {
+		return
+	}
+
+	packetReader := ipod.NewPacketReader(inFrame)
+	inCmdBuf := ipod.CmdBuffer{}
+	for {
+		inPacket, err := packetReader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		logPacket(inPacket, err, "<< PACKET")
+		if err != nil {
+			cmdTracer.record(trace.DirIn, frameNum, nil, inPacket, err)
+			continue
+		}
+
+		inCmd, err := s.serde.UnmarshalCmd(inPacket)
+		logCmd(inCmd, err, "<< CMD")
+		cmdTracer.record(trace.DirIn, frameNum, inCmd, inPacket, err)
+		annotator.command(trace.DirIn, inCmd, err)
+		s.observe(inCmd)
+		s.events.command(s.record(trace.DirIn, frameNum, inCmd, inPacket, err))
+		inCmdBuf.WriteCommand(inCmd)
+	}
+
+	outCmdBuf := ipod.CmdBuffer{}
+	for i := range inCmdBuf.Commands {
+		//todo: check return error
+		handlePacket(&outCmdBuf, inCmdBuf.Commands[i])
+	}
+
+	for i := range outCmdBuf.Commands {
+		s.writeCommand(outCmdBuf.Commands[i])
+	}
+
+	if st := s.stateLocked(); !reflect.DeepEqual(st, s.last) {
+		s.last = st
+		s.events.state(st)
+	}
+}
+
+// record describes a command for the event stream
+func (s *session) record(dir trace.Dir, frame uint, cmd *ipod.Command, packet []byte, err error) *trace.CommandRecord {
+	rec := trace.NewCommandRecord(dir, frame, cmd, packet, err)
+	rec.TS = time.Since(s.start)
+	return rec
+}
+
+// observe keeps the state the handlers don't track
+func (s *session) observe(cmd *ipod.Command) {
+	switch msg := cmd.Payload.(type) {
+	case *extremote.SetPlayStatusChangeNotification:
+		s.playStatusMask = msg.EventMask
+	case *extremote.SetPlayStatusChangeNotificationShort:
+		s.playStatusMask = 0
+		if msg.Enabled {
+			s.playStatusMask = ^uint32(0)
+		}
+	}
+}
+
+// writeCommand writes the command as a frame of its own and returns
+// the packet, s.mu must be held
+func (s *session) writeCommand(outCmd *ipod.Command) ([]byte, error) {
+	logCmd(outCmd, nil, ">> CMD")
+
+	outPacket, err := s.serde.MarshalCmd(outCmd)
+	frameErr := s.writePacket(outCmd, outPacket, err)
+	if err != nil {
+		return nil, err
+	}
+	return outPacket, frameErr
+}
+
+// writePacket writes the packet as a frame of its own and returns
+// the frame error. outCmd and err describe the packet for the traces.
+func (s *session) writePacket(outCmd *ipod.Command, outPacket []byte, err error) error {
+	logPacket(outPacket, err, ">> PACKET")
+	cmdTracer.record(trace.DirOut, cmdTracer.nextFrame(), outCmd, outPacket, err)
+
+	packetWriter := ipod.NewPacketWriter()
+	packetWriter.WritePacket(outPacket)
+	outFrame := packetWriter.Bytes()
+	outFrameErr := s.transport.WriteFrame(outFrame)
+	logFrame(outFrame, outFrameErr, ">> FRAME")
+	annotator.command(trace.DirOut, outCmd, err)
+	return outFrameErr
+}
+
+// send writes a command initiated by the device with the next transaction id
+func (s *session) send(payload interface{}) (*ipod.Command, []byte, error) {
+	cmd, err := ipod.BuildCommand(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.Transaction = ipod.TrxNext()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	packet, err := s.writeCommand(cmd)
+	return cmd, packet, err
+}
+
+// sendPacket writes a raw packet i.e. one the handlers can't build.
+// The packet is decoded for the logs and traces only.
+func (s *session) sendPacket(packet []byte) (*ipod.Command, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	serde := s.serde
+	cmd, err := serde.UnmarshalCmd(packet)
+	logCmd(cmd, err, ">> CMD")
+	return cmd, s.writePacket(cmd, packet, err)
+}
+
+// sessionState is what the accessory set up during the session
+type sessionState struct {
+	UIMode         general.UIMode
+	Transactions   bool
+	EventMask      uint64
+	PlayStatusMask uint32
+	Tokens         []general.FIDTokenValue
+}
+
+func (s *session) state() sessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stateLocked()
+}
+
+func (s *session) stateLocked() sessionState {
+	return sessionState{
+		UIMode:         devGeneral.UIMode(),
+		Transactions:   s.serde.TrxEnabled,
+		EventMask:      devGeneral.EventNotificationMask(),
+		PlayStatusMask: s.playStatusMask,
+		Tokens:         append([]general.FIDTokenValue(nil), devGeneral.tokens...),
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oandrew/ipod"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+const shellHelp = `commands:
+  send <lingo.Command> [Field=value...]  send a command to the accessory i.e.
+                                         send extremote.PlayStatusChangeNotification Status=1
+  list [filter]                          list the commands that can be sent
+  state                                  print the ui mode, notification masks and accessory tokens
+  debug [<lingo> on|off]                 dump the commands of a lingo at any log level
+  mark [text]                            insert a marker comment into the trace
+  help                                   print this help
+  quit                                   stop serving
+values are numbers (0x.. for hex), true/false, "quoted text" (null terminated
+for byte fields) or hex bytes; nested fields are set with Field.Sub=value`
+
+// lingoDebug selects the lingoes whose commands are dumped whatever the log level
+type lingoDebug struct {
+	mu     sync.Mutex
+	lingos map[uint8]bool
+}
+
+var debugLingos = &lingoDebug{}
+
+func (d *lingoDebug) set(lingo uint8, on bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lingos == nil {
+		d.lingos = make(map[uint8]bool)
+	}
+	if on {
+		d.lingos[lingo] = true
+	} else {
+		delete(d.lingos, lingo)
+	}
+}
+
+func (d *lingoDebug) enabled(cmd *ipod.Command) bool {
+	if cmd == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lingos[cmd.ID.LingoID()]
+}
+
+func (d *lingoDebug) list() []uint8 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ids []uint8
+	for id := range d.lingos {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// lingoLabel returns the config name of a lingo or its id
+func lingoLabel(id uint8) string {
+	for name, lingoID := range lingoIDs {
+		if lingoID == id {
+			return name
+		}
+	}
+	return fmt.Sprintf("%#02x", id)
+}
+
+var uiModeNames = map[general.UIMode]string{
+	general.UIModeStandart: "standard",
+	general.UIModeExtended: "extended",
+	general.UIModeiPodOut:  "ipodout",
+}
+
+// runShell reads shell commands from r until EOF, quit or ctx is canceled
+func runShell(ctx context.Context, r io.Reader, w io.Writer, s *session) {
+	// stops the scanner when the shell returns before the input ends
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	fmt.Fprintln(w, `type "help" for the list of commands`)
+	for {
+		fmt.Fprint(w, "ipod> ")
+		var line string
+		select {
+		case <-ctx.Done():
+			return
+		case l, ok := <-lines:
+			if !ok {
+				fmt.Fprintln(w)
+				return
+			}
+			line = l
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" || args[0] == "exit" {
+			return
+		}
+		if err := shellCommand(w, s, args); err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+		}
+	}
+}
+
+func shellCommand(w io.Writer, s *session, args []string) error {
+	switch args[0] {
+	case "help", "?":
+		fmt.Fprintln(w, shellHelp)
+	case "send":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: send <lingo.Command> [Field=value...]")
+		}
+		_, payload, ok := ipod.LookupName(args[1])
+		if !ok {
+			return fmt.Errorf("unknown command %q, see list", args[1])
+		}
+		if err := setFields(payload, args[2:]); err != nil {
+			return err
+		}
+		cmd, _, err := s.send(payload)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, dirPrefix(trace.DirOut, commandSummary(cmd)))
+	case "list":
+		filter := ""
+		if len(args) > 1 {
+			filter = strings.ToLower(args[1])
+		}
+		for _, line := range strings.Split(strings.TrimSpace(ipod.DumpLingos()), "\n") {
+			if strings.Contains(strings.ToLower(line), filter) {
+				fmt.Fprintln(w, line)
+			}
+		}
+	case "state":
+		printState(w, s.state())
+	case "debug":
+		switch len(args) {
+		case 1:
+			var names []string
+			for _, id := range debugLingos.list() {
+				names = append(names, lingoLabel(id))
+			}
+			fmt.Fprintf(w, "debug: %s\n", strings.Join(names, " "))
+		case 3:
+			lingo, err := parseLingo(args[1])
+			if err != nil {
+				return err
+			}
+			on, err := parseOnOff(args[2])
+			if err != nil {
+				return err
+			}
+			debugLingos.set(lingo, on)
+		default:
+			return fmt.Errorf("usage: debug [<lingo> on|off]")
+		}
+	case "mark":
+		if annotator == nil {
+			return fmt.Errorf("no trace is written, start with -w")
+		}
+		annotator.marker(strings.Join(args[1:], " "))
+	default:
+		return fmt.Errorf("unknown command %q, see help", args[0])
+	}
+	return nil
+}
+
+func parseOnOff(s string) (bool, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, got %q", s)
+}
+
+func printState(w io.Writer, st sessionState) {
+	mode, ok := uiModeNames[st.UIMode]
+	if !ok {
+		mode = "unknown"
+	}
+	fmt.Fprintf(w, "ui mode:          %s (%#02x)\n", mode, uint8(st.UIMode))
+	fmt.Fprintf(w, "transactions:     %v\n", st.Transactions)
+	fmt.Fprintf(w, "event mask:       %#016x\n", st.EventMask)
+	fmt.Fprintf(w, "play status mask: %#08x\n", st.PlayStatusMask)
+	fmt.Fprintf(w, "tokens:           %d\n", len(st.Tokens))
+	for _, token := range st.Tokens {
+		fmt.Fprintf(w, "  %s\n", commandSummary(&ipod.Command{Payload: token.Token}))
+	}
+}
+
+// splitArgs splits a line at spaces keeping "quoted text" in one argument
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && (c == ' ' || c == '\t'):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+			continue
+		}
+		cur.WriteRune(c)
+		inArg = true
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// setFields assigns Field=value arguments to the payload
+func setFields(payload interface{}, assigns []string) error {
+	for _, a := range assigns {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("bad field %q: expected Field=value", a)
+		}
+		v, err := fieldByPath(payload, kv[0])
+		if err != nil {
+			return err
+		}
+		if err := setValue(v, kv[1]); err != nil {
+			return fmt.Errorf("%s: %v", kv[0], err)
+		}
+	}
+	return nil
+}
+
+// fieldByPath returns the field of the payload at a path like Field.Sub,
+// names are not case sensitive
+func fieldByPath(payload interface{}, path string) (reflect.Value, error) {
+	v := reflect.ValueOf(payload).Elem()
+	for _, name := range strings.Split(path, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("%s: not a struct", path)
+		}
+		v = v.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, name) })
+		if !v.IsValid() || !v.CanSet() {
+			return reflect.Value{}, fmt.Errorf("unknown field %s of %T", path, payload)
+		}
+	}
+	return v, nil
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.String:
+		if strings.HasPrefix(s, `"`) {
+			var err error
+			if s, err = strconv.Unquote(s); err != nil {
+				return err
+			}
+		}
+		v.SetString(s)
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported type %v", v.Type())
+		}
+		b, err := parseBytes(s)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Slice {
+			if strings.HasPrefix(s, `"`) {
+				b = ipod.StringToBytes(string(b))
+			}
+			v.Set(reflect.ValueOf(b).Convert(v.Type()))
+			return nil
+		}
+		if len(b) > v.Len() {
+			return fmt.Errorf("%d bytes do not fit into %v", len(b), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf(b))
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+// parseBytes parses "quoted text" or hex bytes
+func parseBytes(s string) ([]byte, error) {
+	if strings.HasPrefix(s, `"`) {
+		text, err := strconv.Unquote(s)
+		return []byte(text), err
+	}
+	return hex.DecodeString(strings.TrimPrefix(s, "0x"))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/oandrew/ipod"
+	extremote "github.com/oandrew/ipod/lingo-extremote"
+	general "github.com/oandrew/ipod/lingo-general"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"  state ", []string{"state"}},
+		{"send general.ReturniPodName Name=\"my car\"", []string{"send", "general.ReturniPodName", "Name=\"my car\""}},
+		{`mark "a \" b"`, []string{"mark", `"a \" b"`}},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.line)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q want %q", tt.line, got, tt.want)
+		}
+	}
+	if _, err := splitArgs(`send "open`); err == nil {
+		t.Error("got no error for an unterminated quote")
+	}
+}
+
+func TestSetFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		assigns []string
+		want    interface{}
+		wantErr bool
+	}{
+		{"extremote.PlayStatusChangeNotification", []string{"Status=1"}, &extremote.PlayStatusChangeNotification{Status: 1}, false},
+		{"extremote.SetPlayStatusChangeNotification", []string{"eventmask=0xff"}, &extremote.SetPlayStatusChangeNotification{EventMask: 0xff}, false},
+		{"extremote.SetPlayStatusChangeNotificationShort", []string{"Enabled=true"}, &extremote.SetPlayStatusChangeNotificationShort{Enabled: true}, false},
+		{"general.ReturniPodName", []string{`Name="my car"`}, &general.ReturniPodName{Name: []byte("my car\x00")}, false},
+		{"general.ReturniPodSerialNum", []string{"Serial=0a0b"}, &general.ReturniPodSerialNum{Serial: []byte{0x0a, 0x0b}}, false},
+		{"general.GetiPodOptionsForLingo", []string{"LingoID=0x100"}, nil, true},
+		{"general.GetiPodOptionsForLingo", []string{"Lingo=1"}, nil, true},
+		{"general.GetiPodOptionsForLingo", []string{"LingoID"}, nil, true},
+	}
+	for _, tt := range tests {
+		_, payload, ok := ipod.LookupName(tt.name)
+		if !ok {
+			t.Fatalf("%s: not found", tt.name)
+		}
+		err := setFields(payload, tt.assigns)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s %v: error = %v, wantErr %v", tt.name, tt.assigns, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(payload, tt.want) {
+			t.Errorf("%s %v: got %+v want %+v", tt.name, tt.assigns, payload, tt.want)
+		}
+	}
+}
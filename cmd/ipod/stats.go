@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+// maxStatsErrors is the number of decode errors listed in detail
+const maxStatsErrors = 10
+
+type statsKey struct {
+	Dir  trace.Dir
+	Name string
+}
+
+type handshakeEvent struct {
+	TS   time.Duration
+	Dir  trace.Dir
+	Text string
+}
+
+type pendingRequest struct {
+	Name string
+	TS   time.Duration
+}
+
+// traceStats summarizes a trace
+type traceStats struct {
+	Duration time.Duration
+	Frames   [2]int
+
+	FrameErrors  int
+	PacketErrors int
+	CmdErrors    int
+	Errors       []string
+
+	Lingos   map[statsKey]int
+	Commands map[statsKey]int
+	Unknown  map[statsKey]int
+
+	Handshake []handshakeEvent
+
+	// Latency is the time from a request to the first response
+	// with the same transaction id by request command
+	Latency map[string][]time.Duration
+	// pending are the requests sent in each direction
+	// waiting for a response from the other one
+	pending [2]map[ipod.Transaction]pendingRequest
+}
+
+func collectStats(tr *trace.Reader, reportDefs hid.ReportDefs) (*traceStats, error) {
+	s := &traceStats{
+		Lingos:   map[statsKey]int{},
+		Commands: map[statsKey]int{},
+		Unknown:  map[statsKey]int{},
+		Latency:  map[string][]time.Duration{},
+		pending: [2]map[ipod.Transaction]pendingRequest{
+			trace.DirIn:  {},
+			trace.DirOut: {},
+		},
+	}
+	err := decodeTrace(tr, reportDefs, s.addFrame)
+	return s, err
+}
+
+func (s *traceStats) addError(frame *trace.Frame, what string, err error) {
+	if len(s.Errors) >= maxStatsErrors {
+		return
+	}
+	index := uint(0)
+	if len(frame.Msgs) > 0 {
+		index = frame.Msgs[0].Index
+	}
+	s.Errors = append(s.Errors, dirPrefix(frame.Dir, fmt.Sprintf("#%d %v %s: %v", index, frame.TS, what, err)))
+}
+
+func (s *traceStats) addFrame(frame *trace.Frame) {
+	s.Frames[frame.Dir]++
+	if frame.TS > s.Duration {
+		s.Duration = frame.TS
+	}
+	if frame.Err != nil {
+		s.FrameErrors++
+		s.addError(frame, "frame", frame.Err)
+		return
+	}
+	for _, p := range frame.Packets {
+		if p.Err != nil {
+			s.PacketErrors++
+			s.addError(frame, "packet", p.Err)
+			continue
+		}
+		if p.CmdErr != nil {
+			if _, ok := p.Cmd.Payload.(ipod.UnknownPayload); ok {
+				s.Unknown[statsKey{frame.Dir, p.Cmd.ID.String()}]++
+				s.Lingos[statsKey{frame.Dir, lingoName(p.Cmd)}]++
+				continue
+			}
+			s.CmdErrors++
+			s.addError(frame, commandName(p.Cmd), p.CmdErr)
+			continue
+		}
+		s.addCommand(frame, p.Cmd)
+	}
+}
+
+func (s *traceStats) addCommand(frame *trace.Frame, cmd *ipod.Command) {
+	name := commandName(cmd)
+	s.Commands[statsKey{frame.Dir, name}]++
+	s.Lingos[statsKey{frame.Dir, lingoName(cmd)}]++
+
+	if text, ok := handshakeText(cmd); ok {
+		s.Handshake = append(s.Handshake, handshakeEvent{frame.TS, frame.Dir, text})
+	}
+
+	if cmd.Transaction == nil {
+		return
+	}
+	// either side can start a transaction, a command answers
+	// a pending request from the other side or starts a new one
+	trx := *cmd.Transaction
+	other := s.pending[1-frame.Dir]
+	if req, ok := other[trx]; ok {
+		s.Latency[req.Name] = append(s.Latency[req.Name], frame.TS-req.TS)
+		delete(other, trx)
+		return
+	}
+	s.pending[frame.Dir][trx] = pendingRequest{name, frame.TS}
+}
+
+// handshakeText describes the commands of the identification
+// and authentication handshake
+func handshakeText(cmd *ipod.Command) (string, bool) {
+	name := commandName(cmd)
+	switch p := cmd.Payload.(type) {
+	case *general.IdentifyDeviceLingoes:
+		return fmt.Sprintf("%s lingos=%v options=%#x device=%#x", name, &p.Lingos, p.Options, p.DeviceID), true
+	case *general.SetFIDTokenValues:
+		var tokens []string
+		for _, v := range p.FIDTokenValues {
+			token := fmt.Sprintf("%T", v.Token)
+			token = token[strings.Index(token, ".")+1:]
+			if info, ok := v.Token.(*general.FIDAccInfoToken); ok {
+				token = fmt.Sprintf("%s(%d)", token, info.AccInfoType)
+			}
+			tokens = append(tokens, token)
+		}
+		return fmt.Sprintf("%s %s", name, strings.Join(tokens, " ")), true
+	case *general.RetFIDTokenValueACKs:
+		return fmt.Sprintf("%s acks=%d", name, len(p.FIDTokenValueACKs)), true
+	case *general.EndIDPS:
+		return fmt.Sprintf("%s status=%d", name, p.AccEndIDPSStatus), true
+	case *general.IDPSStatus:
+		return fmt.Sprintf("%s %+v", name, *p), true
+	case *general.RetDevAuthenticationInfo:
+		if p.Major < 2 {
+			return fmt.Sprintf("%s v%d.%d", name, p.Major, p.Minor), true
+		}
+		return fmt.Sprintf("%s v%d.%d cert section %d/%d (%d bytes)", name, p.Major, p.Minor,
+			p.CertCurrentSection, p.CertMaxSection, len(p.CertData)), true
+	case *general.AckDevAuthenticationInfo:
+		return fmt.Sprintf("%s status=%d", name, p.Status), true
+	case *general.RetDevAuthenticationSignature:
+		return fmt.Sprintf("%s (%d bytes)", name, len(p.Signature)), true
+	case *general.AckDevAuthenticationStatus:
+		result := "passed"
+		if p.Status != general.DevAuthStatusPassed {
+			result = fmt.Sprintf("failed (%d)", p.Status)
+		}
+		return fmt.Sprintf("%s %s", name, result), true
+	case *general.RequestIdentify, *general.StartIDPS, *general.GetDevAuthenticationInfo,
+		*general.GetDevAuthenticationSignatureV1, *general.GetDevAuthenticationSignatureV2:
+		return name, true
+	}
+	return "", false
+}
+
+// percentile returns the nearest rank percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// sortedCounts returns the keys of counts ordered by direction and
+// descending count
+func sortedCounts(counts map[statsKey]int) []statsKey {
+	keys := make([]statsKey, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Dir != b.Dir {
+			return a.Dir < b.Dir
+		}
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+		return a.Name < b.Name
+	})
+	return keys
+}
+
+func printCounts(w io.Writer, title string, counts map[statsKey]int) {
+	if len(counts) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%s:\n", title)
+	for _, k := range sortedCounts(counts) {
+		fmt.Fprintf(w, "  %s\n", dirPrefix(k.Dir, fmt.Sprintf("%6d  %s", counts[k], k.Name)))
+	}
+}
+
+func (s *traceStats) print(w io.Writer) {
+	fmt.Fprintf(w, "duration: %v\n", s.Duration)
+	fmt.Fprintf(w, "frames: %d in, %d out\n", s.Frames[trace.DirIn], s.Frames[trace.DirOut])
+	fmt.Fprintf(w, "errors: %d frame, %d packet, %d command\n", s.FrameErrors, s.PacketErrors, s.CmdErrors)
+	for _, e := range s.Errors {
+		fmt.Fprintf(w, "  %s\n", e)
+	}
+	if n := s.FrameErrors + s.PacketErrors + s.CmdErrors; n > len(s.Errors) {
+		fmt.Fprintf(w, "  ... %d more\n", n-len(s.Errors))
+	}
+
+	printCounts(w, "lingos", s.Lingos)
+	printCounts(w, "commands", s.Commands)
+	printCounts(w, "unknown commands", s.Unknown)
+
+	if len(s.Handshake) > 0 {
+		fmt.Fprintf(w, "\nhandshake:\n")
+		for _, e := range s.Handshake {
+			fmt.Fprintf(w, "  %12v %s\n", e.TS, dirPrefix(e.Dir, e.Text))
+		}
+	}
+
+	if len(s.Latency) > 0 {
+		names := make([]string, 0, len(s.Latency))
+		var all []time.Duration
+		for name, l := range s.Latency {
+			names = append(names, name)
+			all = append(all, l...)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "\nresponse latency by request:\n")
+		fmt.Fprintf(w, "  %6s %12s %12s %12s %12s  %s\n", "count", "p50", "p90", "p99", "max", "request")
+		printLatency := func(name string, l []time.Duration) {
+			sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+			fmt.Fprintf(w, "  %6d %12v %12v %12v %12v  %s\n", len(l),
+				percentile(l, 50), percentile(l, 90), percentile(l, 99), l[len(l)-1], name)
+		}
+		for _, name := range names {
+			printLatency(name, s.Latency[name])
+		}
+		printLatency("all", all)
+	}
+	if len(s.pending[trace.DirIn])+len(s.pending[trace.DirOut]) > 0 {
+		fmt.Fprintf(w, "\nunanswered requests: %d in, %d out\n", len(s.pending[trace.DirIn]), len(s.pending[trace.DirOut]))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+func TestCollectStats(t *testing.T) {
+	trx := func(payload interface{}, id uint16) *ipod.Command {
+		return testCommand(t, payload, ipod.NewTransaction(id))
+	}
+	var buf bytes.Buffer
+	tw := trace.NewWriter(&buf)
+	if err := tw.WriteHeader(&trace.Header{ReportDefs: hid.DefaultReportDefs}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ms      int
+		dir     trace.Dir
+		payload interface{}
+	}{
+		{0, trace.DirIn, trx(&general.StartIDPS{}, 0)},
+		{50, trace.DirOut, trx(&general.ACK{Status: general.ACKStatusSuccess, CmdID: 0x38}, 0)},
+		{60, trace.DirIn, trx(&general.RequestiPodName{}, 1)},
+		{160, trace.DirOut, trx(&general.ReturniPodName{Name: ipod.StringToBytes("ipod")}, 1)},
+		// a request of the ipod answered by the accessory
+		{200, trace.DirOut, trx(&general.GetDevAuthenticationInfo{}, 2)},
+		{500, trace.DirIn, trx(&general.RetDevAuthenticationInfo{Major: 1, Minor: 0}, 2)},
+		// the accessory reuses the transaction id
+		{600, trace.DirIn, trx(&general.RequestiPodName{}, 2)},
+		{1000, trace.DirOut, trx(&general.ReturniPodName{Name: ipod.StringToBytes("ipod")}, 2)},
+		{1100, trace.DirIn, trx(&general.RequestiPodSoftwareVersion{}, 3)},
+		// without a transaction id
+		{1200, trace.DirIn, &general.RequestiPodSerialNum{}},
+	} {
+		writeTestCommand(t, tw, c.dir, time.Duration(c.ms)*time.Millisecond, c.payload)
+	}
+	// a frame with a broken checksum
+	if err := tw.WriteMsg(&trace.Msg{Dir: trace.DirIn, TS: 1300 * time.Millisecond, Data: []byte{0x01, 0x00, 0x55, 0x02, 0x00, 0x07, 0x00}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := trace.NewReader(&buf)
+	s, err := collectStats(tr, traceReportDefs(tr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Duration != 1300*time.Millisecond || s.Frames != [2]int{7, 4} {
+		t.Errorf("duration %v frames %v", s.Duration, s.Frames)
+	}
+	if s.FrameErrors+s.PacketErrors != 1 || len(s.Errors) != 1 {
+		t.Errorf("errors: %d frame %d packet %v", s.FrameErrors, s.PacketErrors, s.Errors)
+	}
+	wantCommands := map[statsKey]int{
+		{trace.DirIn, "general.StartIDPS"}:                  1,
+		{trace.DirIn, "general.RequestiPodName"}:            2,
+		{trace.DirIn, "general.RetDevAuthenticationInfo"}:   1,
+		{trace.DirIn, "general.RequestiPodSoftwareVersion"}: 1,
+		{trace.DirIn, "general.RequestiPodSerialNum"}:       1,
+		{trace.DirOut, "general.ACK"}:                       1,
+		{trace.DirOut, "general.ReturniPodName"}:            2,
+		{trace.DirOut, "general.GetDevAuthenticationInfo"}:  1,
+	}
+	if !reflect.DeepEqual(s.Commands, wantCommands) {
+		t.Errorf("commands = %v, want %v", s.Commands, wantCommands)
+	}
+	wantLingos := map[statsKey]int{{trace.DirIn, "general"}: 6, {trace.DirOut, "general"}: 4}
+	if !reflect.DeepEqual(s.Lingos, wantLingos) {
+		t.Errorf("lingos = %v, want %v", s.Lingos, wantLingos)
+	}
+	wantHandshake := []handshakeEvent{
+		{0, trace.DirIn, "general.StartIDPS"},
+		{200 * time.Millisecond, trace.DirOut, "general.GetDevAuthenticationInfo"},
+		{500 * time.Millisecond, trace.DirIn, "general.RetDevAuthenticationInfo v1.0"},
+	}
+	if !reflect.DeepEqual(s.Handshake, wantHandshake) {
+		t.Errorf("handshake = %v, want %v", s.Handshake, wantHandshake)
+	}
+	wantLatency := map[string][]time.Duration{
+		"general.RequestiPodName":          {100 * time.Millisecond, 400 * time.Millisecond},
+		"general.GetDevAuthenticationInfo": {300 * time.Millisecond},
+		"general.StartIDPS":                {50 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(s.Latency, wantLatency) {
+		t.Errorf("latency = %v, want %v", s.Latency, wantLatency)
+	}
+
+	var out bytes.Buffer
+	s.print(&out)
+	for _, want := range []string{
+		"frames: 7 in, 4 out",
+		fmt.Sprintf("%6d %12v %12v %12v %12v  %s", 2, 100*time.Millisecond, 400*time.Millisecond, 400*time.Millisecond, 400*time.Millisecond, "general.RequestiPodName"),
+		fmt.Sprintf("%6d %12v %12v %12v %12v  %s", 4, 100*time.Millisecond, 400*time.Millisecond, 400*time.Millisecond, 400*time.Millisecond, "all"),
+		"unanswered requests: 1 in, 0 out",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var ms []time.Duration
+	for i := 1; i <= 10; i++ {
+		ms = append(ms, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{ms, 0, 1 * time.Millisecond},
+		{ms, 50, 5 * time.Millisecond},
+		{ms, 90, 9 * time.Millisecond},
+		{ms, 99, 10 * time.Millisecond},
+		{ms, 100, 10 * time.Millisecond},
+		{ms[:1], 50, 1 * time.Millisecond},
+		{ms[:3], 50, 2 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("percentile(%v, %d) = %v, want %v", tt.sorted, tt.p, got, tt.want)
+		}
+	}
+}
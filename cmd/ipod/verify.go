@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	"github.com/oandrew/ipod/trace"
+)
+
+// verifyTrace feeds the requests of a recorded trace to the handlers
+// and compares the responses with the recorded ones. cfg is the device
+// identity the handlers answer with, nil for the default one.
+func verifyTrace(w io.Writer, path string, cfg *deviceConfig, rules ignoreRules, all bool) (diffSummary, error) {
+	f, err := openTraceFile(path)
+	if err != nil {
+		return diffSummary{}, err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return diffSummary{}, err
+	}
+	recorded, err := readTraceCommands(bytes.NewReader(data))
+	if err != nil {
+		return diffSummary{}, err
+	}
+
+	buf, err := runTraceRequests(bytes.NewReader(data), cfg)
+	if err != nil {
+		return diffSummary{}, err
+	}
+	produced, err := readTraceCommands(buf)
+	if err != nil {
+		return diffSummary{}, err
+	}
+	return diffCommands(w, recorded, produced, rules, all), nil
+}
+
+// runTraceRequests feeds the requests of a trace to a fresh device
+// and returns the trace of the requests and the responses
+func runTraceRequests(r io.Reader, cfg *deviceConfig) (*bytes.Buffer, error) {
+	tr := trace.NewReader(r)
+	reportDefs := traceReportDefs(tr)
+	q := trace.Queue{}
+	for {
+		var msg trace.Msg
+		err := tr.ReadMsg(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		q.Enqueue(&msg)
+	}
+
+	var buf bytes.Buffer
+	tw := trace.NewWriter(&buf)
+	if err := tw.WriteHeader(&trace.Header{ReportDefs: reportDefs}); err != nil {
+		return nil, err
+	}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{trace.NewQueueDirReader(&q, trace.DirIn), ioutil.Discard}
+	t := trace.NewTracerWriter(tw, rw)
+
+	// every trace starts with a fresh device
+	devGeneral = &DevGeneral{cfg: cfg}
+	devExtRemote = newDevExtRemote()
+	ipod.TrxReset()
+	processFrames(context.Background(), hid.NewTransport(hid.NewReportReader(t), hid.NewReportWriter(t), reportDefs))
+	return &buf, nil
+}
+
+// verifyTraces verifies each trace and prints a verdict per trace,
+// it fails if any of them does not match
+func verifyTraces(w io.Writer, files []string, cfg *deviceConfig, rules ignoreRules, all bool) error {
+	failed := 0
+	for _, path := range files {
+		fmt.Fprintf(w, "=== %s\n", path)
+		s, err := verifyTrace(w, path, cfg, rules, all)
+		switch {
+		case err != nil:
+			log.WithError(err).WithField("path", path).Errorf("could not verify the trace")
+			failed++
+		case !s.Same():
+			fmt.Fprintf(w, "--- FAIL %s\n", path)
+			failed++
+		default:
+			fmt.Fprintf(w, "--- ok %s\n", path)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d traces failed", failed, len(files))
+	}
+	return nil
+}
+
+// traceFiles expands directories into the *.trace files they contain
+func traceFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !stat.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.trace"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no trace files found")
+	}
+	return files, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod/hid"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+func TestVerifyTraces(t *testing.T) {
+	defer func() {
+		devGeneral = &DevGeneral{}
+		devExtRemote = newDevExtRemote()
+	}()
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// record the responses of the current handlers
+	var requests bytes.Buffer
+	tw := trace.NewWriter(&requests)
+	if err := tw.WriteHeader(&trace.Header{ReportDefs: hid.DefaultReportDefs}); err != nil {
+		t.Fatal(err)
+	}
+	for i, req := range []interface{}{
+		&general.RequestiPodName{},
+		&general.RequestiPodSoftwareVersion{},
+		&general.RequestiPodSerialNum{},
+	} {
+		writeTestCommand(t, tw, trace.DirIn, time.Duration(i)*100*time.Millisecond, req)
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := runTraceRequests(&requests, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	okPath := filepath.Join(dir, "ok.trace")
+	if err := ioutil.WriteFile(okPath, recorded.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// and change one of them
+	cmds, err := readTraceCommands(bytes.NewReader(recorded.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 6 {
+		t.Fatalf("recorded %d commands, want 6", len(cmds))
+	}
+	var changed bytes.Buffer
+	tw = trace.NewWriter(&changed)
+	if err := tw.WriteHeader(&trace.Header{ReportDefs: hid.DefaultReportDefs}); err != nil {
+		t.Fatal(err)
+	}
+	for i, cmd := range cmds {
+		payload := cmd.Cmd.Payload
+		if sw, ok := payload.(*general.ReturniPodSoftwareVersion); ok {
+			other := *sw
+			other.Major++
+			payload = &other
+		}
+		writeTestCommand(t, tw, cmd.Dir, time.Duration(i)*100*time.Millisecond, payload)
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	badPath := filepath.Join(dir, "bad.trace")
+	if err := ioutil.WriteFile(badPath, changed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := verifyTraces(&out, []string{okPath}, nil, nil, false); err != nil {
+		t.Fatalf("verify failed: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "--- ok "+okPath) {
+		t.Errorf("missing the verdict in report:\n%s", out.String())
+	}
+
+	out.Reset()
+	err = verifyTraces(&out, []string{okPath, badPath}, nil, nil, false)
+	if err == nil || err.Error() != "1 of 2 traces failed" {
+		t.Fatalf("got error %v\n%s", err, out.String())
+	}
+	for _, want := range []string{"--- ok " + okPath, "ReturniPodSoftwareVersion", "--- FAIL " + badPath} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in report:\n%s", want, out.String())
+		}
+	}
+}
@@ -94,6 +94,31 @@ func TestCommand_UnmarshalBinary(t *testing.T) {
 	}
 }
 
+func TestLookupName(t *testing.T) {
+	tests := []struct {
+		name   string
+		wantID ipod.LingoCmdID
+		want   interface{}
+		wantOk bool
+	}{
+		{"audio.TrackNewAudioAttributes", ipod.NewLingoCmdID(ipod.LingoDigitalAudioID, 0x04), &audio.TrackNewAudioAttributes{}, true},
+		{"audio.tracknewaudioattributes", ipod.NewLingoCmdID(ipod.LingoDigitalAudioID, 0x04), &audio.TrackNewAudioAttributes{}, true},
+		{"audio.Unknown", 0, nil, false},
+		{"TrackNewAudioAttributes", 0, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, got, ok := ipod.LookupName(tt.name)
+			if ok != tt.wantOk {
+				t.Fatalf("LookupName() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if id != tt.wantID || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LookupName() = %v %#v, want %v %#v", id, got, tt.wantID, tt.want)
+			}
+		})
+	}
+}
+
 func BenchmarkCommand_MarshalBinary(b *testing.B) {
 	serde := ipod.CommandSerde{}
 	cmd := ipod.Command{
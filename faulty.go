@@ -0,0 +1,301 @@
+package ipod
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fault is a set of faults that can be injected by FaultyTransport
+type Fault uint8
+
+const (
+	// FaultDrop silently drops a frame
+	FaultDrop Fault = 1 << iota
+	// FaultDuplicate delivers a frame twice
+	FaultDuplicate
+	// FaultDelay delays a frame by up to FaultConfig.MaxDelay
+	FaultDelay
+	// FaultReorder swaps a frame with the next one, a frame is
+	// held back for at most FaultConfig.MaxDelay
+	FaultReorder
+	// FaultTruncate cuts off the tail of a frame
+	FaultTruncate
+	// FaultCorrupt flips a random bit of a frame
+	FaultCorrupt
+
+	FaultAll = FaultDrop | FaultDuplicate | FaultDelay | FaultReorder | FaultTruncate | FaultCorrupt
+)
+
+var faultNames = []struct {
+	f    Fault
+	name string
+}{
+	{FaultDrop, "drop"},
+	{FaultDuplicate, "duplicate"},
+	{FaultDelay, "delay"},
+	{FaultReorder, "reorder"},
+	{FaultTruncate, "truncate"},
+	{FaultCorrupt, "corrupt"},
+}
+
+func (f Fault) String() string {
+	labels := make([]string, 0, len(faultNames))
+	for _, n := range faultNames {
+		if f&n.f != 0 {
+			labels = append(labels, n.name)
+		}
+	}
+	return strings.Join(labels, ",")
+}
+
+// ParseFaults parses a comma separated list of fault names i.e. "drop,corrupt"
+func ParseFaults(s string) (Fault, error) {
+	var f Fault
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, n := range faultNames {
+			if n.name == name {
+				f |= n.f
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown fault: %s", name)
+		}
+	}
+	return f, nil
+}
+
+// FaultConfig configures a FaultyTransport
+type FaultConfig struct {
+	// Probability is the chance of a frame being affected by a fault
+	Probability float64
+	// Faults is the set of faults to pick from, all faults if zero
+	Faults Fault
+	// Seed makes the injected faults reproducible
+	Seed int64
+	// MaxDelay is the upper limit for FaultDelay and for how long
+	// FaultReorder holds back a frame
+	MaxDelay time.Duration
+}
+
+// FaultyTransport wraps a FrameReadWriter and injects faults
+// into the frames passing through it in both directions
+type FaultyTransport struct {
+	t   FrameReadWriter
+	cfg FaultConfig
+
+	mu         sync.Mutex
+	rnd        *rand.Rand
+	pending    [][]byte
+	heldRead   []byte
+	heldReadAt time.Time
+	heldWrite  []byte
+	heldTimer  *time.Timer
+
+	// wmu serializes the writes to t
+	wmu sync.Mutex
+}
+
+var _ FrameReadWriter = &FaultyTransport{}
+
+// NewFaultyTransport returns a FaultyTransport wrapping t
+func NewFaultyTransport(t FrameReadWriter, cfg FaultConfig) *FaultyTransport {
+	if cfg.Faults == 0 {
+		cfg.Faults = FaultAll
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = time.Second
+	}
+	return &FaultyTransport{
+		t:   t,
+		cfg: cfg,
+		rnd: rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+func (t *FaultyTransport) pickFault() Fault {
+	var faults []Fault
+	for _, n := range faultNames {
+		if t.cfg.Faults&n.f != 0 {
+			faults = append(faults, n.f)
+		}
+	}
+	return faults[t.rnd.Intn(len(faults))]
+}
+
+// inject returns the frames that should be delivered instead of frame
+// and how long to wait before delivering them
+func (t *FaultyTransport) inject(frame []byte, held *[]byte, dir string) ([][]byte, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rnd.Float64() >= t.cfg.Probability {
+		return t.release([][]byte{frame}, held), 0
+	}
+
+	fault := t.pickFault()
+	logrus.WithFields(logrus.Fields{
+		"fault": fault,
+		"dir":   dir,
+		"len":   len(frame),
+	}).Warn("injecting fault")
+
+	var delay time.Duration
+	var out [][]byte
+	switch fault {
+	case FaultDrop:
+	case FaultDuplicate:
+		out = [][]byte{frame, append([]byte(nil), frame...)}
+	case FaultDelay:
+		delay = time.Duration(t.rnd.Int63n(int64(t.cfg.MaxDelay)))
+		out = [][]byte{frame}
+	case FaultReorder:
+		if *held == nil {
+			*held = frame
+			return nil, 0
+		}
+		out = [][]byte{frame}
+	case FaultTruncate:
+		if len(frame) > 0 {
+			frame = frame[:t.rnd.Intn(len(frame))]
+		}
+		out = [][]byte{frame}
+	case FaultCorrupt:
+		if len(frame) > 0 {
+			frame[t.rnd.Intn(len(frame))] ^= 1 << uint(t.rnd.Intn(8))
+		}
+		out = [][]byte{frame}
+	}
+	return t.release(out, held), delay
+}
+
+// release appends a frame held back by FaultReorder
+func (t *FaultyTransport) release(out [][]byte, held *[]byte) [][]byte {
+	if *held != nil {
+		out = append(out, *held)
+		*held = nil
+	}
+	return out
+}
+
+func (t *FaultyTransport) ReadFrame() ([]byte, error) {
+	return t.ReadFrameContext(context.Background())
+}
+
+func (t *FaultyTransport) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	for {
+		t.mu.Lock()
+		if len(t.pending) > 0 {
+			frame := t.pending[0]
+			t.pending = t.pending[1:]
+			t.mu.Unlock()
+			return frame, nil
+		}
+		readCtx, cancel := ctx, context.CancelFunc(func() {})
+		if t.heldRead != nil {
+			// don't hold the frame longer than MaxDelay if nothing else is read,
+			// readers without context support release it with the next frame only
+			readCtx, cancel = context.WithDeadline(ctx, t.heldReadAt.Add(t.cfg.MaxDelay))
+		}
+		t.mu.Unlock()
+
+		frame, err := ReadFrameContext(readCtx, t.t)
+		cancel()
+		if err != nil {
+			t.mu.Lock()
+			held := t.heldRead
+			t.heldRead = nil
+			t.mu.Unlock()
+			if held != nil {
+				return held, nil
+			}
+			return nil, err
+		}
+
+		// the underlying transport may reuse the buffer
+		frames, delay := t.inject(append([]byte(nil), frame...), &t.heldRead, "read")
+		var waitErr error
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				// the frames are kept for the next read
+				waitErr = ctx.Err()
+			}
+		}
+		t.mu.Lock()
+		t.pending = append(t.pending, frames...)
+		if t.heldRead != nil && len(frames) == 0 {
+			t.heldReadAt = time.Now()
+		}
+		t.mu.Unlock()
+		if waitErr != nil {
+			return nil, waitErr
+		}
+	}
+}
+
+func (t *FaultyTransport) WriteFrame(data []byte) error {
+	frames, delay := t.inject(append([]byte(nil), data...), &t.heldWrite, "write")
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	t.mu.Lock()
+	switch {
+	case t.heldWrite != nil && t.heldTimer == nil:
+		// don't lose the frame if nothing else is written
+		t.heldTimer = time.AfterFunc(t.cfg.MaxDelay, func() { t.flushWrite() })
+	case t.heldWrite == nil && t.heldTimer != nil:
+		t.heldTimer.Stop()
+		t.heldTimer = nil
+	}
+	t.mu.Unlock()
+	return t.writeFrames(frames)
+}
+
+func (t *FaultyTransport) writeFrames(frames [][]byte) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	for _, frame := range frames {
+		if err := t.t.WriteFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushWrite writes the frame held back by FaultReorder if any
+func (t *FaultyTransport) flushWrite() error {
+	t.mu.Lock()
+	if t.heldTimer != nil {
+		t.heldTimer.Stop()
+		t.heldTimer = nil
+	}
+	frames := t.release(nil, &t.heldWrite)
+	t.mu.Unlock()
+	return t.writeFrames(frames)
+}
+
+// Close writes the frame held back by FaultReorder and closes the
+// underlying transport if it is an io.Closer
+func (t *FaultyTransport) Close() error {
+	err := t.flushWrite()
+	if c, ok := t.t.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,261 @@
+package ipod_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod"
+)
+
+type testFrameTransport struct {
+	in  [][]byte
+	out [][]byte
+}
+
+func (t *testFrameTransport) ReadFrame() ([]byte, error) {
+	if len(t.in) == 0 {
+		return nil, io.EOF
+	}
+	frame := t.in[0]
+	t.in = t.in[1:]
+	return frame, nil
+}
+
+func (t *testFrameTransport) WriteFrame(data []byte) error {
+	t.out = append(t.out, data)
+	return nil
+}
+
+func readAllFrames(t *testing.T, r ipod.FrameReader) [][]byte {
+	var frames [][]byte
+	for {
+		frame, err := r.ReadFrame()
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestFaultyTransport(t *testing.T) {
+	frames := [][]byte{{0x01, 0x01}, {0x02, 0x02}, {0x03, 0x03}}
+	tests := []struct {
+		name  string
+		fault ipod.Fault
+		want  [][]byte
+	}{
+		{"drop", ipod.FaultDrop, nil},
+		{"duplicate", ipod.FaultDuplicate, [][]byte{{0x01, 0x01}, {0x01, 0x01}, {0x02, 0x02}, {0x02, 0x02}, {0x03, 0x03}, {0x03, 0x03}}},
+		{"reorder", ipod.FaultReorder, [][]byte{{0x02, 0x02}, {0x01, 0x01}, {0x03, 0x03}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ipod.FaultConfig{Probability: 1, Faults: tt.fault, MaxDelay: time.Hour}
+
+			ft := ipod.NewFaultyTransport(&testFrameTransport{in: frames}, cfg)
+			if got := readAllFrames(t, ft); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read frames = %v, want %v", got, tt.want)
+			}
+
+			tr := &testFrameTransport{}
+			ft = ipod.NewFaultyTransport(tr, cfg)
+			for _, frame := range frames {
+				if err := ft.WriteFrame(frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the frame held back for reordering is flushed on close
+			if err := ft.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tr.out, tt.want) {
+				t.Errorf("written frames = %v, want %v", tr.out, tt.want)
+			}
+		})
+	}
+}
+
+func TestFaultyTransportReorderAlternate(t *testing.T) {
+	cfg := ipod.FaultConfig{Probability: 1, Faults: ipod.FaultReorder, MaxDelay: time.Hour}
+
+	// a response held back is overtaken by the next one
+	// even if a request is read in between
+	tr := &testFrameTransport{in: [][]byte{{0x10}, {0x11}}}
+	ft := ipod.NewFaultyTransport(tr, cfg)
+	if err := ft.WriteFrame([]byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.out) != 0 {
+		t.Fatalf("written frames = %v, want the first one held", tr.out)
+	}
+	if _, err := ft.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.out) != 0 {
+		t.Fatalf("written frames = %v, the read released the held frame", tr.out)
+	}
+	if err := ft.WriteFrame([]byte{0x02}); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{{0x02}, {0x01}}; !reflect.DeepEqual(tr.out, want) {
+		t.Errorf("written frames = %v, want %v", tr.out, want)
+	}
+}
+
+func TestFaultyTransportReorderMaxDelay(t *testing.T) {
+	cfg := ipod.FaultConfig{Probability: 1, Faults: ipod.FaultReorder, MaxDelay: 10 * time.Millisecond}
+
+	// a written frame is released after MaxDelay if nothing else is written
+	w := &syncFrameWriter{}
+	ft := ipod.NewFaultyTransport(w, cfg)
+	if err := ft.WriteFrame([]byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for w.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if w.count() != 1 {
+		t.Errorf("held frame not written after MaxDelay")
+	}
+
+	// and so is a read frame if nothing else is read
+	ft = ipod.NewFaultyTransport(&blockingFrameReader{frame: []byte{0x01}}, cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, err := ft.ReadFrameContext(ctx)
+	if err != nil || !bytes.Equal(got, []byte{0x01}) {
+		t.Errorf("got %v, %v want the held frame", got, err)
+	}
+}
+
+// blockingFrameReader returns frame once and then blocks until the context is done
+type blockingFrameReader struct {
+	testFrameTransport
+	frame []byte
+}
+
+func (r *blockingFrameReader) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	if r.frame != nil {
+		frame := r.frame
+		r.frame = nil
+		return frame, nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// syncFrameWriter counts the written frames, it is safe for concurrent use
+type syncFrameWriter struct {
+	testFrameTransport
+	mu sync.Mutex
+}
+
+func (w *syncFrameWriter) WriteFrame(data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.testFrameTransport.WriteFrame(data)
+}
+
+func (w *syncFrameWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.out)
+}
+
+func TestFaultyTransportTruncate(t *testing.T) {
+	frame := []byte{0x55, 0x02, 0x00, 0x13, 0xeb}
+	for seed := int64(0); seed < 32; seed++ {
+		ft := ipod.NewFaultyTransport(&testFrameTransport{in: [][]byte{frame}}, ipod.FaultConfig{
+			Probability: 1,
+			Faults:      ipod.FaultTruncate,
+			Seed:        seed,
+		})
+		got, err := ft.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) >= len(frame) {
+			t.Errorf("seed %d: frame not truncated: %v", seed, got)
+		}
+	}
+}
+
+func TestFaultyTransportDelayContext(t *testing.T) {
+	ft := ipod.NewFaultyTransport(&testFrameTransport{in: [][]byte{{0x01}}}, ipod.FaultConfig{
+		Probability: 1,
+		Faults:      ipod.FaultDelay,
+		MaxDelay:    time.Hour,
+		Seed:        1,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ft.ReadFrameContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("delay ignored the context, returned after %v", d)
+	}
+	// the delayed frame is not lost
+	got, err := ft.ReadFrame()
+	if err != nil || !bytes.Equal(got, []byte{0x01}) {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
+
+func TestFaultyTransportCorrupt(t *testing.T) {
+	frame := []byte{0x55, 0x02, 0x00, 0x13, 0xeb}
+	ft := ipod.NewFaultyTransport(&testFrameTransport{in: [][]byte{frame}}, ipod.FaultConfig{
+		Probability: 1,
+		Faults:      ipod.FaultCorrupt | ipod.FaultTruncate,
+		Seed:        1,
+	})
+	got, err := ft.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, frame) {
+		t.Errorf("frame not modified: %v", got)
+	}
+	if !bytes.Equal(frame, []byte{0x55, 0x02, 0x00, 0x13, 0xeb}) {
+		t.Errorf("source frame modified: %v", frame)
+	}
+}
+
+func TestFaultyTransportSeed(t *testing.T) {
+	frames := make([][]byte, 32)
+	for i := range frames {
+		frames[i] = []byte{byte(i), 0x00, 0xff}
+	}
+	cfg := ipod.FaultConfig{Probability: 0.5, Faults: ipod.FaultAll &^ ipod.FaultDelay, Seed: 42}
+	got1 := readAllFrames(t, ipod.NewFaultyTransport(&testFrameTransport{in: frames}, cfg))
+	got2 := readAllFrames(t, ipod.NewFaultyTransport(&testFrameTransport{in: frames}, cfg))
+	if !reflect.DeepEqual(got1, got2) {
+		t.Errorf("same seed produced different faults: %v != %v", got1, got2)
+	}
+}
+
+func TestParseFaults(t *testing.T) {
+	f, err := ipod.ParseFaults("drop, corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != ipod.FaultDrop|ipod.FaultCorrupt {
+		t.Errorf("ParseFaults() = %v", f)
+	}
+	if f.String() != "drop,corrupt" {
+		t.Errorf("Fault.String() = %s", f.String())
+	}
+	if _, err := ipod.ParseFaults("bogus"); err == nil {
+		t.Errorf("ParseFaults() expected error")
+	}
+}
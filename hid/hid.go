@@ -3,6 +3,7 @@ package hid
 
 import (
 	"bytes"
+	"context"
 )
 
 type Report struct {
@@ -22,6 +23,7 @@ const (
 type Encoder struct {
 	reportDefs ReportDefs
 	w          ReportWriter
+	dir        ReportDir
 }
 
 func min(a, b int) int {
@@ -35,7 +37,7 @@ func (e *Encoder) WriteFrame(data []byte) error {
 	offset := 0
 	bytesLeft := len(data)
 	for bytesLeft > 0 {
-		reportDef, err := e.reportDefs.Pick(bytesLeft, ReportDirAccIn)
+		reportDef, err := e.reportDefs.Pick(bytesLeft, e.dir)
 		if err != nil {
 			return err
 		}
@@ -68,10 +70,22 @@ func (e *Encoder) WriteFrame(data []byte) error {
 
 }
 
+// NewEncoder returns an Encoder writing ipod->accessory reports
 func NewEncoder(w ReportWriter, defs ReportDefs) *Encoder {
+	return NewEncoderDir(w, defs, ReportDirAccIn)
+}
+
+// NewEncoderDir returns an Encoder writing the reports of direction dir.
+// Descriptors without reports of dir (like DefaultReportDefs) use the
+// ipod->accessory reports both ways.
+func NewEncoderDir(w ReportWriter, defs ReportDefs, dir ReportDir) *Encoder {
+	if _, err := defs.Pick(0, dir); err != nil {
+		dir = ReportDirAccIn
+	}
 	return &Encoder{
 		reportDefs: defs,
 		w:          w,
+		dir:        dir,
 	}
 }
 
@@ -86,11 +100,27 @@ type Decoder struct {
 }
 
 func (e *Decoder) ReadFrame() ([]byte, error) {
+	return e.ReadFrameContext(context.Background())
+}
+
+func (e *Decoder) readReport(ctx context.Context) (Report, error) {
+	if rr, ok := e.r.(ReportReaderContext); ok {
+		return rr.ReadReportContext(ctx)
+	}
+	if ctx.Err() != nil {
+		return Report{}, ctxErr(ctx)
+	}
+	return e.r.ReadReport()
+}
+
+// ReadFrameContext is like ReadFrame but returns early with
+// context.Canceled or ErrTimeout once ctx is done.
+func (e *Decoder) ReadFrameContext(ctx context.Context) ([]byte, error) {
 	buf := &e.buf
 	buf.Reset()
 	done := false
 	for !done {
-		report, err := e.r.ReadReport()
+		report, err := e.readReport(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -96,6 +96,38 @@ func TestEncoder(t *testing.T) {
 	}
 }
 
+func TestEncoderDir(t *testing.T) {
+	data := make([]byte, 300)
+	for _, tt := range []struct {
+		dir  hid.ReportDir
+		want []byte
+	}{
+		{hid.ReportDirAccIn, []byte{0x0A}},
+		{hid.ReportDirAccOut, []byte{0x15, 0x12}},
+	} {
+		rw := &testReportWriter{}
+		if err := hid.NewEncoderDir(rw, hid.LegacyReportDefs, tt.dir).WriteFrame(data); err != nil {
+			t.Fatal(err)
+		}
+		var ids []byte
+		for _, report := range rw.reports {
+			ids = append(ids, report.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%v: report ids % 02x want % 02x", tt.dir, ids, tt.want)
+		}
+	}
+
+	// the default descriptor has the same reports in both directions
+	rw := &testReportWriter{}
+	if err := hid.NewEncoderDir(rw, hid.DefaultReportDefs, hid.ReportDirAccOut).WriteFrame([]byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rw.reports) != 1 || rw.reports[0].ID != 0x01 {
+		t.Errorf("got reports %+v want one 0x01 report", rw.reports)
+	}
+}
+
 func TestHidDecoder(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -3,6 +3,7 @@ package hid
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 // ReportDir is the report direction
@@ -102,3 +103,44 @@ func (defs ReportDefs) Find(id int) (ReportDef, error) {
 	}
 	return ReportDef{}, fmt.Errorf("report id no found: %#v", id)
 }
+
+func (dir ReportDir) String() string {
+	switch dir {
+	case ReportDirAccIn:
+		return "in"
+	case ReportDirAccOut:
+		return "out"
+	}
+	return fmt.Sprintf("dir(%d)", uint8(dir))
+}
+
+// String returns defs as a space separated list of id:len:dir
+func (defs ReportDefs) String() string {
+	parts := make([]string, len(defs))
+	for i, def := range defs {
+		parts[i] = fmt.Sprintf("%02x:%d:%v", def.ID, def.Len, def.Dir)
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseReportDefs parses report types in the format produced by ReportDefs.String
+func ParseReportDefs(s string) (ReportDefs, error) {
+	var defs ReportDefs
+	for _, part := range strings.Fields(s) {
+		var def ReportDef
+		var dir string
+		if _, err := fmt.Sscanf(strings.Replace(part, ":", " ", -1), "%x %d %s", &def.ID, &def.Len, &dir); err != nil {
+			return nil, fmt.Errorf("bad report def %q: %v", part, err)
+		}
+		switch dir {
+		case "in":
+			def.Dir = ReportDirAccIn
+		case "out":
+			def.Dir = ReportDirAccOut
+		default:
+			return nil, fmt.Errorf("bad report def %q: unknown dir", part)
+		}
+		defs = append(defs, def)
+	}
+	return defs, nil
+}
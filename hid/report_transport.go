@@ -2,7 +2,14 @@ package hid
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 type ReportReader interface {
@@ -13,6 +20,16 @@ type ReportWriter interface {
 	WriteReport(Report) error
 }
 
+// ReportReaderContext is implemented by report readers
+// that can abort a blocking read.
+type ReportReaderContext interface {
+	ReadReportContext(ctx context.Context) (Report, error)
+}
+
+// ErrTimeout is returned when a report could not be transferred
+// before the deadline
+var ErrTimeout = errors.New("hid: i/o timeout")
+
 type SingleReport []byte
 
 func (s SingleReport) ReadReport() (Report, error) {
@@ -45,6 +62,59 @@ func (rr *rawReportReader) ReadReport() (Report, error) {
 	}, nil
 }
 
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ctxErr converts the context error so that an expired deadline
+// is reported the same way as a read timeout
+func ctxErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+// ReadReportContext reads a report until ctx is done.
+// The read is interrupted using a read deadline, readers that do not
+// support deadlines are only checked before the read.
+func (rr *rawReportReader) ReadReportContext(ctx context.Context) (Report, error) {
+	if ctx.Err() != nil {
+		return Report{}, ctxErr(ctx)
+	}
+	dr, ok := rr.r.(readDeadliner)
+	if !ok {
+		return rr.ReadReport()
+	}
+	deadline, _ := ctx.Deadline()
+	if err := dr.SetReadDeadline(deadline); err != nil {
+		// i.e. regular files
+		return rr.ReadReport()
+	}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// unblock the pending read
+			dr.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	report, err := rr.ReadReport()
+	close(stop)
+	<-stopped
+
+	if err != nil && isTimeout(err) {
+		if ctx.Err() != nil {
+			return Report{}, ctxErr(ctx)
+		}
+		return Report{}, ErrTimeout
+	}
+	return report, err
+}
+
 func NewReportReader(r io.Reader) ReportReader {
 	return &rawReportReader{
 		r:   r,
@@ -52,22 +122,131 @@ func NewReportReader(r io.Reader) ReportReader {
 	}
 }
 
+// WriterOptions controls the pacing and deadlines of a report writer
+type WriterOptions struct {
+	// ReportDelay is the minimum interval between two consecutive reports
+	ReportDelay time.Duration
+	// FrameTimeout limits the time it takes to write all reports of a frame.
+	// Zero means no deadline.
+	FrameTimeout time.Duration
+	// RetryDelay is the pause before retrying a write that failed with EAGAIN
+	RetryDelay time.Duration
+	// RetryTimeout limits how long a write that fails with EAGAIN is retried
+	// when there is no frame deadline. Zero means defaultRetryTimeout.
+	RetryTimeout time.Duration
+}
+
+const (
+	defaultRetryDelay   = 5 * time.Millisecond
+	defaultRetryTimeout = 10 * time.Second
+)
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
 type rawReportWriter struct {
-	w   io.Writer
-	buf bytes.Buffer
+	w        io.Writer
+	buf      bytes.Buffer
+	opts     WriterOptions
+	last     time.Time
+	deadline time.Time
+}
+
+// wait blocks until the inter-report delay has passed
+func (rw *rawReportWriter) wait() error {
+	if rw.opts.ReportDelay <= 0 || rw.last.IsZero() {
+		return nil
+	}
+	next := rw.last.Add(rw.opts.ReportDelay)
+	if !rw.deadline.IsZero() && next.After(rw.deadline) {
+		return ErrTimeout
+	}
+	time.Sleep(time.Until(next))
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var te interface{ Timeout() bool }
+	return errors.As(err, &te) && te.Timeout()
 }
 
 func (rw *rawReportWriter) WriteReport(report Report) error {
+	// the first report of a frame starts a new deadline
+	if report.LinkControl&LinkControlContinue == 0 {
+		rw.deadline = time.Time{}
+		if rw.opts.FrameTimeout > 0 {
+			rw.deadline = time.Now().Add(rw.opts.FrameTimeout)
+		}
+	}
+
+	if err := rw.wait(); err != nil {
+		return fmt.Errorf("hid: write report %#02x: %w", report.ID, err)
+	}
+
+	if dw, ok := rw.w.(writeDeadliner); ok {
+		// not all files support deadlines, i.e. regular files
+		_ = dw.SetWriteDeadline(rw.deadline)
+	}
+
 	rw.buf.Reset()
 	rw.buf.WriteByte(report.ID)
 	rw.buf.WriteByte(byte(report.LinkControl))
 	rw.buf.Write(report.Data)
-	_, err := rw.buf.WriteTo(rw.w)
-	return err
+	data := rw.buf.Bytes()
+
+	// retryUntil is set by the first EAGAIN of the report
+	var retryUntil time.Time
+	for {
+		n, err := rw.w.Write(data)
+		rw.last = time.Now()
+		switch {
+		case err == nil && n == len(data):
+			return nil
+		case n > 0 && n < len(data), err == nil:
+			// a report can not be resumed once the device has accepted a part of it
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+			return fmt.Errorf("hid: write report %#02x: wrote %d of %d bytes: %w", report.ID, n, len(data), err)
+		case errors.Is(err, syscall.EAGAIN):
+			if retryUntil.IsZero() {
+				retryUntil = rw.deadline
+				if retryUntil.IsZero() {
+					retryTimeout := rw.opts.RetryTimeout
+					if retryTimeout <= 0 {
+						retryTimeout = defaultRetryTimeout
+					}
+					retryUntil = rw.last.Add(retryTimeout)
+				}
+				logrus.WithField("report", fmt.Sprintf("%#02x", report.ID)).
+					Warnf("hid: device busy, retrying write until %s", retryUntil.Format(time.StampMilli))
+			}
+			if rw.last.After(retryUntil) {
+				return fmt.Errorf("hid: write report %#02x: %w", report.ID, ErrTimeout)
+			}
+			retryDelay := rw.opts.RetryDelay
+			if retryDelay <= 0 {
+				retryDelay = defaultRetryDelay
+			}
+			time.Sleep(retryDelay)
+		case isTimeout(err):
+			return fmt.Errorf("hid: write report %#02x: %w", report.ID, ErrTimeout)
+		default:
+			return fmt.Errorf("hid: write report %#02x: %w", report.ID, err)
+		}
+	}
 }
 
 func NewReportWriter(w io.Writer) ReportWriter {
+	return NewReportWriterOptions(w, WriterOptions{})
+}
+
+// NewReportWriterOptions returns a ReportWriter that writes
+// each report with a single Write call honoring opts
+func NewReportWriterOptions(w io.Writer, opts WriterOptions) ReportWriter {
 	return &rawReportWriter{
-		w: w,
+		w:    w,
+		opts: opts,
 	}
 }
@@ -0,0 +1,147 @@
+package hid_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod/hid"
+)
+
+type testWriter struct {
+	writes [][]byte
+	// results are returned by consecutive writes, nil means success
+	results []error
+	short   bool
+}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	i := len(w.writes)
+	w.writes = append(w.writes, append([]byte(nil), p...))
+	var err error
+	if i < len(w.results) {
+		err = w.results[i]
+	}
+	if w.short {
+		return len(p) - 1, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func TestReportWriter(t *testing.T) {
+	report := hid.Report{ID: 0x01, LinkControl: hid.LinkControlDone, Data: []byte{0x55, 0x00}}
+	tests := []struct {
+		name       string
+		w          *testWriter
+		opts       hid.WriterOptions
+		wantErr    error
+		wantWrites int
+	}{
+		{"ok", &testWriter{}, hid.WriterOptions{}, nil, 1},
+		{"short-write", &testWriter{short: true}, hid.WriterOptions{}, io.ErrShortWrite, 1},
+		{"short-write-error", &testWriter{short: true, results: []error{io.ErrClosedPipe}}, hid.WriterOptions{}, io.ErrClosedPipe, 1},
+		{"eagain-retry", &testWriter{results: []error{syscall.EAGAIN, syscall.EAGAIN}}, hid.WriterOptions{RetryDelay: time.Millisecond}, nil, 3},
+		{"eagain-timeout", &testWriter{results: []error{syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN}}, hid.WriterOptions{RetryDelay: 10 * time.Millisecond, FrameTimeout: 5 * time.Millisecond}, hid.ErrTimeout, 2},
+		{"eagain-retry-timeout", &testWriter{results: []error{syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN}}, hid.WriterOptions{RetryDelay: 10 * time.Millisecond, RetryTimeout: 5 * time.Millisecond}, hid.ErrTimeout, 2},
+		{"error", &testWriter{results: []error{io.ErrClosedPipe}}, hid.WriterOptions{}, io.ErrClosedPipe, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := hid.NewReportWriterOptions(tt.w, tt.opts)
+			err := rw.WriteReport(report)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("WriteReport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(tt.w.writes) != tt.wantWrites {
+				t.Errorf("WriteReport() writes = %d, want %d", len(tt.w.writes), tt.wantWrites)
+			}
+		})
+	}
+}
+
+func TestReportWriterDelay(t *testing.T) {
+	delay := 20 * time.Millisecond
+	rw := hid.NewReportWriterOptions(&testWriter{}, hid.WriterOptions{ReportDelay: delay})
+	report := hid.Report{ID: 0x01, LinkControl: hid.LinkControlDone, Data: []byte{0x55}}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := rw.WriteReport(report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Errorf("3 reports written in %v, want at least %v", elapsed, 2*delay)
+	}
+}
+
+func TestReportWriterFrameTimeout(t *testing.T) {
+	rw := hid.NewReportWriterOptions(&testWriter{}, hid.WriterOptions{
+		ReportDelay:  20 * time.Millisecond,
+		FrameTimeout: 10 * time.Millisecond,
+	})
+	first := hid.Report{ID: 0x01, LinkControl: hid.LinkControlMoreToFollow, Data: []byte{0x55}}
+	last := hid.Report{ID: 0x01, LinkControl: hid.LinkControlContinue, Data: []byte{0x00}}
+	if err := rw.WriteReport(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.WriteReport(last); !errors.Is(err, hid.ErrTimeout) {
+		t.Errorf("WriteReport() error = %v, wantErr %v", err, hid.ErrTimeout)
+	}
+}
+
+func TestReportReaderContext(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	rr := hid.NewReportReader(r).(hid.ReportReaderContext)
+
+	t.Run("read", func(t *testing.T) {
+		w.Write([]byte{0x01, 0x00, 0x55})
+		report, err := rr.ReadReportContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.ID != 0x01 {
+			t.Errorf("ReadReportContext() report id = %#02x, want %#02x", report.ID, 0x01)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		if _, err := rr.ReadReportContext(ctx); err != context.Canceled {
+			t.Errorf("ReadReportContext() error = %v, wantErr %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := rr.ReadReportContext(ctx); err != hid.ErrTimeout {
+			t.Errorf("ReadReportContext() error = %v, wantErr %v", err, hid.ErrTimeout)
+		}
+	})
+
+	t.Run("read-after-cancel", func(t *testing.T) {
+		w.Write([]byte{0x02, 0x00, 0x55})
+		report, err := rr.ReadReportContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.ID != 0x02 {
+			t.Errorf("ReadReportContext() report id = %#02x, want %#02x", report.ID, 0x02)
+		}
+	})
+}
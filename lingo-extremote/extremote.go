@@ -49,6 +49,8 @@ var Lingos struct {
 	SetPlayStatusChangeNotification            `id:"0x0026"`
 	SetPlayStatusChangeNotificationShort       `id:"0x0026"`
 	PlayStatusChangeNotification               `id:"0x0027"`
+	PlayStatusChangeNotificationValue          `id:"0x0027"`
+	PlayStatusChangeNotificationState          `id:"0x0027"`
 	PlayCurrentSelection                       `id:"0x0028"`
 	PlayControl                                `id:"0x0029"`
 	GetTrackArtworkTimes                       `id:"0x002A"`
@@ -372,6 +374,44 @@ type SetPlayStatusChangeNotificationShort struct {
 type PlayStatusChangeNotification struct {
 	Status byte // finish
 }
+
+// PlayStatusChangeNotificationValue is a PlayStatusChangeNotification
+// carrying the new track index, track position or chapter index
+type PlayStatusChangeNotificationValue struct {
+	Status byte
+	Value  uint32
+}
+
+// PlayStatusChangeNotificationState is a PlayStatusChangeNotification
+// carrying the extended play state
+type PlayStatusChangeNotificationState struct {
+	Status byte
+	State  byte
+}
+
+// PlayStatusChangeNotification statuses
+const (
+	PlayStatusStopped       = 0x00
+	PlayStatusTrackIndex    = 0x01
+	PlayStatusTrackPosition = 0x04
+	PlayStatusExtended      = 0x06
+)
+
+// Extended play states of PlayStatusChangeNotificationState
+const (
+	ExtendedStateStopped = 0x02
+	ExtendedStatePlaying = 0x0A
+	ExtendedStatePaused  = 0x0B
+)
+
+// SetPlayStatusChangeNotification event mask bits
+const (
+	PlayStatusMaskBasic         = 1 << 0
+	PlayStatusMaskExtended      = 1 << 1
+	PlayStatusMaskTrackIndex    = 1 << 2
+	PlayStatusMaskTrackPosition = 1 << 3
+)
+
 type PlayCurrentSelection struct {
 	SelectedTrackIndex int32
 }
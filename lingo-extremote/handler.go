@@ -8,6 +8,22 @@ type DeviceExtRemote interface {
 	PlaybackStatus() (trackLength, trackPos uint32, state PlayerState)
 }
 
+// DeviceTrackInfo is implemented by devices that know the metadata
+// of the playing track, placeholders are returned for other devices
+type DeviceTrackInfo interface {
+	TrackTitle() string
+	TrackArtistName() string
+	TrackAlbumName() string
+}
+
+// trackInfo returns the metadata of the playing track
+func trackInfo(dev DeviceExtRemote) (title, artist, album string) {
+	if info, ok := dev.(DeviceTrackInfo); ok {
+		return info.TrackTitle(), info.TrackArtistName(), info.TrackAlbumName()
+	}
+	return "title", "artist", "album"
+}
+
 func ackSuccess(req *ipod.Command) *ACK {
 	return &ACK{Status: ACKStatusSuccess, CmdID: req.ID.CmdID()}
 }
@@ -46,9 +62,10 @@ func HandleExtRemote(req *ipod.Command, tr ipod.CommandWriter, dev DeviceExtRemo
 		var info interface{}
 		switch msg.InfoType {
 		case TrackInfoCaps:
+			trackLength, _, _ := dev.PlaybackStatus()
 			info = &TrackCaps{
 				Caps:         0x0,
-				TrackLength:  300 * 1000,
+				TrackLength:  trackLength,
 				ChapterCount: 1,
 			}
 		case TrackInfoDescription, TrackInfoLyrics:
@@ -85,26 +102,27 @@ func HandleExtRemote(req *ipod.Command, tr ipod.CommandWriter, dev DeviceExtRemo
 	case *RetrieveCategorizedDatabaseRecords:
 		ipod.Respond(req, tr, &ReturnCategorizedDatabaseRecord{})
 	case *GetPlayStatus:
-		ipod.Respond(req, tr, &ReturnPlayStatus{
-			TrackLength:   300 * 1000,
-			TrackPosition: 20 * 1000,
-			State:         PlayerStatePaused,
-		})
+		var resp ReturnPlayStatus
+		resp.TrackLength, resp.TrackPosition, resp.State = dev.PlaybackStatus()
+		ipod.Respond(req, tr, &resp)
 	case *GetCurrentPlayingTrackIndex:
 		ipod.Respond(req, tr, &ReturnCurrentPlayingTrackIndex{
 			TrackIndex: 0,
 		})
 	case *GetIndexedPlayingTrackTitle:
+		title, _, _ := trackInfo(dev)
 		ipod.Respond(req, tr, &ReturnIndexedPlayingTrackTitle{
-			Title: ipod.StringToBytes("title"),
+			Title: ipod.StringToBytes(title),
 		})
 	case *GetIndexedPlayingTrackArtistName:
+		_, artist, _ := trackInfo(dev)
 		ipod.Respond(req, tr, &ReturnIndexedPlayingTrackArtistName{
-			ArtistName: ipod.StringToBytes("artist"),
+			ArtistName: ipod.StringToBytes(artist),
 		})
 	case *GetIndexedPlayingTrackAlbumName:
+		_, _, album := trackInfo(dev)
 		ipod.Respond(req, tr, &ReturnIndexedPlayingTrackAlbumName{
-			AlbumName: ipod.StringToBytes("album"),
+			AlbumName: ipod.StringToBytes(album),
 		})
 	case *SetPlayStatusChangeNotification:
 		ipod.Respond(req, tr, ackSuccess(req))
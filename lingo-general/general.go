@@ -101,6 +101,7 @@ type ACKStatus uint8
 const (
 	ACKStatusSuccess  ACKStatus = 0x00
 	ACKStatusFailed   ACKStatus = 0x02
+	ACKStatusBadParam ACKStatus = 0x04
 	ACKStatusUnkownID ACKStatus = 0x05
 	ACKStatusPending  ACKStatus = 0x06
 )
@@ -263,6 +264,15 @@ type RetDevAuthenticationInfo struct {
 	CertData           []byte
 }
 
+func (s *RetDevAuthenticationInfo) MarshalBinary() ([]byte, error) {
+	buf := []byte{s.Major, s.Minor}
+	if s.Major >= 0x02 {
+		buf = append(buf, s.CertCurrentSection, s.CertMaxSection)
+		buf = append(buf, s.CertData...)
+	}
+	return buf, nil
+}
+
 func (s *RetDevAuthenticationInfo) UnmarshalBinary(r []byte) error {
 	if len(r) < 2 {
 		return errors.New("short packet")
@@ -306,6 +316,10 @@ type RetDevAuthenticationSignature struct {
 	Signature []byte
 }
 
+func (s *RetDevAuthenticationSignature) MarshalBinary() ([]byte, error) {
+	return s.Signature, nil
+}
+
 func (s *RetDevAuthenticationSignature) UnmarshalBinary(r []byte) error {
 	s.Signature = make([]byte, len(r))
 	copy(s.Signature, r)
@@ -516,6 +530,14 @@ type FIDAccInfoToken struct {
 	Value       interface{}
 }
 
+func (t *FIDAccInfoToken) MarshalBinary() ([]byte, error) {
+	v, ok := t.Value.([]byte)
+	if !ok {
+		return nil, errors.New("unknown AccInfoToken value")
+	}
+	return append([]byte{t.AccInfoType}, v...), nil
+}
+
 func (t *FIDAccInfoToken) UnmarshalBinary(data []byte) error {
 	r := bytes.NewReader(data)
 	binary.Read(r, binary.BigEndian, &t.AccInfoType)
@@ -552,6 +574,10 @@ type FIDEAProtocolToken struct {
 	ProtocolString []byte
 }
 
+func (t *FIDEAProtocolToken) MarshalBinary() ([]byte, error) {
+	return append([]byte{t.ProtocolIndex}, t.ProtocolString...), nil
+}
+
 func (t *FIDEAProtocolToken) UnmarshalBinary(data []byte) error {
 	t.ProtocolIndex = data[0]
 	t.ProtocolString = data[1:]
@@ -713,6 +739,13 @@ func (s *SetFIDTokenValues) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// The first byte of a FIDTokenValueACK
+const (
+	FIDTokenACKStatusAccepted byte = 0x00
+	// FIDTokenACKStatusFailed refuses a required token
+	FIDTokenACKStatusFailed byte = 0x01
+)
+
 type FIDTokenValueACK struct {
 	ID  TokenID
 	ACK interface{}
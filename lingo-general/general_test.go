@@ -0,0 +1,98 @@
+package general_test
+
+import (
+	"bytes"
+	"encoding"
+	"reflect"
+	"testing"
+
+	general "github.com/oandrew/ipod/lingo-general"
+)
+
+func TestMarshalRoundtrip(t *testing.T) {
+	type payload interface {
+		encoding.BinaryMarshaler
+		encoding.BinaryUnmarshaler
+	}
+	tests := []struct {
+		name string
+		p    payload
+		new  func() payload
+		want []byte
+	}{
+		{
+			"auth-info-v1",
+			&general.RetDevAuthenticationInfo{Major: 1, Minor: 0},
+			func() payload { return &general.RetDevAuthenticationInfo{} },
+			[]byte{0x01, 0x00},
+		},
+		{
+			"auth-info-v2",
+			&general.RetDevAuthenticationInfo{Major: 2, Minor: 0, CertCurrentSection: 1, CertMaxSection: 3, CertData: []byte{0x30, 0x82, 0x01}},
+			func() payload { return &general.RetDevAuthenticationInfo{} },
+			[]byte{0x02, 0x00, 0x01, 0x03, 0x30, 0x82, 0x01},
+		},
+		{
+			"auth-signature",
+			&general.RetDevAuthenticationSignature{Signature: []byte{0xaa, 0xbb, 0xcc}},
+			func() payload { return &general.RetDevAuthenticationSignature{} },
+			[]byte{0xaa, 0xbb, 0xcc},
+		},
+		{
+			"accinfo-serial",
+			&general.FIDAccInfoToken{AccInfoType: 0x08, Value: []byte("SN1\x00")},
+			func() payload { return &general.FIDAccInfoToken{} },
+			[]byte{0x08, 'S', 'N', '1', 0x00},
+		},
+		{
+			"accinfo-version",
+			&general.FIDAccInfoToken{AccInfoType: 0x04, Value: []byte{0x01, 0x02, 0x03}},
+			func() payload { return &general.FIDAccInfoToken{} },
+			[]byte{0x04, 0x01, 0x02, 0x03},
+		},
+		{
+			"ea-protocol",
+			&general.FIDEAProtocolToken{ProtocolIndex: 1, ProtocolString: []byte("com.example\x00")},
+			func() payload { return &general.FIDEAProtocolToken{} },
+			append([]byte{0x01}, "com.example\x00"...),
+		},
+		{
+			"token-values",
+			&general.SetFIDTokenValues{FIDTokenValues: []general.FIDTokenValue{
+				{ID: general.TokenID{FIDType: 0x00, FIDSubtype: 0x02}, Token: &general.FIDAccInfoToken{AccInfoType: 0x08, Value: []byte("SN1\x00")}},
+				{ID: general.TokenID{FIDType: 0x00, FIDSubtype: 0x04}, Token: &general.FIDEAProtocolToken{ProtocolIndex: 1, ProtocolString: []byte("com.a\x00")}},
+			}},
+			func() payload { return &general.SetFIDTokenValues{} },
+			[]byte{
+				0x02,
+				0x07, 0x00, 0x02, 0x08, 'S', 'N', '1', 0x00,
+				0x09, 0x00, 0x04, 0x01, 'c', 'o', 'm', '.', 'a', 0x00,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.p.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tt.want) {
+				t.Errorf("MarshalBinary() = % 02x, want % 02x", data, tt.want)
+			}
+			got := tt.new()
+			if err := got.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.p) {
+				t.Errorf("UnmarshalBinary() = %+v, want %+v", got, tt.p)
+			}
+		})
+	}
+}
+
+func TestFIDAccInfoTokenBadValue(t *testing.T) {
+	token := &general.FIDAccInfoToken{AccInfoType: 0x08, Value: "SN1"}
+	if _, err := token.MarshalBinary(); err == nil {
+		t.Errorf("MarshalBinary() expected error")
+	}
+}
@@ -12,7 +12,10 @@ type DeviceGeneral interface {
 	Name() string
 	SoftwareVersion() (major, minor, rev uint8)
 	SerialNum() string
+	ModelNum() (modelID uint32, model string)
 
+	// LingoProtocolVersion returns 0.0 for lingoes the device doesn't support,
+	// accessories identifying with such lingoes are refused
 	LingoProtocolVersion(lingo uint8) (major, minor uint8)
 	LingoOptions(ling uint8) uint64
 
@@ -45,11 +48,35 @@ func ack(req *ipod.Command, status ACKStatus) *ACK {
 	return &ACK{Status: status, CmdID: uint8(req.ID.CmdID())}
 }
 
-func ackFIDTokenValue(tokenValue FIDTokenValue) FIDTokenValueACK {
+// supportsLingoes reports whether the device supports all the lingoes
+func supportsLingoes(dev DeviceGeneral, lingoes []uint8) bool {
+	for _, lingo := range lingoes {
+		if major, minor := dev.LingoProtocolVersion(lingo); major == 0 && minor == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// maskLingoes returns the lingoes set in the mask
+func maskLingoes(mask LingoMask) []uint8 {
+	var lingoes []uint8
+	for i := uint8(0); i < 32; i++ {
+		if mask&(1<<i) != 0 {
+			lingoes = append(lingoes, i)
+		}
+	}
+	return lingoes
+}
+
+func ackFIDTokenValue(tokenValue FIDTokenValue, dev DeviceGeneral) FIDTokenValueACK {
 	ackToken := func(token interface{}) interface{} {
 		switch t := token.(type) {
 		case *FIDIdentifyToken:
-			return []byte{0x00}
+			if !supportsLingoes(dev, t.AccLingoes) {
+				return []byte{FIDTokenACKStatusFailed}
+			}
+			return []byte{FIDTokenACKStatusAccepted}
 		case *FIDAccCapsToken:
 			return []byte{0x00}
 		case *FIDAccInfoToken:
@@ -78,10 +105,10 @@ func ackFIDTokenValue(tokenValue FIDTokenValue) FIDTokenValueACK {
 	}
 }
 
-func ackFIDTokenValues(tokens *SetFIDTokenValues) *RetFIDTokenValueACKs {
+func ackFIDTokenValues(tokens *SetFIDTokenValues, dev DeviceGeneral) *RetFIDTokenValueACKs {
 	acks := make([]FIDTokenValueACK, len(tokens.FIDTokenValues))
 	for i := range tokens.FIDTokenValues {
-		acks[i] = ackFIDTokenValue(tokens.FIDTokenValues[i])
+		acks[i] = ackFIDTokenValue(tokens.FIDTokenValues[i], dev)
 	}
 	return &RetFIDTokenValueACKs{
 		FIDTokenValueACKs: acks,
@@ -121,19 +148,27 @@ func HandleGeneral(req *ipod.Command, tr ipod.CommandWriter, dev DeviceGeneral)
 	case *RequestiPodSerialNum:
 		ipod.Respond(req, tr, &ReturniPodSerialNum{Serial: ipod.StringToBytes(dev.SerialNum())})
 	case *RequestiPodModelNum:
+		modelID, model := dev.ModelNum()
 		ipod.Respond(req, tr, &ReturniPodModelNum{
-			// iphone 4
-			ModelID: 0x00111349,
-			Model:   ipod.StringToBytes("MC676"),
+			ModelID: modelID,
+			Model:   ipod.StringToBytes(model),
 		})
 	case *RequestLingoProtocolVersion:
 		var resp ReturnLingoProtocolVersion
 		resp.Lingo = msg.Lingo
 		resp.Major, resp.Minor = dev.LingoProtocolVersion(msg.Lingo)
+		if resp.Major == 0 && resp.Minor == 0 {
+			ipod.Respond(req, tr, ack(req, ACKStatusBadParam))
+			break
+		}
 		ipod.Respond(req, tr, &resp)
 	case *RequestTransportMaxPayloadSize:
 		ipod.Respond(req, tr, &ReturnTransportMaxPayloadSize{MaxPayload: dev.MaxPayload()})
 	case *IdentifyDeviceLingoes:
+		if !supportsLingoes(dev, maskLingoes(msg.Lingos)) {
+			ipod.Respond(req, tr, ack(req, ACKStatusBadParam))
+			break
+		}
 		ipod.Respond(req, tr, ackSuccess(req))
 		if msg.DeviceID != 0x00 {
 			//ipod.Send(tr, &GetDevAuthenticationInfo{})
@@ -215,7 +250,7 @@ func HandleGeneral(req *ipod.Command, tr ipod.CommandWriter, dev DeviceGeneral)
 		for _, token := range msg.FIDTokenValues {
 			dev.SetToken(token)
 		}
-		ipod.Respond(req, tr, ackFIDTokenValues(msg))
+		ipod.Respond(req, tr, ackFIDTokenValues(msg, dev))
 	case *EndIDPS:
 		dev.EndIDPS(msg.AccEndIDPSStatus)
 		switch msg.AccEndIDPSStatus {
@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 // LingoCmdID represents Lingo ID and Command ID
@@ -144,6 +145,17 @@ func LookupID(v interface{}) (id LingoCmdID, ok bool) {
 	return
 }
 
+// LookupName finds a registered payload by the name of its type i.e. general.ACK.
+// Payload is a pointer to a new zero value of the found type.
+func LookupName(name string) (id LingoCmdID, payload interface{}, ok bool) {
+	for t, id := range mTypeToID {
+		if strings.EqualFold(t.String(), name) {
+			return id, reflect.New(t).Interface(), true
+		}
+	}
+	return 0, nil, false
+}
+
 // LookupResult contains the result of a Lookup.
 // Payload is a pointer to a new zero value of the found type
 // Transaction specifies if the Transaction should be present in the packet.
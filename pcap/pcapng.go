@@ -0,0 +1,132 @@
+// Package pcap implements reading and writing of packet captures
+// for exchanging traces with tools like Wireshark
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// LinkType is the link layer type of the captured packets
+type LinkType uint16
+
+const (
+	// LinkTypeUSBLinux is the usbmon binary format with a 48 byte header
+	LinkTypeUSBLinux LinkType = 189
+	// LinkTypeUSBLinuxMMapped is the usbmon binary format with a 64 byte header
+	LinkTypeUSBLinuxMMapped LinkType = 220
+)
+
+const (
+	blockTypeSHB = 0x0A0D0D0A
+	blockTypeIDB = 0x00000001
+	blockTypeEPB = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	optEndOfOpt = 0
+	optComment  = 1
+	optTSResol  = 9
+	optEPBFlags = 2
+)
+
+// Flags is the direction of a packet as stored in the epb_flags option
+type Flags uint32
+
+const (
+	FlagsInbound  Flags = 0x01
+	FlagsOutbound Flags = 0x02
+)
+
+// Packet is a single captured packet
+type Packet struct {
+	Timestamp time.Time
+	Data      []byte
+	Flags     Flags
+	Comment   string
+	// LinkType is set by Reader, NgWriter uses the type of its interface
+	LinkType LinkType
+}
+
+// NgWriter writes packets of a single interface in the pcapng format
+type NgWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+// NewNgWriter writes the section and interface headers
+// and returns a writer for packets of the given link type
+func NewNgWriter(w io.Writer, linkType LinkType, snapLen uint32) (*NgWriter, error) {
+	nw := &NgWriter{w: w}
+
+	var shb bytes.Buffer
+	binary.Write(&shb, binary.LittleEndian, uint32(byteOrderMagic))
+	binary.Write(&shb, binary.LittleEndian, uint16(1))
+	binary.Write(&shb, binary.LittleEndian, uint16(0))
+	binary.Write(&shb, binary.LittleEndian, int64(-1))
+	if err := nw.writeBlock(blockTypeSHB, shb.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var idb bytes.Buffer
+	binary.Write(&idb, binary.LittleEndian, uint16(linkType))
+	binary.Write(&idb, binary.LittleEndian, uint16(0))
+	binary.Write(&idb, binary.LittleEndian, snapLen)
+	// microsecond timestamps
+	writeOption(&idb, optTSResol, []byte{6})
+	writeOption(&idb, optEndOfOpt, nil)
+	if err := nw.writeBlock(blockTypeIDB, idb.Bytes()); err != nil {
+		return nil, err
+	}
+	return nw, nil
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+func writeOption(buf *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(buf, binary.LittleEndian, code)
+	binary.Write(buf, binary.LittleEndian, uint16(len(value)))
+	buf.Write(value)
+	buf.Write(make([]byte, pad4(len(value))))
+}
+
+func (nw *NgWriter) writeBlock(blockType uint32, body []byte) error {
+	nw.buf.Reset()
+	total := uint32(12 + len(body))
+	binary.Write(&nw.buf, binary.LittleEndian, blockType)
+	binary.Write(&nw.buf, binary.LittleEndian, total)
+	nw.buf.Write(body)
+	binary.Write(&nw.buf, binary.LittleEndian, total)
+	_, err := nw.buf.WriteTo(nw.w)
+	return err
+}
+
+// WritePacket writes p as an enhanced packet block
+func (nw *NgWriter) WritePacket(p *Packet) error {
+	var epb bytes.Buffer
+	ts := uint64(p.Timestamp.UnixNano() / int64(time.Microsecond))
+	binary.Write(&epb, binary.LittleEndian, uint32(0))
+	binary.Write(&epb, binary.LittleEndian, uint32(ts>>32))
+	binary.Write(&epb, binary.LittleEndian, uint32(ts))
+	binary.Write(&epb, binary.LittleEndian, uint32(len(p.Data)))
+	binary.Write(&epb, binary.LittleEndian, uint32(len(p.Data)))
+	epb.Write(p.Data)
+	epb.Write(make([]byte, pad4(len(p.Data))))
+
+	if p.Comment != "" || p.Flags != 0 {
+		if p.Comment != "" {
+			writeOption(&epb, optComment, []byte(p.Comment))
+		}
+		if p.Flags != 0 {
+			var flags [4]byte
+			binary.LittleEndian.PutUint32(flags[:], uint32(p.Flags))
+			writeOption(&epb, optEPBFlags, flags[:])
+		}
+		writeOption(&epb, optEndOfOpt, nil)
+	}
+	return nw.writeBlock(blockTypeEPB, epb.Bytes())
+}
@@ -0,0 +1,57 @@
+package pcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod/pcap"
+)
+
+func TestNgWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+	w, err := pcap.NewNgWriter(&buf, pcap.LinkTypeUSBLinuxMMapped, 65535)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pcap.Packet{
+		Timestamp: time.Unix(1, 500),
+		Data:      []byte{0x01, 0x02, 0x03},
+		Flags:     pcap.FlagsInbound,
+		Comment:   "hello",
+	}
+	if err := w.WritePacket(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	var blockTypes []uint32
+	data := buf.Bytes()
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("short block: %v", data)
+		}
+		blockType := binary.LittleEndian.Uint32(data[0:])
+		total := binary.LittleEndian.Uint32(data[4:])
+		if total%4 != 0 || int(total) > len(data) {
+			t.Fatalf("bad block length: %d", total)
+		}
+		if trailer := binary.LittleEndian.Uint32(data[total-4:]); trailer != total {
+			t.Fatalf("block length mismatch: %d != %d", total, trailer)
+		}
+		blockTypes = append(blockTypes, blockType)
+		if blockType == 0x06 {
+			body := data[8 : total-4]
+			if capLen := binary.LittleEndian.Uint32(body[12:]); capLen != 3 {
+				t.Errorf("captured len = %d, want 3", capLen)
+			}
+			if !bytes.Contains(body, []byte("hello")) {
+				t.Errorf("comment missing")
+			}
+		}
+		data = data[total:]
+	}
+	if !(len(blockTypes) == 3 && blockTypes[0] == 0x0A0D0D0A && blockTypes[1] == 0x01 && blockTypes[2] == 0x06) {
+		t.Errorf("block types = %x", blockTypes)
+	}
+}
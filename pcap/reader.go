@@ -0,0 +1,228 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	magicMicros = 0xA1B2C3D4
+	magicNanos  = 0xA1B23C4D
+
+	blockTypeSPB = 0x00000003
+)
+
+// ErrFormat is returned when the input is neither a pcap nor a pcapng file
+var ErrFormat = errors.New("pcap: unknown file format")
+
+type iface struct {
+	linkType LinkType
+	// timestamp units per second
+	tsResol uint64
+}
+
+// Reader reads packets from a pcap or a pcapng file
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+
+	// pcap
+	linkType LinkType
+	nanos    bool
+
+	// pcapng
+	ifaces []iface
+}
+
+// NewReader detects the file format and reads the file header
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReader(r)}
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case binary.LittleEndian.Uint32(magic) == blockTypeSHB:
+		pr.ng = true
+		return pr, nil
+	case binary.LittleEndian.Uint32(magic) == magicMicros || binary.LittleEndian.Uint32(magic) == magicNanos:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic) == magicMicros || binary.BigEndian.Uint32(magic) == magicNanos:
+		pr.order = binary.BigEndian
+	default:
+		return nil, ErrFormat
+	}
+
+	var hdr [24]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	pr.nanos = pr.order.Uint32(hdr[0:]) == magicNanos
+	pr.linkType = LinkType(pr.order.Uint32(hdr[20:]))
+	return pr, nil
+}
+
+// ByteOrder returns the byte order of the file
+// which is also the byte order of the capturing host
+func (pr *Reader) ByteOrder() binary.ByteOrder {
+	return pr.order
+}
+
+// ReadPacket returns the next packet
+func (pr *Reader) ReadPacket() (*Packet, error) {
+	if pr.ng {
+		return pr.readBlock()
+	}
+	var hdr [16]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	sec, frac := pr.order.Uint32(hdr[0:]), pr.order.Uint32(hdr[4:])
+	capLen := pr.order.Uint32(hdr[8:])
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, unexpected(err)
+	}
+	if !pr.nanos {
+		frac *= 1000
+	}
+	return &Packet{
+		Timestamp: time.Unix(int64(sec), int64(frac)),
+		Data:      data,
+		LinkType:  pr.linkType,
+	}, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (pr *Reader) readBlock() (*Packet, error) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(hdr[0:]) == blockTypeSHB {
+			// the byte order of a section follows the block length
+			var bom [4]byte
+			if _, err := io.ReadFull(pr.r, bom[:]); err != nil {
+				return nil, unexpected(err)
+			}
+			if binary.LittleEndian.Uint32(bom[:]) == byteOrderMagic {
+				pr.order = binary.LittleEndian
+			} else {
+				pr.order = binary.BigEndian
+			}
+			total := pr.order.Uint32(hdr[4:])
+			if total < 16 {
+				return nil, fmt.Errorf("pcap: bad block length %d", total)
+			}
+			if _, err := pr.r.Discard(int(total) - 12); err != nil {
+				return nil, unexpected(err)
+			}
+			pr.ifaces = pr.ifaces[:0]
+			continue
+		}
+		if pr.order == nil {
+			return nil, ErrFormat
+		}
+
+		blockType, total := pr.order.Uint32(hdr[0:]), pr.order.Uint32(hdr[4:])
+		if total < 12 || total%4 != 0 {
+			return nil, fmt.Errorf("pcap: bad block length %d", total)
+		}
+		body := make([]byte, total-8)
+		if _, err := io.ReadFull(pr.r, body); err != nil {
+			return nil, unexpected(err)
+		}
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case blockTypeIDB:
+			if len(body) < 8 {
+				return nil, fmt.Errorf("pcap: short interface block")
+			}
+			iface := iface{
+				linkType: LinkType(pr.order.Uint16(body[0:])),
+				tsResol:  1000000,
+			}
+			pr.walkOptions(body[8:], func(code uint16, value []byte) {
+				if code == optTSResol && len(value) == 1 {
+					iface.tsResol = tsResol(value[0])
+				}
+			})
+			pr.ifaces = append(pr.ifaces, iface)
+		case blockTypeEPB:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("pcap: short packet block")
+			}
+			id := pr.order.Uint32(body[0:])
+			if int(id) >= len(pr.ifaces) {
+				return nil, fmt.Errorf("pcap: unknown interface %d", id)
+			}
+			iface := pr.ifaces[id]
+			ts := uint64(pr.order.Uint32(body[4:]))<<32 | uint64(pr.order.Uint32(body[8:]))
+			capLen := int(pr.order.Uint32(body[12:]))
+			if 20+capLen > len(body) {
+				return nil, fmt.Errorf("pcap: bad captured length %d", capLen)
+			}
+			p := &Packet{
+				Timestamp: time.Unix(int64(ts/iface.tsResol), int64(ts%iface.tsResol*uint64(time.Second)/iface.tsResol)),
+				Data:      body[20 : 20+capLen],
+				LinkType:  iface.linkType,
+			}
+			pr.walkOptions(body[20+capLen+pad4(capLen):], func(code uint16, value []byte) {
+				switch code {
+				case optComment:
+					p.Comment = string(value)
+				case optEPBFlags:
+					if len(value) == 4 {
+						p.Flags = Flags(pr.order.Uint32(value))
+					}
+				}
+			})
+			return p, nil
+		case blockTypeSPB:
+			if len(pr.ifaces) == 0 || len(body) < 4 {
+				return nil, fmt.Errorf("pcap: bad simple packet block")
+			}
+			return &Packet{
+				Data:     body[4:],
+				LinkType: pr.ifaces[0].linkType,
+			}, nil
+		}
+	}
+}
+
+// tsResol converts the if_tsresol option to units per second
+func tsResol(v byte) uint64 {
+	n := uint64(1)
+	base := uint64(10)
+	if v&0x80 != 0 {
+		base = 2
+	}
+	for i := byte(0); i < v&0x7f; i++ {
+		n *= base
+	}
+	return n
+}
+
+func (pr *Reader) walkOptions(opts []byte, fn func(code uint16, value []byte)) {
+	for len(opts) >= 4 {
+		code, n := pr.order.Uint16(opts[0:]), int(pr.order.Uint16(opts[2:]))
+		if code == optEndOfOpt || 4+n > len(opts) {
+			return
+		}
+		fn(code, opts[4:4+n])
+		opts = opts[4+n+pad4(n):]
+	}
+}
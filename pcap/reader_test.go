@@ -0,0 +1,112 @@
+package pcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod/pcap"
+)
+
+func TestReaderNg(t *testing.T) {
+	buf := bytes.Buffer{}
+	w, err := pcap.NewNgWriter(&buf, pcap.LinkTypeUSBLinuxMMapped, 65535)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := pcap.USBPacket{
+		ID:        1,
+		Type:      'C',
+		Transfer:  pcap.TransferInterrupt,
+		Endpoint:  0x81,
+		Device:    5,
+		Bus:       1,
+		Timestamp: time.Unix(10, 2000),
+		Length:    3,
+		Data:      []byte{0x01, 0x02, 0x03},
+	}
+	in := []pcap.Packet{
+		{Timestamp: time.Unix(10, 2000), Data: up.MarshalMMapped(), Flags: pcap.FlagsInbound, Comment: "hello"},
+		{Timestamp: time.Unix(11, 0), Data: []byte{0xff}, Flags: pcap.FlagsOutbound},
+	}
+	for i := range in {
+		if err := w.WritePacket(&in[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := pcap.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range in {
+		p, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		in[i].LinkType = pcap.LinkTypeUSBLinuxMMapped
+		if !p.Timestamp.Equal(in[i].Timestamp) {
+			t.Errorf("packet %d: timestamp %v != %v", i, p.Timestamp, in[i].Timestamp)
+		}
+		p.Timestamp = in[i].Timestamp
+		if !reflect.DeepEqual(*p, in[i]) {
+			t.Errorf("packet %d: %+v != %+v", i, *p, in[i])
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("err = %v, want EOF", err)
+	}
+
+	p := pcap.Packet{Data: in[0].Data, LinkType: in[0].LinkType, Timestamp: in[0].Timestamp}
+	got, err := pcap.ParseUSBPacket(&p, r.ByteOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, up) {
+		t.Errorf("usb packet %+v != %+v", *got, up)
+	}
+}
+
+func TestReaderPcap(t *testing.T) {
+	buf := bytes.Buffer{}
+	le := binary.LittleEndian
+	hdr := make([]byte, 24)
+	le.PutUint32(hdr[0:], 0xA1B2C3D4)
+	le.PutUint16(hdr[4:], 2)
+	le.PutUint16(hdr[6:], 4)
+	le.PutUint32(hdr[16:], 65535)
+	le.PutUint32(hdr[20:], uint32(pcap.LinkTypeUSBLinux))
+	buf.Write(hdr)
+	rec := make([]byte, 16)
+	le.PutUint32(rec[0:], 5)
+	le.PutUint32(rec[4:], 7)
+	le.PutUint32(rec[8:], 2)
+	le.PutUint32(rec[12:], 2)
+	buf.Write(rec)
+	buf.Write([]byte{0xaa, 0xbb})
+
+	r, err := pcap.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := r.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pcap.Packet{Timestamp: time.Unix(5, 7000), Data: []byte{0xaa, 0xbb}, LinkType: pcap.LinkTypeUSBLinux}
+	if !p.Timestamp.Equal(want.Timestamp) || !bytes.Equal(p.Data, want.Data) || p.LinkType != want.LinkType {
+		t.Errorf("%+v != %+v", *p, want)
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("err = %v, want EOF", err)
+	}
+}
+
+func TestReaderUnknown(t *testing.T) {
+	if _, err := pcap.NewReader(bytes.NewReader([]byte("< 01 02\n"))); err != pcap.ErrFormat {
+		t.Errorf("err = %v, want ErrFormat", err)
+	}
+}
@@ -0,0 +1,237 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// USB transfer types as used by usbmon
+const (
+	TransferIsochronous = 0
+	TransferInterrupt   = 1
+	TransferControl     = 2
+	TransferBulk        = 3
+)
+
+// USBPacket is a usbmon event
+type USBPacket struct {
+	ID        uint64
+	Type      byte // 'S'ubmission, 'C'allback, 'E'rror
+	Transfer  byte
+	Endpoint  byte // 0x80 is set for IN endpoints
+	Device    byte
+	Bus       uint16
+	Timestamp time.Time
+	Status    int32
+	Length    uint32
+	Setup     []byte
+	Data      []byte
+}
+
+// In reports whether the transfer is device to host
+func (p *USBPacket) In() bool {
+	return p.Endpoint&0x80 != 0
+}
+
+// MarshalMMapped encodes p in the LinkTypeUSBLinuxMMapped format
+func (p *USBPacket) MarshalMMapped() []byte {
+	b := make([]byte, 64, 64+len(p.Data))
+	le := binary.LittleEndian
+	le.PutUint64(b[0:], p.ID)
+	b[8] = p.Type
+	b[9] = p.Transfer
+	b[10] = p.Endpoint
+	b[11] = p.Device
+	le.PutUint16(b[12:], p.Bus)
+	if len(p.Setup) == 8 {
+		b[14] = 0
+		copy(b[40:48], p.Setup)
+	} else {
+		b[14] = '-'
+	}
+	if len(p.Data) > 0 {
+		b[15] = 0
+	} else {
+		b[15] = '<'
+	}
+	le.PutUint64(b[16:], uint64(p.Timestamp.Unix()))
+	le.PutUint32(b[24:], uint32(p.Timestamp.Nanosecond()/1000))
+	le.PutUint32(b[28:], uint32(p.Status))
+	le.PutUint32(b[32:], p.Length)
+	le.PutUint32(b[36:], uint32(len(p.Data)))
+	return append(b, p.Data...)
+}
+
+// ParseUSBPacket decodes a packet captured with one of the usbmon link types.
+// order is the byte order of the capturing host, see Reader.ByteOrder.
+func ParseUSBPacket(p *Packet, order binary.ByteOrder) (*USBPacket, error) {
+	hdrLen := 0
+	switch p.LinkType {
+	case LinkTypeUSBLinux:
+		hdrLen = 48
+	case LinkTypeUSBLinuxMMapped:
+		hdrLen = 64
+	default:
+		return nil, fmt.Errorf("pcap: not a usbmon link type: %d", p.LinkType)
+	}
+	b := p.Data
+	if len(b) < hdrLen {
+		return nil, fmt.Errorf("pcap: short usbmon header")
+	}
+	up := &USBPacket{
+		ID:        order.Uint64(b[0:]),
+		Type:      b[8],
+		Transfer:  b[9],
+		Endpoint:  b[10],
+		Device:    b[11],
+		Bus:       order.Uint16(b[12:]),
+		Timestamp: p.Timestamp,
+		Status:    int32(order.Uint32(b[28:])),
+		Length:    order.Uint32(b[32:]),
+	}
+	if up.Timestamp.IsZero() {
+		up.Timestamp = time.Unix(int64(order.Uint64(b[16:])), int64(order.Uint32(b[24:]))*1000)
+	}
+	if b[14] == 0 {
+		up.Setup = append([]byte(nil), b[40:48]...)
+	}
+	capLen := int(order.Uint32(b[36:]))
+	data := b[hdrLen:]
+	if capLen < len(data) {
+		data = data[:capLen]
+	}
+	if len(data) > 0 {
+		up.Data = append([]byte(nil), data...)
+	}
+	return up, nil
+}
+
+// ParseUSBMonText parses a line of the usbmon text format (the 'u' format
+// from /sys/kernel/debug/usb/usbmon/Nu), i.e.
+//
+//	ffff88003a1f6840 3575914555 C Ii:1:005:1 0:8 4 = 01020304
+func ParseUSBMonText(line string) (*USBPacket, error) {
+	f := strings.Fields(line)
+	if len(f) < 6 {
+		return nil, fmt.Errorf("usbmon: short line: %q", line)
+	}
+	var p USBPacket
+	var err error
+	if p.ID, err = strconv.ParseUint(f[0], 16, 64); err != nil {
+		return nil, fmt.Errorf("usbmon: bad urb tag: %v", err)
+	}
+	us, err := strconv.ParseUint(f[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("usbmon: bad timestamp: %v", err)
+	}
+	p.Timestamp = time.Unix(0, int64(us)*int64(time.Microsecond))
+	if len(f[2]) != 1 {
+		return nil, fmt.Errorf("usbmon: bad event type: %q", f[2])
+	}
+	p.Type = f[2][0]
+
+	addr := strings.Split(f[3], ":")
+	if len(addr) != 4 || len(addr[0]) != 2 {
+		return nil, fmt.Errorf("usbmon: bad address: %q", f[3])
+	}
+	switch addr[0][0] {
+	case 'Z':
+		p.Transfer = TransferIsochronous
+	case 'I':
+		p.Transfer = TransferInterrupt
+	case 'C':
+		p.Transfer = TransferControl
+	case 'B':
+		p.Transfer = TransferBulk
+	default:
+		return nil, fmt.Errorf("usbmon: bad transfer type: %q", f[3])
+	}
+	bus, err1 := strconv.ParseUint(addr[1], 10, 16)
+	dev, err2 := strconv.ParseUint(addr[2], 10, 8)
+	ep, err3 := strconv.ParseUint(addr[3], 10, 8)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, fmt.Errorf("usbmon: bad address: %q", f[3])
+	}
+	p.Bus, p.Device, p.Endpoint = uint16(bus), byte(dev), byte(ep)
+	if addr[0][1] == 'i' {
+		p.Endpoint |= 0x80
+	}
+
+	rest := f[4:]
+	if rest[0] == "s" {
+		// bmRequestType bRequest wValue wIndex wLength
+		if len(rest) < 6 {
+			return nil, fmt.Errorf("usbmon: short setup packet")
+		}
+		var setup [8]byte
+		for i, w := range rest[1:6] {
+			v, err := strconv.ParseUint(w, 16, 16)
+			if err != nil {
+				return nil, fmt.Errorf("usbmon: bad setup packet: %v", err)
+			}
+			if i < 2 {
+				setup[i] = byte(v)
+			} else {
+				binary.LittleEndian.PutUint16(setup[2+(i-2)*2:], uint16(v))
+			}
+		}
+		p.Setup = setup[:]
+		rest = rest[6:]
+	} else {
+		// status, optionally followed by the interval etc.
+		status, err := strconv.ParseInt(strings.Split(rest[0], ":")[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("usbmon: bad status: %v", err)
+		}
+		p.Status = int32(status)
+		rest = rest[1:]
+	}
+
+	if len(rest) < 2 {
+		return nil, fmt.Errorf("usbmon: missing data length")
+	}
+	length, err := strconv.ParseUint(rest[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("usbmon: bad data length: %v", err)
+	}
+	p.Length = uint32(length)
+	if rest[1] == "=" {
+		data, err := hex.DecodeString(strings.Join(rest[2:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("usbmon: bad data: %v", err)
+		}
+		p.Data = data
+	}
+	return &p, nil
+}
+
+// USBMonTextReader reads packets in the usbmon text format
+type USBMonTextReader struct {
+	s *bufio.Scanner
+}
+
+func NewUSBMonTextReader(r io.Reader) *USBMonTextReader {
+	return &USBMonTextReader{
+		s: bufio.NewScanner(r),
+	}
+}
+
+func (r *USBMonTextReader) ReadPacket() (*USBPacket, error) {
+	for r.s.Scan() {
+		line := strings.TrimSpace(r.s.Text())
+		if line == "" {
+			continue
+		}
+		return ParseUSBMonText(line)
+	}
+	if err := r.s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,72 @@
+package pcap_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod/pcap"
+)
+
+func TestParseUSBMonText(t *testing.T) {
+	cases := []struct {
+		line string
+		want pcap.USBPacket
+	}{
+		{
+			line: "ffff88003a1f6840 3575914555 C Ii:1:005:1 0:8 4 = 01020304",
+			want: pcap.USBPacket{
+				ID: 0xffff88003a1f6840, Type: 'C', Transfer: pcap.TransferInterrupt,
+				Endpoint: 0x81, Device: 5, Bus: 1,
+				Timestamp: time.Unix(0, 3575914555*int64(time.Microsecond)),
+				Length:    4, Data: []byte{0x01, 0x02, 0x03, 0x04},
+			},
+		},
+		{
+			line: "ffff88003a1f6840 3575914555 S Co:2:003:0 s 21 09 0213 0002 0005 5 = 13005504 00",
+			want: pcap.USBPacket{
+				ID: 0xffff88003a1f6840, Type: 'S', Transfer: pcap.TransferControl,
+				Endpoint: 0x00, Device: 3, Bus: 2,
+				Timestamp: time.Unix(0, 3575914555*int64(time.Microsecond)),
+				Setup:     []byte{0x21, 0x09, 0x13, 0x02, 0x02, 0x00, 0x05, 0x00},
+				Length:    5, Data: []byte{0x13, 0x00, 0x55, 0x04, 0x00},
+			},
+		},
+		{
+			line: "ffff88003a1f6840 3575914555 S Ii:1:005:1 -115:8 64 <",
+			want: pcap.USBPacket{
+				ID: 0xffff88003a1f6840, Type: 'S', Transfer: pcap.TransferInterrupt,
+				Endpoint: 0x81, Device: 5, Bus: 1,
+				Timestamp: time.Unix(0, 3575914555*int64(time.Microsecond)),
+				Status:    -115, Length: 64,
+			},
+		},
+	}
+	for _, c := range cases {
+		got, err := pcap.ParseUSBMonText(c.line)
+		if err != nil {
+			t.Errorf("%q: %v", c.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, c.want) {
+			t.Errorf("%q:\n got %+v\nwant %+v", c.line, *got, c.want)
+		}
+	}
+
+	for _, line := range []string{"", "ffff 1 C", "ffff88003a1f6840 1 C Xi:1:005:1 0 4 = 01"} {
+		if _, err := pcap.ParseUSBMonText(line); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+
+	r := pcap.NewUSBMonTextReader(strings.NewReader("\n" + cases[0].line + "\n\n" + cases[1].line + "\n"))
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.ReadPacket(); err == nil {
+		t.Errorf("expected EOF")
+	}
+}
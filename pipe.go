@@ -0,0 +1,63 @@
+package ipod
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// PipeTransport is one end of an in-memory transport created by Pipe
+type PipeTransport struct {
+	r    <-chan []byte
+	w    chan<- []byte
+	done chan struct{}
+	once *sync.Once
+}
+
+// Pipe returns the two ends of an in-memory transport: frames written
+// to one end are read from the other in order. Closing either end makes
+// reads return io.EOF and writes io.ErrClosedPipe on both.
+func Pipe() (*PipeTransport, *PipeTransport) {
+	ab, ba := make(chan []byte, 64), make(chan []byte, 64)
+	done := make(chan struct{})
+	once := &sync.Once{}
+	return &PipeTransport{r: ba, w: ab, done: done, once: once},
+		&PipeTransport{r: ab, w: ba, done: done, once: once}
+}
+
+func (p *PipeTransport) ReadFrame() ([]byte, error) {
+	return p.ReadFrameContext(context.Background())
+}
+
+func (p *PipeTransport) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	select {
+	case frame := <-p.r:
+		return frame, nil
+	case <-p.done:
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *PipeTransport) WriteFrame(data []byte) error {
+	frame := make([]byte, len(data))
+	copy(frame, data)
+	select {
+	case <-p.done:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case p.w <- frame:
+		return nil
+	case <-p.done:
+		return io.ErrClosedPipe
+	}
+}
+
+// Close closes both ends of the pipe
+func (p *PipeTransport) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
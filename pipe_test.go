@@ -0,0 +1,50 @@
+package ipod_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := ipod.Pipe()
+	frames := [][]byte{{0x01}, {0x02, 0x03}}
+	for _, f := range frames {
+		if err := a.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.WriteFrame([]byte{0x04}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range frames {
+		got, err := b.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got % 02x want % 02x", got, want)
+		}
+	}
+	if got, err := a.ReadFrame(); err != nil || !bytes.Equal(got, []byte{0x04}) {
+		t.Errorf("got % 02x, %v want 04", got, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := ipod.ReadFrameContext(ctx, a); err != context.DeadlineExceeded {
+		t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+	}
+
+	b.Close()
+	if _, err := a.ReadFrame(); err != io.EOF {
+		t.Errorf("read after close: got %v want EOF", err)
+	}
+	if err := a.WriteFrame([]byte{0x05}); err != io.ErrClosedPipe {
+		t.Errorf("write after close: got %v want %v", err, io.ErrClosedPipe)
+	}
+}
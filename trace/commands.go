@@ -0,0 +1,271 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+)
+
+// CommandRecord is a decoded command of a command trace.
+// Command traces are JSON lines, one record per line i.e.
+//
+//	{"ts":0.0015,"dir":"<","frame":0,"name":"general.RequestiPodName","id":"0x00,0x07","packet":"00 07"}
+//
+// The packet is the raw iap packet payload, so a command trace
+// can be encoded again for any hid report defs.
+type CommandRecord struct {
+	// TS is the time since the start of the trace
+	TS  time.Duration `json:"-"`
+	Dir Dir           `json:"dir"`
+	// Frame is the number of the frame the command was sent in.
+	// Commands sharing a frame number and direction are sent together.
+	Frame  uint                   `json:"frame"`
+	Name   string                 `json:"name,omitempty"`
+	ID     string                 `json:"id,omitempty"`
+	Trx    *uint16                `json:"trx,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Packet string                 `json:"packet"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+type commandRecordJSON struct {
+	TS float64 `json:"ts"`
+	*commandRecordAlias
+}
+
+type commandRecordAlias CommandRecord
+
+func (rec *CommandRecord) MarshalJSON() ([]byte, error) {
+	// json.Marshal would escape the < and > directions
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(commandRecordJSON{
+		TS:                 rec.TS.Seconds(),
+		commandRecordAlias: (*commandRecordAlias)(rec),
+	})
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), err
+}
+
+func (rec *CommandRecord) UnmarshalJSON(data []byte) error {
+	v := commandRecordJSON{commandRecordAlias: (*commandRecordAlias)(rec)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	rec.TS = time.Duration(v.TS*float64(time.Second) + 0.5)
+	return nil
+}
+
+// NewCommandRecord describes a command and the packet it was decoded from
+// or encoded to. cmd may be nil if the packet could not be decoded.
+func NewCommandRecord(dir Dir, frame uint, cmd *ipod.Command, packet []byte, err error) *CommandRecord {
+	rec := &CommandRecord{
+		Dir:    dir,
+		Frame:  frame,
+		Packet: fmt.Sprintf("% 02X", packet),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if cmd != nil {
+		rec.ID = cmd.ID.String()
+		if cmd.Payload != nil {
+			rec.Name = strings.TrimPrefix(fmt.Sprintf("%T", cmd.Payload), "*")
+			if fields, ok := jsonValue(reflect.ValueOf(cmd.Payload)).(map[string]interface{}); ok {
+				rec.Fields = fields
+			}
+		}
+		if cmd.Transaction != nil {
+			trx := uint16(*cmd.Transaction)
+			rec.Trx = &trx
+		}
+	}
+	return rec
+}
+
+// jsonValue converts a payload to values that read well as json:
+// structs become objects and byte slices hex strings
+func jsonValue(v reflect.Value) interface{} {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		fields := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				continue
+			}
+			fields[t.Field(i).Name] = jsonValue(v.Field(i))
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return fmt.Sprintf("% 02X", b)
+		}
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = jsonValue(v.Index(i))
+		}
+		return values
+	}
+	return v.Interface()
+}
+
+// PacketData returns the raw packet of the record
+func (rec *CommandRecord) PacketData() ([]byte, error) {
+	return hex.DecodeString(strings.Replace(rec.Packet, " ", "", -1))
+}
+
+// CommandWriter writes a command trace. It is safe for concurrent use.
+type CommandWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func NewCommandWriter(w io.Writer) *CommandWriter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &CommandWriter{
+		w:   w,
+		enc: enc,
+	}
+}
+
+func (w *CommandWriter) WriteRecord(rec *CommandRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(rec)
+}
+
+// Close closes the underlying writer if it is an io.Closer
+func (w *CommandWriter) Close() error {
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// CommandReader reads a command trace
+type CommandReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func NewCommandReader(r io.Reader) *CommandReader {
+	s := bufio.NewScanner(newDecompressReader(r))
+	s.Buffer(nil, 1<<20)
+	return &CommandReader{s: s}
+}
+
+func (r *CommandReader) ReadRecord(rec *CommandRecord) error {
+	for r.s.Scan() {
+		r.line++
+		text := strings.TrimSpace(r.s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		*rec = CommandRecord{}
+		if err := json.Unmarshal([]byte(text), rec); err != nil {
+			return fmt.Errorf("command trace line %d: %v", r.line, err)
+		}
+		return nil
+	}
+	if err := r.s.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// IsCommandTrace reports whether the start of a trace looks like a command trace
+func IsCommandTrace(start []byte) bool {
+	text := strings.TrimSpace(string(start))
+	return strings.HasPrefix(text, "{")
+}
+
+type msgCollector struct {
+	dir  Dir
+	ts   time.Duration
+	msgs []*Msg
+}
+
+func (c *msgCollector) WriteReport(report hid.Report) error {
+	data := append([]byte{report.ID, byte(report.LinkControl)}, report.Data...)
+	c.msgs = append(c.msgs, &Msg{Dir: c.dir, TS: c.ts, Data: data})
+	return nil
+}
+
+// EncodeCommands converts a command trace into a raw report trace using
+// the given report defs. The packets are decoded and encoded again with
+// a CommandSerde using the recorded transaction mode,
+// packets that can't be decoded are copied as is.
+func EncodeCommands(r *CommandReader, w *Writer, reportDefs hid.ReportDefs) error {
+	var pending *CommandRecord
+	pw := ipod.NewPacketWriter()
+	flush := func() error {
+		if pending == nil {
+			return nil
+		}
+		c := &msgCollector{dir: pending.Dir, ts: pending.TS}
+		if err := hid.NewEncoderDir(c, reportDefs, pending.Dir.ReportDir()).WriteFrame(pw.Bytes()); err != nil {
+			return err
+		}
+		for _, msg := range c.msgs {
+			if err := w.WriteMsg(msg); err != nil {
+				return err
+			}
+		}
+		pw = ipod.NewPacketWriter()
+		pending = nil
+		return nil
+	}
+
+	for {
+		var rec CommandRecord
+		err := r.ReadRecord(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if pending != nil && (pending.Dir != rec.Dir || pending.Frame != rec.Frame) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		packet, err := rec.PacketData()
+		if err != nil {
+			return fmt.Errorf("command trace: bad packet %q: %v", rec.Packet, err)
+		}
+		serde := ipod.CommandSerde{TrxEnabled: rec.Trx != nil}
+		if cmd, err := serde.UnmarshalCmd(packet); err == nil {
+			if encoded, err := serde.MarshalCmd(cmd); err == nil {
+				packet = encoded
+			}
+		}
+		if err := pw.WritePacket(packet); err != nil {
+			return err
+		}
+		pending = &rec
+	}
+	return flush()
+}
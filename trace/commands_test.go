@@ -0,0 +1,141 @@
+package trace_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+func testCommandRecords(t *testing.T) []*trace.CommandRecord {
+	t.Helper()
+	name := bytes.Repeat([]byte("a"), 80)
+	cmds := []struct {
+		dir     trace.Dir
+		payload interface{}
+		trx     *ipod.Transaction
+	}{
+		{trace.DirIn, &general.StartIDPS{}, ipod.NewTransaction(1)},
+		{trace.DirIn, &general.RequestiPodName{}, ipod.NewTransaction(2)},
+		{trace.DirOut, &general.ReturniPodName{Name: append(name, 0)}, ipod.NewTransaction(2)},
+	}
+	var recs []*trace.CommandRecord
+	for i, c := range cmds {
+		cmd, err := ipod.BuildCommand(c.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.Transaction = c.trx
+		serde := ipod.CommandSerde{TrxEnabled: true}
+		pkt, err := serde.MarshalCmd(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := trace.NewCommandRecord(c.dir, uint(i), cmd, pkt, nil)
+		rec.TS = time.Duration(i) * time.Millisecond
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestCommandWriteRead(t *testing.T) {
+	recs := testCommandRecords(t)
+	var buf bytes.Buffer
+	w := trace.NewCommandWriter(&buf)
+	for _, rec := range recs {
+		if err := w.WriteRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !trace.IsCommandTrace(buf.Bytes()) {
+		t.Errorf("not detected as a command trace:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"dir":"<"`) {
+		t.Errorf("directions are escaped:\n%s", buf.String())
+	}
+
+	r := trace.NewCommandReader(&buf)
+	for i, want := range recs {
+		var rec trace.CommandRecord
+		if err := r.ReadRecord(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Dir != want.Dir || rec.Frame != want.Frame || rec.TS != want.TS ||
+			rec.Name != want.Name || rec.ID != want.ID || rec.Packet != want.Packet ||
+			!reflect.DeepEqual(rec.Trx, want.Trx) {
+			t.Errorf("record %d: got %+v want %+v", i, rec, *want)
+		}
+	}
+	var rec trace.CommandRecord
+	if err := r.ReadRecord(&rec); err != io.EOF {
+		t.Errorf("got %v want EOF", err)
+	}
+
+	if recs[2].Name != "general.ReturniPodName" || recs[2].Fields["Name"] == nil {
+		t.Errorf("bad fields %+v", recs[2])
+	}
+}
+
+func TestEncodeCommands(t *testing.T) {
+	recs := testCommandRecords(t)
+	for _, reportDefs := range []hid.ReportDefs{hid.DefaultReportDefs, hid.LegacyReportDefs} {
+		var cmdBuf bytes.Buffer
+		w := trace.NewCommandWriter(&cmdBuf)
+		for _, rec := range recs {
+			w.WriteRecord(rec)
+		}
+
+		var buf bytes.Buffer
+		if err := trace.EncodeCommands(trace.NewCommandReader(&cmdBuf), trace.NewWriter(&buf), reportDefs); err != nil {
+			t.Fatal(err)
+		}
+		tr := trace.NewReader(&buf)
+		q := trace.Queue{}
+		for _, msg := range readAllMsgs(t, tr) {
+			msg := msg
+			q.Enqueue(&msg)
+		}
+
+		for _, rec := range recs {
+			d := hid.NewDecoder(hid.NewReportReader(trace.NewQueueDirReader(&q, rec.Dir)), reportDefs)
+			frame, err := d.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pkt, err := ipod.NewPacketReader(frame).ReadPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := rec.PacketData()
+			if !bytes.Equal(pkt, want) {
+				t.Errorf("%s: got packet % 02x want % 02x", rec.Name, pkt, want)
+			}
+		}
+	}
+}
+
+func TestEncodeCommandsReportDirs(t *testing.T) {
+	var cmdBuf bytes.Buffer
+	w := trace.NewCommandWriter(&cmdBuf)
+	for _, rec := range testCommandRecords(t) {
+		w.WriteRecord(rec)
+	}
+	var buf bytes.Buffer
+	if err := trace.EncodeCommands(trace.NewCommandReader(&cmdBuf), trace.NewWriter(&buf), hid.LegacyReportDefs); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range readAllMsgs(t, trace.NewReader(&buf)) {
+		id := msg.Data[0]
+		// the accessory sends 0x0D-0x15 with the legacy descriptor
+		if in := id >= 0x0D && id <= 0x15; in != (msg.Dir == trace.DirIn) {
+			t.Errorf("%v message in report %#02x", msg.Dir, id)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package trace
+
+import (
+	"io"
+	"time"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+)
+
+// Packet is a packet of a frame and the command it contains
+type Packet struct {
+	Data   []byte
+	Err    error
+	Cmd    *ipod.Command
+	CmdErr error
+}
+
+// Frame is a frame reassembled from the reports of a trace
+type Frame struct {
+	Dir Dir
+	// TS is the timestamp of the first report of the frame
+	TS      time.Duration
+	Msgs    []*Msg
+	Data    []byte
+	Err     error
+	Packets []Packet
+}
+
+// Commands returns the commands of the frame that could be decoded
+func (f *Frame) Commands() []*ipod.Command {
+	var cmds []*ipod.Command
+	for _, p := range f.Packets {
+		if p.Err == nil && p.CmdErr == nil {
+			cmds = append(cmds, p.Cmd)
+		}
+	}
+	return cmds
+}
+
+// ReportDir returns the hid report direction of the messages of dir:
+// inbound messages are sent by the accessory
+func (d Dir) ReportDir() hid.ReportDir {
+	if d == DirIn {
+		return hid.ReportDirAccOut
+	}
+	return hid.ReportDirAccIn
+}
+
+// Decoder reassembles the frames of both directions of a trace
+// and decodes their packets and commands.
+// Frames are returned in the order of their first report.
+//
+// Each direction has its own CommandSerde. The transaction mode is
+// negotiated by the accessory so outbound commands are decoded
+// in the mode last selected by an inbound command.
+type Decoder struct {
+	r          *Reader
+	reportDefs hid.ReportDefs
+	q          Queue
+	eof        bool
+	err        error
+	serdes     [2]ipod.CommandSerde
+}
+
+func NewDecoder(r *Reader, reportDefs hid.ReportDefs) *Decoder {
+	return &Decoder{
+		r:          r,
+		reportDefs: reportDefs,
+	}
+}
+
+// fill reads the next message of the trace into the queue
+func (d *Decoder) fill() bool {
+	if d.eof || d.err != nil {
+		return false
+	}
+	var msg Msg
+	err := d.r.ReadMsg(&msg)
+	if err == io.EOF {
+		d.eof = true
+		return false
+	}
+	if err != nil {
+		d.err = err
+		return false
+	}
+	d.q.Enqueue(&msg)
+	return true
+}
+
+// frameReader reads the messages of one direction and remembers them
+type frameReader struct {
+	d    *Decoder
+	dir  Dir
+	msgs []*Msg
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	msg := r.d.q.DequeueDir(r.dir)
+	for msg == nil {
+		if !r.d.fill() {
+			if r.d.err != nil {
+				return 0, r.d.err
+			}
+			return 0, io.EOF
+		}
+		msg = r.d.q.DequeueDir(r.dir)
+	}
+	r.msgs = append(r.msgs, msg)
+	return copy(p, msg.Data), nil
+}
+
+// Next returns the next frame or io.EOF at the end of the trace.
+// Errors decoding the frame, packets or commands are reported
+// in the frame, the returned error is only set if the trace can't be read.
+func (d *Decoder) Next() (*Frame, error) {
+	head := d.q.Head()
+	for head == nil {
+		if !d.fill() {
+			if d.err != nil {
+				return nil, d.err
+			}
+			return nil, io.EOF
+		}
+		head = d.q.Head()
+	}
+
+	fr := &frameReader{d: d, dir: head.Dir}
+	data, err := hid.NewDecoder(hid.NewReportReader(fr), d.reportDefs).ReadFrame()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err == io.EOF {
+		// the trace ended in the middle of a frame
+		err = io.ErrUnexpectedEOF
+	}
+	frame := &Frame{
+		Dir:  head.Dir,
+		TS:   head.TS,
+		Msgs: fr.msgs,
+		Data: append([]byte(nil), data...),
+		Err:  err,
+	}
+	if err != nil {
+		return frame, nil
+	}
+
+	serde := &d.serdes[frame.Dir]
+	if frame.Dir == DirOut {
+		serde.TrxEnabled = d.serdes[DirIn].TrxEnabled
+	}
+	packetReader := ipod.NewPacketReader(frame.Data)
+	for {
+		packet, err := packetReader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		p := Packet{Data: packet, Err: err}
+		if err == nil {
+			p.Cmd, p.CmdErr = serde.UnmarshalCmd(packet)
+		}
+		frame.Packets = append(frame.Packets, p)
+	}
+	return frame, nil
+}
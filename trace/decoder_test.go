@@ -0,0 +1,135 @@
+package trace_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/hid"
+	general "github.com/oandrew/ipod/lingo-general"
+	"github.com/oandrew/ipod/trace"
+)
+
+type msgWriter struct {
+	dir  trace.Dir
+	msgs []*trace.Msg
+}
+
+func (w *msgWriter) WriteReport(report hid.Report) error {
+	data := append([]byte{report.ID, byte(report.LinkControl)}, report.Data...)
+	w.msgs = append(w.msgs, &trace.Msg{Dir: w.dir, Data: data})
+	return nil
+}
+
+func encodeFrame(t *testing.T, dir trace.Dir, payload interface{}, trx uint16) []*trace.Msg {
+	t.Helper()
+	cmd, err := ipod.BuildCommand(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Transaction = ipod.NewTransaction(trx)
+	serde := ipod.CommandSerde{TrxEnabled: true}
+	pkt, err := serde.MarshalCmd(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := ipod.NewPacketWriter()
+	pw.WritePacket(pkt)
+	w := &msgWriter{dir: dir}
+	if err := hid.NewEncoder(w, hid.DefaultReportDefs).WriteFrame(pw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return w.msgs
+}
+
+func TestDecoder(t *testing.T) {
+	name := append(bytes.Repeat([]byte("n"), 200), 0)
+	startIDPS := encodeFrame(t, trace.DirIn, &general.StartIDPS{}, 1)
+	request := encodeFrame(t, trace.DirIn, &general.RequestiPodName{}, 2)
+	response := encodeFrame(t, trace.DirOut, &general.ReturniPodName{Name: name}, 2)
+	request2 := encodeFrame(t, trace.DirIn, &general.RequestiPodName{}, 3)
+	if len(response) < 3 {
+		t.Fatalf("expected a multi report frame, got %d reports", len(response))
+	}
+
+	// the second request arrives while the response is being sent
+	var msgs []*trace.Msg
+	msgs = append(msgs, startIDPS...)
+	msgs = append(msgs, request...)
+	msgs = append(msgs, response[0])
+	msgs = append(msgs, request2...)
+	msgs = append(msgs, response[1:]...)
+
+	var buf bytes.Buffer
+	tw := trace.NewWriter(&buf)
+	for _, msg := range msgs {
+		if err := tw.WriteMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []struct {
+		dir  trace.Dir
+		name string
+		trx  uint16
+		msgs int
+	}{
+		{trace.DirIn, "general.StartIDPS", 1, len(startIDPS)},
+		{trace.DirIn, "general.RequestiPodName", 2, len(request)},
+		{trace.DirOut, "general.ReturniPodName", 2, len(response)},
+		{trace.DirIn, "general.RequestiPodName", 3, len(request2)},
+	}
+
+	d := trace.NewDecoder(trace.NewReader(&buf), hid.DefaultReportDefs)
+	for i, w := range want {
+		frame, err := d.Next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if frame.Err != nil {
+			t.Fatalf("frame %d: %v", i, frame.Err)
+		}
+		if frame.Dir != w.dir || len(frame.Msgs) != w.msgs {
+			t.Errorf("frame %d: got dir %v with %d msgs want %v with %d", i, frame.Dir, len(frame.Msgs), w.dir, w.msgs)
+		}
+		cmds := frame.Commands()
+		if len(cmds) != 1 {
+			t.Fatalf("frame %d: got %d commands: %+v", i, len(cmds), frame.Packets)
+		}
+		cmd := cmds[0]
+		if cmd.Transaction == nil || uint16(*cmd.Transaction) != w.trx {
+			t.Errorf("frame %d: got transaction %v want %d", i, cmd.Transaction, w.trx)
+		}
+		if got := trace.NewCommandRecord(frame.Dir, 0, cmd, nil, nil).Name; got != w.name {
+			t.Errorf("frame %d: got %s want %s", i, got, w.name)
+		}
+		if p, ok := cmd.Payload.(*general.ReturniPodName); ok && !bytes.Equal(p.Name, name) {
+			t.Errorf("frame %d: got name %q", i, p.Name)
+		}
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("got %v want EOF", err)
+	}
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	response := encodeFrame(t, trace.DirOut, &general.ReturniPodName{Name: make([]byte, 200)}, 1)
+	var buf bytes.Buffer
+	tw := trace.NewWriter(&buf)
+	for _, msg := range response[:len(response)-1] {
+		tw.WriteMsg(msg)
+	}
+
+	d := trace.NewDecoder(trace.NewReader(&buf), hid.DefaultReportDefs)
+	frame, err := d.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v want %v", frame.Err, io.ErrUnexpectedEOF)
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("got %v want EOF", err)
+	}
+}
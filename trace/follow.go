@@ -0,0 +1,98 @@
+package trace
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// FollowReader reads a file that is still being written like tail -f.
+// At the end of the file it waits for more data instead of returning io.EOF.
+// If the file is rotated or truncated it continues with the new file
+// from the start. Read returns io.EOF once the context is done.
+type FollowReader struct {
+	ctx      context.Context
+	path     string
+	interval time.Duration
+	f        *os.File
+}
+
+// OpenFollow opens the file for following, checking for new data every interval
+func OpenFollow(ctx context.Context, path string, interval time.Duration) (*FollowReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FollowReader{
+		ctx:      ctx,
+		path:     path,
+		interval: interval,
+		f:        f,
+	}, nil
+}
+
+func (r *FollowReader) Read(p []byte) (int, error) {
+	for {
+		if r.ctx.Err() != nil {
+			return 0, io.EOF
+		}
+		n, err := r.f.Read(p)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		reopened, err := r.reopen()
+		if err != nil {
+			return 0, err
+		}
+		if reopened {
+			continue
+		}
+
+		t := time.NewTimer(r.interval)
+		select {
+		case <-t.C:
+		case <-r.ctx.Done():
+			t.Stop()
+		}
+	}
+}
+
+// reopen starts over if the file was replaced or truncated
+func (r *FollowReader) reopen() (bool, error) {
+	st, err := os.Stat(r.path)
+	if err != nil {
+		// in the middle of a rotation
+		return false, nil
+	}
+	cur, err := r.f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !os.SameFile(st, cur) {
+		f, err := os.Open(r.path)
+		if err != nil {
+			return false, nil
+		}
+		r.f.Close()
+		r.f = f
+		return true, nil
+	}
+	offset, err := r.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	if st.Size() < offset {
+		_, err := r.f.Seek(0, io.SeekStart)
+		return err == nil, err
+	}
+	return false, nil
+}
+
+func (r *FollowReader) Close() error {
+	return r.f.Close()
+}
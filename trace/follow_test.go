@@ -0,0 +1,91 @@
+package trace_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oandrew/ipod/trace"
+)
+
+func TestFollowReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipod.trace")
+
+	rf, err := trace.OpenRotatingFile(path, false, trace.RotateConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	tw := trace.NewWriter(rf)
+	if err := tw.WriteHeader(&trace.Header{Device: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fr, err := trace.OpenFollow(ctx, path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+
+	type result struct {
+		msg trace.Msg
+		err error
+	}
+	results := make(chan result)
+	go func() {
+		tr := trace.NewReader(fr)
+		for {
+			var msg trace.Msg
+			err := tr.ReadMsg(&msg)
+			results <- result{msg, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	next := func() result {
+		t.Helper()
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return result{}
+	}
+
+	for i := byte(0); i < 3; i++ {
+		if i == 2 {
+			if err := rf.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.WriteMsg(&trace.Msg{Dir: trace.DirIn, Data: []byte{0x0b, i}}); err != nil {
+			t.Fatal(err)
+		}
+		r := next()
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.msg.Data[1] != i {
+			t.Errorf("got % 02x want message %d", r.msg.Data, i)
+		}
+	}
+
+	cancel()
+	if r := next(); r.err != io.EOF {
+		t.Errorf("got %v want EOF", r.err)
+	}
+}
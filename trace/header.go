@@ -0,0 +1,75 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oandrew/ipod/hid"
+)
+
+// Version is the current version of the trace format
+const Version = 2
+
+// Header describes how a trace was recorded.
+// It is stored at the beginning of a trace as '!' prefixed lines.
+type Header struct {
+	Version    int
+	Date       time.Time
+	Tool       string
+	Device     string
+	Legacy     bool
+	ReportDefs hid.ReportDefs
+}
+
+func (h *Header) writeTo(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "!ipod-trace %d\n", h.Version)
+	if !h.Date.IsZero() {
+		fmt.Fprintf(&b, "!date %s\n", h.Date.Format(time.RFC3339))
+	}
+	if h.Tool != "" {
+		fmt.Fprintf(&b, "!tool %s\n", h.Tool)
+	}
+	if h.Device != "" {
+		fmt.Fprintf(&b, "!device %s\n", h.Device)
+	}
+	fmt.Fprintf(&b, "!legacy %t\n", h.Legacy)
+	if len(h.ReportDefs) > 0 {
+		fmt.Fprintf(&b, "!reportdefs %v\n", h.ReportDefs)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// parseLine parses a single header line without the '!' prefix.
+// Unknown keys are ignored.
+func (h *Header) parseLine(text string) error {
+	var key, value string
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		key, value = text[:i], strings.TrimSpace(text[i+1:])
+	} else {
+		key = text
+	}
+	var err error
+	switch key {
+	case "ipod-trace":
+		h.Version, err = strconv.Atoi(value)
+	case "date":
+		h.Date, err = time.Parse(time.RFC3339, value)
+	case "tool":
+		h.Tool = value
+	case "device":
+		h.Device = value
+	case "legacy":
+		h.Legacy, err = strconv.ParseBool(value)
+	case "reportdefs":
+		h.ReportDefs, err = hid.ParseReportDefs(value)
+	}
+	if err != nil {
+		return fmt.Errorf("trace header %s: %v", key, err)
+	}
+	return nil
+}
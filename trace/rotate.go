@@ -0,0 +1,387 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// segmentTimeFormat is used to name rotated files so they sort by time
+const segmentTimeFormat = "20060102-150405.000000"
+
+// segmentPattern matches the suffix of rotated files
+var segmentPattern = regexp.MustCompile(`\.\d{8}-\d{6}\.\d{6}(\.gz)?$`)
+
+// RotateConfig controls when a RotatingFile starts a new file
+// and what happens to the old ones
+type RotateConfig struct {
+	// MaxSize rotates the file before it grows beyond MaxSize bytes (0 disables)
+	MaxSize int64
+	// MaxAge rotates the file once it is older than MaxAge (0 disables)
+	MaxAge time.Duration
+	// Compress gzips rotated files
+	Compress bool
+	// MaxFiles is the number of rotated files to keep (0 keeps all)
+	MaxFiles int
+}
+
+// RotatingFile is a file that is moved aside and replaced with a new one
+// once it gets too big or too old. Rotated files are named
+// path.YYYYMMDD-HHMMSS.UUUUUU[.gz]. Rotation only happens between writes
+// so lines written by Writer are never split across files, and the trace
+// header is repeated at the start of every file.
+type RotatingFile struct {
+	mu     sync.Mutex
+	path   string
+	cfg    RotateConfig
+	f      *os.File
+	size   int64
+	opened time.Time
+	header []byte
+	// retryAt delays the next rotation after a failed one
+	retryAt time.Time
+
+	// bg serializes the compression and pruning of rotated files
+	// which run in the background, wg waits for them on Close
+	bg sync.Mutex
+	wg sync.WaitGroup
+}
+
+// OpenRotatingFile opens the file for writing. Unless appendMode is set
+// the file is truncated and the files rotated from it are removed,
+// so they are not read as part of the new trace.
+func OpenRotatingFile(path string, appendMode bool, cfg RotateConfig) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path: path,
+		cfg:  cfg,
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !appendMode {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		segments, err := rotatedSegments(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, segment := range segments {
+			if err := os.Remove(segment); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := rf.open(flag); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open opens the file at path, rf.f is left alone on error
+func (rf *RotatingFile) open(flag int) error {
+	f, err := os.OpenFile(rf.path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size, rf.opened = f, stat.Size(), time.Now()
+	return nil
+}
+
+// setHeader remembers the header to repeat in new files
+func (rf *RotatingFile) setHeader(header []byte) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.header = append([]byte(nil), header...)
+}
+
+func (rf *RotatingFile) needsRotation(n int) bool {
+	if rf.size == 0 || rf.size == int64(len(rf.header)) || time.Now().Before(rf.retryAt) {
+		return false
+	}
+	if rf.cfg.MaxSize > 0 && rf.size+int64(n) > rf.cfg.MaxSize {
+		return true
+	}
+	return rf.cfg.MaxAge > 0 && time.Since(rf.opened) >= rf.cfg.MaxAge
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.needsRotation(len(p)) {
+		if err := rf.rotate(); err != nil {
+			// losing the trace is worse than a file too big
+			logrus.WithError(err).WithField("path", rf.path).Warn("trace: could not rotate the file")
+			rf.retryAt = time.Now().Add(time.Minute)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Size returns the size of the current file
+func (rf *RotatingFile) Size() int64 {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.size
+}
+
+// Rotate starts a new file now
+func (rf *RotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return os.ErrClosed
+	}
+	return rf.rotate()
+}
+
+func (rf *RotatingFile) rotate() error {
+	rotated := rotatedName(rf.path, time.Now())
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return err
+	}
+	// keep writing to the rotated file if a new one can't be created
+	old := rf.f
+	if err := rf.open(os.O_WRONLY | os.O_CREATE | os.O_TRUNC); err != nil {
+		return err
+	}
+	if err := old.Close(); err != nil {
+		logrus.WithError(err).WithField("path", rotated).Warn("trace: could not close the rotated file")
+	}
+	rf.wg.Add(1)
+	go rf.archive(rotated)
+	if len(rf.header) > 0 {
+		n, err := rf.f.Write(rf.header)
+		rf.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+// archive compresses the rotated file and removes the oldest ones
+func (rf *RotatingFile) archive(rotated string) {
+	defer rf.wg.Done()
+	rf.bg.Lock()
+	defer rf.bg.Unlock()
+	if rf.cfg.Compress {
+		if err := gzipFile(rotated); err != nil {
+			logrus.WithError(err).WithField("path", rotated).Warn("trace: could not compress the rotated file")
+		}
+	}
+	if err := rf.prune(); err != nil {
+		logrus.WithError(err).WithField("path", rf.path).Warn("trace: could not remove old rotated files")
+	}
+}
+
+// rotatedName returns an unused name for a rotated file
+func rotatedName(path string, t time.Time) string {
+	for {
+		name := path + "." + t.Format(segmentTimeFormat)
+		if !exists(name) && !exists(name+".gz") {
+			return name
+		}
+		t = t.Add(time.Microsecond)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// prune removes the oldest rotated files
+func (rf *RotatingFile) prune() error {
+	if rf.cfg.MaxFiles <= 0 {
+		return nil
+	}
+	segments, err := rotatedSegments(rf.path)
+	if err != nil {
+		return err
+	}
+	for len(segments) > rf.cfg.MaxFiles {
+		if err := os.Remove(segments[0]); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+// Close closes the file and waits for rotated files to be compressed
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return os.ErrClosed
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	rf.wg.Wait()
+	return err
+}
+
+// gzipFile replaces the file with a gzip compressed path.gz
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// readers must not pick up a partially written segment
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// rotatedSegments returns the rotated files of path, oldest first
+func rotatedSegments(path string) ([]string, error) {
+	matches, err := filepath.Glob(globEscape(path) + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, m := range matches {
+		if segmentPattern.MatchString(m[len(path):]) {
+			segments = append(segments, m)
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func globEscape(path string) string {
+	var buf bytes.Buffer
+	for _, c := range path {
+		switch c {
+		case '*', '?', '[', '\\':
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+type multiReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiReadCloser) Close() error {
+	var err error
+	for _, c := range m.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// OpenSegments opens the rotated files of path followed by path itself
+// as a single stream that can be passed to NewReader
+func OpenSegments(path string) (io.ReadCloser, error) {
+	segments, err := rotatedSegments(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &multiReadCloser{}
+	var readers []io.Reader
+	for _, p := range append(segments, path) {
+		f, err := os.Open(p)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.closers = append(m.closers, f)
+		readers = append(readers, f)
+	}
+	m.Reader = io.MultiReader(readers...)
+	return m, nil
+}
+
+// gzipMagic is the first byte of a gzip stream.
+// It never appears in a trace which is plain text.
+const gzipMagic = 0x1f
+
+// decompressReader passes plain text through and decompresses
+// gzip streams found on the way, so concatenated plain and gzipped
+// segments read as one trace
+type decompressReader struct {
+	br *bufio.Reader
+	zr *gzip.Reader
+}
+
+func newDecompressReader(r io.Reader) *decompressReader {
+	return &decompressReader{br: bufio.NewReader(r)}
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	for {
+		if d.zr != nil {
+			n, err := d.zr.Read(p)
+			if err == io.EOF {
+				d.zr = nil
+				if n > 0 {
+					return n, nil
+				}
+				continue
+			}
+			return n, err
+		}
+
+		b, err := d.br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if b[0] == gzipMagic {
+			if d.zr, err = gzip.NewReader(d.br); err != nil {
+				return 0, err
+			}
+			d.zr.Multistream(false)
+			continue
+		}
+
+		buf, _ := d.br.Peek(d.br.Buffered())
+		if i := bytes.IndexByte(buf, gzipMagic); i != -1 {
+			buf = buf[:i]
+		}
+		n := copy(p, buf)
+		d.br.Discard(n)
+		return n, nil
+	}
+}
@@ -0,0 +1,198 @@
+package trace_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oandrew/ipod/trace"
+)
+
+func readAllMsgs(t *testing.T, tr *trace.Reader) []trace.Msg {
+	t.Helper()
+	var msgs []trace.Msg
+	for {
+		var m trace.Msg
+		err := tr.ReadMsg(&m)
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipod.trace")
+
+	rf, err := trace.OpenRotatingFile(path, false, trace.RotateConfig{
+		MaxSize:  100,
+		Compress: true,
+		MaxFiles: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := trace.NewWriter(rf)
+	if err := w.WriteHeader(&trace.Header{Tool: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := w.WriteMsg(&trace.Msg{Dir: trace.DirIn, Data: []byte{byte(i), 0, 0, 0, 0, 0}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, _ := filepath.Glob(path + ".*.gz")
+	if len(gz) != 3 {
+		t.Errorf("rotated files: %v", gz)
+	}
+
+	f, err := trace.OpenSegments(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := trace.NewReader(f)
+	hdr, err := tr.Header()
+	if err != nil || hdr == nil || hdr.Tool != "test" {
+		t.Fatalf("header: %+v %v", hdr, err)
+	}
+	msgs := readAllMsgs(t, tr)
+	if len(msgs) == 0 || len(msgs) >= 20 {
+		t.Fatalf("messages: %d", len(msgs))
+	}
+	// the oldest segments were pruned, the rest is in order and complete
+	first := int(msgs[0].Data[0])
+	for i, m := range msgs {
+		if int(m.Data[0]) != first+i {
+			t.Errorf("msg %d: %x", i, m.Data)
+		}
+	}
+	if last := msgs[len(msgs)-1].Data[0]; last != 19 {
+		t.Errorf("last msg: %d", last)
+	}
+}
+
+func TestRotatingFileRotateError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipod.trace")
+
+	rf, err := trace.OpenRotatingFile(path, false, trace.RotateConfig{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	// the file can't be renamed anymore, the writes go on
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := rf.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if err := rf.Rotate(); err == nil {
+		t.Errorf("Rotate() expected error")
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotatingFileTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipod.trace")
+
+	writeTrace := func(tool string, appendMode bool, n int) {
+		rf, err := trace.OpenRotatingFile(path, appendMode, trace.RotateConfig{MaxSize: 100, Compress: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := trace.NewWriter(rf)
+		if err := w.WriteHeader(&trace.Header{Tool: tool}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err := w.WriteMsg(&trace.Msg{Dir: trace.DirIn, Data: []byte{byte(i), 0, 0, 0, 0, 0}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTrace("old", false, 20)
+	if gz, _ := filepath.Glob(path + ".*.gz"); len(gz) == 0 {
+		t.Fatalf("the old trace was not rotated")
+	}
+
+	// a new trace over the old one leaves none of it behind
+	writeTrace("new", false, 2)
+	f, err := trace.OpenSegments(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := trace.NewReader(f)
+	hdr, err := tr.Header()
+	if err != nil || hdr == nil || hdr.Tool != "new" {
+		t.Fatalf("header: %+v %v", hdr, err)
+	}
+	msgs := readAllMsgs(t, tr)
+	if len(msgs) != 2 || msgs[0].Data[0] != 0 || msgs[1].Data[0] != 1 {
+		t.Errorf("messages: %v", msgs)
+	}
+	if files, _ := filepath.Glob(path + "*"); len(files) != 1 {
+		t.Errorf("files left: %v", files)
+	}
+}
+
+func TestReadGzip(t *testing.T) {
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+	var buf bytes.Buffer
+	buf.Write(gzipped("< 01\n> 02\n"))
+	buf.Write(gzipped("< 03\n"))
+	buf.WriteString("> 04\n")
+	buf.Write(gzipped("< 05\n"))
+
+	msgs := readAllMsgs(t, trace.NewReader(&buf))
+	var got []string
+	for _, m := range msgs {
+		got = append(got, string(m.Data))
+	}
+	if s := strings.Join(got, ""); s != "\x01\x02\x03\x04\x05" {
+		t.Errorf("messages: %q", s)
+	}
+}
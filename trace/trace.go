@@ -6,6 +6,11 @@ import (
 	"container/list"
 	"fmt"
 	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -42,13 +47,22 @@ func (d *Dir) UnmarshalText(text []byte) error {
 	return fmt.Errorf("trace dir unmarshal: unknown symbol '%c'", text[0])
 }
 
+// Msg is a single message of a trace
 type Msg struct {
-	Dir  Dir
-	TS   uint
-	Data []byte
+	Dir Dir
+	// TS is the time since the start of the trace,
+	// always zero for traces without timestamps
+	TS time.Duration
+	// Index is the position of the message in the trace
+	Index uint
+	Data  []byte
 }
 
 func (m Msg) MarshalText() ([]byte, error) {
+	return m.marshalText(false)
+}
+
+func (m Msg) marshalText(withTS bool) ([]byte, error) {
 	dt, err := m.Dir.MarshalText()
 	if err != nil {
 		return nil, err
@@ -57,10 +71,27 @@ func (m Msg) MarshalText() ([]byte, error) {
 		return nil, fmt.Errorf("trace marshal: no data")
 	}
 
+	if withTS {
+		t := fmt.Sprintf("%c %d.%06d % 02X", dt[0], m.TS/time.Second, m.TS%time.Second/time.Microsecond, m.Data)
+		return []byte(t), nil
+	}
 	t := fmt.Sprintf("%c % 02X", dt[0], m.Data)
 	return []byte(t), nil
 }
 
+func parseTS(text []byte) (time.Duration, error) {
+	parts := bytes.SplitN(text, []byte{'.'}, 2)
+	sec, err := strconv.ParseUint(string(parts[0]), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	usec, err := strconv.ParseUint(string(parts[1]), 10, 32)
+	if err != nil || len(parts[1]) != 6 {
+		return 0, fmt.Errorf("bad fraction")
+	}
+	return time.Duration(sec)*time.Second + time.Duration(usec)*time.Microsecond, nil
+}
+
 func (m *Msg) UnmarshalText(text []byte) error {
 	if len(text) < 4 {
 		return fmt.Errorf("trace unmarshal: short msg")
@@ -69,7 +100,21 @@ func (m *Msg) UnmarshalText(text []byte) error {
 		return err
 	}
 
-	h := bytes.Join(bytes.Split(text[2:], []byte{' '}), []byte{})
+	fields := bytes.Fields(text[2:])
+	m.TS = 0
+	if len(fields) > 0 && bytes.IndexByte(fields[0], '.') >= 0 {
+		ts, err := parseTS(fields[0])
+		if err != nil {
+			return fmt.Errorf("trace unmarshal: bad timestamp")
+		}
+		m.TS = ts
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("trace unmarshal: no data")
+	}
+
+	h := bytes.Join(fields, []byte{})
 	var data []byte
 	_, err := fmt.Sscanf(string(h), "%x", &data)
 	if err != nil {
@@ -81,42 +126,96 @@ func (m *Msg) UnmarshalText(text []byte) error {
 }
 
 type Reader struct {
-	s   *bufio.Scanner
-	err error
-	ts  uint
+	s     *bufio.Scanner
+	err   error
+	index uint
+	hdr   *Header
+	line  []byte
 }
 
+// NewReader reads a trace. Gzip compressed traces and concatenated
+// segments written by RotatingFile, compressed or not, are read as one trace.
 func NewReader(r io.Reader) *Reader {
 	return &Reader{
-		s: bufio.NewScanner(r),
+		s: bufio.NewScanner(newDecompressReader(r)),
 	}
 }
 
-func (r *Reader) ReadMsg(m *Msg) error {
-	if r.err != nil {
-		return r.err
-	}
+// scanLine returns the next message line
+// consuming header lines on the way
+func (r *Reader) scanLine() ([]byte, error) {
 	for r.s.Scan() {
 		text := r.s.Bytes()
 		if len(text) == 0 {
 			continue
 		}
-		err := m.UnmarshalText(text)
-		if err == nil {
-			m.TS = r.ts
-			r.ts++
+		if text[0] == '#' {
+			// comments are annotations for humans
+			continue
 		}
-		return err
+		if text[0] == '!' {
+			if r.hdr == nil {
+				r.hdr = &Header{}
+			}
+			if err := r.hdr.parseLine(string(text[1:])); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return text, nil
 	}
 	r.err = r.s.Err()
 	if r.err == nil {
 		r.err = io.EOF
 	}
-	return r.err
+	return nil, r.err
+}
+
+// Header returns the trace header or nil if the trace has none
+// i.e. it was recorded before timestamps were introduced.
+func (r *Reader) Header() (*Header, error) {
+	if r.line == nil && r.err == nil {
+		line, err := r.scanLine()
+		if err != nil && r.err == nil {
+			return nil, err
+		}
+		r.line = append([]byte(nil), line...)
+	}
+	return r.hdr, nil
 }
 
+func (r *Reader) ReadMsg(m *Msg) error {
+	text := r.line
+	r.line = nil
+	if len(text) == 0 {
+		if r.err != nil {
+			return r.err
+		}
+		var err error
+		if text, err = r.scanLine(); err != nil {
+			return err
+		}
+	}
+	err := m.UnmarshalText(text)
+	if err == nil {
+		m.Index = r.index
+		r.index++
+	}
+	return err
+}
+
+// Writer writes trace messages. It is safe for concurrent use,
+// every message is written as a whole line.
 type Writer struct {
-	w io.Writer
+	mu     sync.Mutex
+	w      io.Writer
+	bw     *bufio.Writer
+	withTS bool
+	// offset is added to the timestamps of a continued trace
+	offset time.Duration
+
+	stop chan struct{}
+	done chan struct{}
 }
 
 func NewWriter(w io.Writer) *Writer {
@@ -125,26 +224,157 @@ func NewWriter(w io.Writer) *Writer {
 	}
 }
 
+// NewBufferedWriter is like NewWriter but buffers the messages and
+// flushes them every flushInterval. Only whole lines are flushed.
+// Close must be called to stop flushing and write out the rest.
+func NewBufferedWriter(w io.Writer, flushInterval time.Duration) *Writer {
+	tw := &Writer{
+		w:    w,
+		bw:   bufio.NewWriter(w),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go tw.flushLoop(flushInterval)
+	return tw
+}
+
+func (w *Writer) flushLoop(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Flush()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// writeLine writes a line making sure a buffered line is never split
+// between two flushes
+func (w *Writer) writeLine(line []byte) error {
+	if w.bw == nil {
+		_, err := w.w.Write(line)
+		return err
+	}
+	if w.bw.Available() < len(line) {
+		if err := w.bw.Flush(); err != nil {
+			return err
+		}
+	}
+	_, err := w.bw.Write(line)
+	return err
+}
+
+// Flush writes out buffered messages
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.bw == nil {
+		return nil
+	}
+	return w.bw.Flush()
+}
+
+// Close flushes buffered messages and closes the underlying writer
+// if it is an io.Closer
+func (w *Writer) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+	err := w.Flush()
+	if c, ok := w.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// WriteHeader writes the trace header.
+// Messages written afterwards carry timestamps.
+func (w *Writer) WriteHeader(h *Header) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	h.Version = Version
+	var buf bytes.Buffer
+	if err := h.writeTo(&buf); err != nil {
+		return err
+	}
+	if rf, ok := w.w.(*RotatingFile); ok {
+		rf.setHeader(buf.Bytes())
+	}
+	if err := w.writeLine(buf.Bytes()); err != nil {
+		return err
+	}
+	w.withTS = true
+	return nil
+}
+
+// Continue prepares the writer to append to a trace with the header h
+// whose last message has the timestamp last. The header is not written
+// again, a RotatingFile still repeats it in new files, and the timestamps
+// of the messages written afterwards continue after last.
+func (w *Writer) Continue(h *Header, last time.Duration) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	h.Version = Version
+	var buf bytes.Buffer
+	if err := h.writeTo(&buf); err != nil {
+		return err
+	}
+	if rf, ok := w.w.(*RotatingFile); ok {
+		rf.setHeader(buf.Bytes())
+	}
+	w.withTS = true
+	w.offset = last
+	return nil
+}
+
 func (w *Writer) WriteMsg(m *Msg) error {
-	t, err := m.MarshalText()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.offset != 0 {
+		mm := *m
+		mm.TS += w.offset
+		m = &mm
+	}
+	t, err := m.marshalText(w.withTS)
 	if err != nil {
 		return err
 	}
 	t = append(t, '\n')
-	n, err := w.w.Write(t)
-	_ = n
-	return err
+	return w.writeLine(t)
+}
+
+// WriteComment writes the text as comment lines starting with "# ".
+// Comments are skipped by Reader.
+func (w *Writer) WriteComment(text string) error {
+	var buf bytes.Buffer
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		buf.WriteString("# ")
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writeLine(buf.Bytes())
 }
 
 type tracer struct {
-	tw *Writer
-	rw io.ReadWriter
+	tw    *Writer
+	rw    io.ReadWriter
+	start time.Time
 }
 
 func (t *tracer) Write(p []byte) (n int, err error) {
 	n, err = t.rw.Write(p)
 	if err == nil {
-		t.tw.WriteMsg(&Msg{Dir: DirOut, Data: p[:n]})
+		t.tw.WriteMsg(&Msg{Dir: DirOut, TS: time.Since(t.start), Data: p[:n]})
 	}
 	return
 }
@@ -152,15 +382,38 @@ func (t *tracer) Write(p []byte) (n int, err error) {
 func (t *tracer) Read(p []byte) (n int, err error) {
 	n, err = t.rw.Read(p)
 	if err == nil {
-		t.tw.WriteMsg(&Msg{Dir: DirIn, Data: p[:n]})
+		t.tw.WriteMsg(&Msg{Dir: DirIn, TS: time.Since(t.start), Data: p[:n]})
 	}
 	return
 }
 
+// SetReadDeadline sets the read deadline of the underlying device if supported
+func (t *tracer) SetReadDeadline(d time.Time) error {
+	if dr, ok := t.rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return dr.SetReadDeadline(d)
+	}
+	return os.ErrNoDeadline
+}
+
+// SetWriteDeadline sets the write deadline of the underlying device if supported
+func (t *tracer) SetWriteDeadline(d time.Time) error {
+	if dw, ok := t.rw.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return dw.SetWriteDeadline(d)
+	}
+	return os.ErrNoDeadline
+}
+
 func NewTracer(tw io.Writer, rw io.ReadWriter) io.ReadWriter {
+	return NewTracerWriter(NewWriter(tw), rw)
+}
+
+// NewTracerWriter is like NewTracer but writes to tw
+// which may already have a header written
+func NewTracerWriter(tw *Writer, rw io.ReadWriter) io.ReadWriter {
 	return &tracer{
-		tw: NewWriter(tw),
-		rw: rw,
+		tw:    tw,
+		rw:    rw,
+		start: time.Now(),
 	}
 }
 
@@ -6,8 +6,11 @@ import (
 	"io/ioutil"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/oandrew/ipod/hid"
 	"github.com/oandrew/ipod/trace"
 )
 
@@ -90,6 +93,132 @@ func TestReadWrite(t *testing.T) {
 	}
 }
 
+func TestHeader(t *testing.T) {
+	hdr := trace.Header{
+		Date:       time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC),
+		Tool:       "ipod test",
+		Device:     "/dev/iap0",
+		Legacy:     true,
+		ReportDefs: hid.LegacyReportDefs,
+	}
+	msgs := []trace.Msg{
+		{Dir: trace.DirIn, TS: 0, Index: 0, Data: []byte{0x01}},
+		{Dir: trace.DirOut, TS: 1500 * time.Microsecond, Index: 1, Data: []byte{0x02, 0x03}},
+		{Dir: trace.DirIn, TS: 61*time.Second + time.Microsecond, Index: 2, Data: []byte{0x04}},
+	}
+
+	buf := bytes.Buffer{}
+	w := trace.NewWriter(&buf)
+	if err := w.WriteHeader(&hdr); err != nil {
+		t.Fatal(err)
+	}
+	for i := range msgs {
+		if err := w.WriteMsg(&msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Logf("marshaled:\n%s", buf.String())
+
+	r := trace.NewReader(&buf)
+	got, err := r.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, &hdr) {
+		t.Errorf("header: %#v != %#v", got, &hdr)
+	}
+	for i := range msgs {
+		var m trace.Msg
+		if err := r.ReadMsg(&m); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, msgs[i]) {
+			t.Errorf("msg1 != msg2: m1=%#v, m2=%#v", msgs[i], m)
+		}
+	}
+	if err := r.ReadMsg(&trace.Msg{}); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestWriterContinue(t *testing.T) {
+	hdr := trace.Header{Tool: "ipod test", ReportDefs: hid.DefaultReportDefs}
+	buf := bytes.Buffer{}
+	w := trace.NewWriter(&buf)
+	if err := w.WriteHeader(&hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteMsg(&trace.Msg{Dir: trace.DirIn, TS: 2 * time.Second, Data: []byte{0x01}}); err != nil {
+		t.Fatal(err)
+	}
+
+	w = trace.NewWriter(&buf)
+	if err := w.Continue(&hdr, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteMsg(&trace.Msg{Dir: trace.DirOut, TS: time.Second, Data: []byte{0x02}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "!ipod-trace"); n != 1 {
+		t.Errorf("%d headers:\n%s", n, buf.String())
+	}
+	msgs := readAllMsgs(t, trace.NewReader(&buf))
+	if len(msgs) != 2 || msgs[1].TS != 3*time.Second {
+		t.Errorf("continued messages: %+v", msgs)
+	}
+}
+
+func TestReadMixed(t *testing.T) {
+	tests := []struct {
+		name    string
+		t       string
+		wantTS  time.Duration
+		wantErr bool
+	}{
+		{"v1", "< 01 02\n", 0, false},
+		{"v2", "< 1.250000 01 02\n", 1250 * time.Millisecond, false},
+		{"v2-no-data", "< 1.250000\n", 0, true},
+		{"v2-bad-ts", "< 1.25 01 02\n", 0, true},
+		{"comment", "# marker: start\n< 1.250000 01 02\n# general.ACK\n", 1250 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := trace.NewReader(strings.NewReader(tt.t))
+			if hdr, _ := r.Header(); hdr != nil {
+				t.Errorf("unexpected header: %#v", hdr)
+			}
+			var m trace.Msg
+			err := r.ReadMsg(&m)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Reader.ReadMsg() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if m.TS != tt.wantTS || !bytes.Equal(m.Data, []byte{0x01, 0x02}) {
+				t.Errorf("Reader.ReadMsg() = %#v", m)
+			}
+		})
+	}
+}
+
+func TestWriteComment(t *testing.T) {
+	var buf bytes.Buffer
+	w := trace.NewWriter(&buf)
+	w.WriteHeader(&trace.Header{})
+	w.WriteMsg(&trace.Msg{Dir: trace.DirIn, Data: []byte{0x01}})
+	w.WriteComment("general.RequestiPodName\nsecond line")
+	w.WriteMsg(&trace.Msg{Dir: trace.DirOut, Data: []byte{0x02}})
+	if !strings.Contains(buf.String(), "\n# general.RequestiPodName\n# second line\n>") {
+		t.Errorf("comment not written:\n%s", buf.String())
+	}
+
+	msgs := readAllMsgs(t, trace.NewReader(&buf))
+	if len(msgs) != 2 || msgs[1].Index != 1 || msgs[1].Data[0] != 0x02 {
+		t.Errorf("got %#v", msgs)
+	}
+}
+
 func TestTracer(t *testing.T) {
 	tbuf := bytes.Buffer{}
 	buf := bytes.Buffer{}
@@ -127,6 +256,78 @@ func TestTracer(t *testing.T) {
 	})
 }
 
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBufferedWriter(t *testing.T) {
+	var buf lockedBuffer
+	w := trace.NewBufferedWriter(&buf, 10*time.Millisecond)
+
+	t.Run("flush", func(t *testing.T) {
+		w.WriteMsg(&trace.Msg{Dir: trace.DirIn, Data: []byte{0x01}})
+		deadline := time.Now().Add(time.Second)
+		for buf.String() == "" && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if buf.String() != "< 01\n" {
+			t.Errorf("trace: %q != %q", buf.String(), "< 01\n")
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				data := bytes.Repeat([]byte{byte(i)}, 64)
+				for j := 0; j < 100; j++ {
+					w.WriteMsg(&trace.Msg{Dir: trace.DirOut, Data: data})
+				}
+			}(i)
+		}
+		wg.Wait()
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := trace.NewReader(strings.NewReader(buf.String()))
+		n := 0
+		for {
+			var m trace.Msg
+			err := r.ReadMsg(&m)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("msg %d: %v", n, err)
+			}
+			if len(m.Data) != 1 && !bytes.Equal(m.Data, bytes.Repeat(m.Data[:1], 64)) {
+				t.Fatalf("msg %d: interleaved data %x", n, m.Data)
+			}
+			n++
+		}
+		if n != 801 {
+			t.Errorf("messages: %d != %d", n, 801)
+		}
+	})
+}
+
 var testReports = `
 < 01
 > 02
@@ -1,5 +1,7 @@
 package ipod
 
+import "context"
+
 type FrameReader interface {
 	// ReadFrame reads a frame that contains
 	// one or more iap packets
@@ -18,3 +20,23 @@ type FrameReadWriter interface {
 	FrameReader
 	FrameWriter
 }
+
+// FrameReaderContext is implemented by transports
+// that support cancelable reads
+type FrameReaderContext interface {
+	// ReadFrameContext reads a frame until ctx is done
+	ReadFrameContext(ctx context.Context) ([]byte, error)
+}
+
+// ReadFrameContext reads a frame from r.
+// If r does not implement FrameReaderContext
+// ctx is only checked before the read.
+func ReadFrameContext(ctx context.Context, r FrameReader) ([]byte, error) {
+	if rc, ok := r.(FrameReaderContext); ok {
+		return rc.ReadFrameContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.ReadFrame()
+}